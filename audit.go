@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	uaa "github.com/cloudfoundry-community/go-uaa"
+	"github.com/govau/torque/config"
+)
+
+// What audit found for a ci user
+const (
+	// AuditUnmanaged the user exists in UAA but no configured space has it, so torque never
+	// rotates its password
+	AuditUnmanaged = "unmanaged"
+	// AuditMissing a configured space should have the user, but it is not in UAA
+	AuditMissing = "missing"
+	// AuditUnreachable the cf's UAA could not be read, so its users were not audited
+	AuditUnreachable = "unreachable"
+)
+
+// AuditEntry a ci user that is in UAA or the config, but not both, or a cf that could not be
+// audited
+type AuditEntry struct {
+	CfID     string `json:"cf_id"`
+	Username string `json:"username,omitempty"`
+	Status   string `json:"status"`
+	// Error why the cf's UAA could not be read, if it is unreachable
+	Error string `json:"error,omitempty"`
+	// Space the configured space the user is for, if it is missing
+	Space  string `json:"space,omitempty"`
+	Origin string `json:"origin,omitempty"`
+	Active *bool  `json:"active,omitempty"`
+	// PasswordLastModified and LastLogon are zero for missing users, and for users that never
+	// logged on
+	PasswordLastModified time.Time `json:"password_last_modified"`
+	LastLogon            time.Time `json:"last_logon"`
+}
+
+// managedUsernames the ci users the config says each cf should have, by cf ID and then username,
+// with the space each is for
+func managedUsernames(s *config.Settings) map[string]map[string]spaceKey {
+	managed := map[string]map[string]spaceKey{}
+	for id := range cfInfos {
+		managed[id] = map[string]spaceKey{}
+	}
+	for _, cfOrg := range s.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			key := spaceKey{cfOrg.Name, cfSpace.Name}
+			usernames := []string{cfUserName(cfOrg.Name, cfSpace.Name)}
+			if cfSpace.Strategy == config.StrategyDual {
+				usernames = []string{}
+				for _, side := range dualSides {
+					usernames = append(usernames, dualUserName(cfOrg.Name, cfSpace.Name, side))
+				}
+			}
+			for _, id := range rotatedCfIDs(cfSpace) {
+				for _, username := range usernames {
+					managed[id][username] = key
+				}
+			}
+		}
+	}
+	return managed
+}
+
+// auditUsers compare the ci users found in each cf's UAA, by cf ID, with those the config manages.
+// A cf whose UAA could not be read is reported as unreachable, rather than all its users missing.
+func auditUsers(managed map[string]map[string]spaceKey, found map[string][]uaa.User, unreachable map[string]error) []AuditEntry {
+	entries := []AuditEntry{}
+	for _, id := range sortedCfIDs() {
+		if err, ok := unreachable[id]; ok {
+			entries = append(entries, AuditEntry{CfID: id, Status: AuditUnreachable, Error: err.Error()})
+			continue
+		}
+		exists := map[string]bool{}
+		for _, user := range found[id] {
+			exists[user.Username] = true
+			if _, ok := managed[id][user.Username]; ok {
+				continue
+			}
+			entry := AuditEntry{
+				CfID:     id,
+				Username: user.Username,
+				Status:   AuditUnmanaged,
+				Origin:   user.Origin,
+				Active:   user.Active,
+			}
+			// An unreadable time is shown as never, rather than hiding the user
+			entry.PasswordLastModified, _ = passwordLastModified(&user)
+			if user.LastLogonTime != 0 {
+				entry.LastLogon = time.Unix(0, int64(user.LastLogonTime)*int64(time.Millisecond)).UTC()
+			}
+			entries = append(entries, entry)
+		}
+		for username, key := range managed[id] {
+			if !exists[username] {
+				entries = append(entries, AuditEntry{CfID: id, Username: username, Status: AuditMissing, Space: key.String()})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].CfID != entries[j].CfID {
+			return entries[i].CfID < entries[j].CfID
+		}
+		return entries[i].Username < entries[j].Username
+	})
+	return entries
+}
+
+// findCIUsers every user in the cf's UAA whose name starts with ci-
+func (cf *CfInfo) findCIUsers() ([]uaa.User, error) {
+	if cf.Err != nil {
+		return nil, cf.Err
+	}
+	filter := `userName sw "ci-"`
+	if cf.UaaOrigin != "" {
+		filter = fmt.Sprintf(`%s and origin eq "%s"`, filter, cf.UaaOrigin)
+	}
+	users, err := cf.UaaAPI.ListAllUsers(filter, "userName", "", uaa.SortAscending)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing ci users in UAA %s: %v", cf.UaaAPI.TargetURL, err)
+	}
+	return users, nil
+}
+
+// findAllCIUsers the ci users in every cf's UAA, by cf ID, and why each cf whose UAA could not be
+// read was not
+func findAllCIUsers() (map[string][]uaa.User, map[string]error) {
+	found := map[string][]uaa.User{}
+	unreachable := map[string]error{}
+	for _, id := range sortedCfIDs() {
+		users, err := cfInfos[id].findCIUsers()
+		if err != nil {
+			unreachable[id] = err
+			continue
+		}
+		found[id] = users
+	}
+	return found, unreachable
+}
+
+// writeAudit write the entries in the given format, either "table" or "json"
+func writeAudit(w io.Writer, entries []AuditEntry, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "CF\tUSERNAME\tSTATUS\tSPACE\tACTIVE\tPASSWORD LAST MODIFIED\tLAST LOGON")
+		for _, e := range entries {
+			active := ""
+			if e.Active != nil {
+				active = fmt.Sprint(*e.Active)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.CfID, e.Username, e.Status, e.Space, active,
+				auditTime(e.PasswordLastModified, e.Status), auditTime(e.LastLogon, e.Status))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("Unknown audit format: %s", format)
+	}
+}
+
+// auditTime a time for the table, blank for a missing user or an unreachable cf, which have no
+// times
+func auditTime(t time.Time, status string) string {
+	switch {
+	case status != AuditUnmanaged:
+		return ""
+	case t.IsZero():
+		return "never"
+	default:
+		return t.Format(time.RFC3339)
+	}
+}
+
+// audit the audit command, which lists ci users in UAA that no configured space manages, and
+// configured spaces whose ci users are missing. Returns false if any cf's UAA could not be read,
+// after auditing the rest.
+func audit(args []string) bool {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	format := flags.String("format", "table", "Output format, table or json")
+	flags.Parse(args)
+
+	initCfInfos()
+	found, unreachable := findAllCIUsers()
+	for _, id := range sortedErrors(unreachable) {
+		fmt.Fprintln(os.Stderr, unreachable[id])
+	}
+
+	entries := auditUsers(managedUsernames(settings), found, unreachable)
+	if err := writeAudit(os.Stdout, entries, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return len(unreachable) == 0
+}
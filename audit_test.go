@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	uaa "github.com/cloudfoundry-community/go-uaa"
+	"github.com/govau/torque/config"
+)
+
+func Test_AuditUsers_ReportsUnmanagedAndMissingUsers(t *testing.T) {
+	defer func(c map[string]*CfInfo) { cfInfos = c }(cfInfos)
+	cfInfos = map[string]*CfInfo{"A": {ID: "A"}, "B": {ID: "B"}}
+	s := &config.Settings{
+		Orgs: []config.CfOrg{{
+			Name: "org",
+			Spaces: []config.CfSpace{
+				{Name: "single", Strategy: config.StrategySingle, SkipIDs: []string{"B"}},
+				{Name: "dual", Strategy: config.StrategyDual},
+			},
+		}},
+	}
+	active := true
+	found := map[string][]uaa.User{
+		"A": {
+			{Username: "ci-org-single"},
+			{Username: "ci-org-dual-a"},
+			{Username: "ci-org-dual-b"},
+			{Username: "ci-old-space", Active: &active, PasswordLastModified: "2019-01-02T03:04:05.000Z", LastLogonTime: 1546398245000},
+		},
+		"B": {{Username: "ci-org-dual-a"}, {Username: "ci-org-single"}},
+	}
+
+	entries := auditUsers(managedUsernames(s), found, nil)
+	want := []struct{ cfID, username, status string }{
+		{"A", "ci-old-space", AuditUnmanaged},
+		{"B", "ci-org-dual-b", AuditMissing},
+		{"B", "ci-org-single", AuditUnmanaged},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("auditUsers() expected %d entries, got %+v", len(want), entries)
+	}
+	for i, w := range want {
+		if entries[i].CfID != w.cfID || entries[i].Username != w.username || entries[i].Status != w.status {
+			t.Errorf("auditUsers() expected %s %s %s, got %+v", w.cfID, w.username, w.status, entries[i])
+		}
+	}
+	if entries[1].Space != "org/dual" {
+		t.Errorf("auditUsers() expected the missing user's space, got %q", entries[1].Space)
+	}
+	if got := entries[0].LastLogon; !got.Equal(time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("auditUsers() expected the last logon time, got %v", got)
+	}
+
+	decoded := []AuditEntry{}
+	buf := &bytes.Buffer{}
+	if err := writeAudit(buf, entries, "json"); err != nil {
+		t.Fatalf("writeAudit() error: %v", err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 3 {
+		t.Errorf("writeAudit() expected 3 entries as JSON, got %s, %v", buf, err)
+	}
+	buf.Reset()
+	if err := writeAudit(buf, entries, "table"); err != nil {
+		t.Fatalf("writeAudit() error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "2019-01-02T03:04:05Z") {
+		t.Errorf("writeAudit() expected the password's last change in the table, got\n%s", buf)
+	}
+}
+
+func Test_FindAllCIUsers_UnreachableCf_AuditsTheRest(t *testing.T) {
+	defer func(c map[string]*CfInfo) { cfInfos = c }(cfInfos)
+	up, down := newFakeCf(), newFakeCf()
+	defer up.server.Close()
+	up.addUser("ci-old-space", time.Time{})
+	cfInfos = map[string]*CfInfo{"A": down.connect(t, "A"), "B": up.connect(t, "B")}
+	down.server.Close()
+
+	found, unreachable := findAllCIUsers()
+	if unreachable["A"] == nil || len(unreachable) != 1 {
+		t.Fatalf("findAllCIUsers() expected only A to be unreachable, got %v", unreachable)
+	}
+	entries := auditUsers(map[string]map[string]spaceKey{}, found, unreachable)
+	if len(entries) != 2 {
+		t.Fatalf("auditUsers() expected 2 entries, got %+v", entries)
+	}
+	if entries[0].CfID != "A" || entries[0].Status != AuditUnreachable || entries[0].Error == "" {
+		t.Errorf("auditUsers() expected A to be unreachable with its error, got %+v", entries[0])
+	}
+	if entries[1].CfID != "B" || entries[1].Username != "ci-old-space" || entries[1].Status != AuditUnmanaged {
+		t.Errorf("auditUsers() expected B's unmanaged user, got %+v", entries[1])
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeAudit(buf, entries, "table"); err != nil {
+		t.Fatalf("writeAudit() error: %v", err)
+	}
+	if !strings.Contains(buf.String(), AuditUnreachable) {
+		t.Errorf("writeAudit() expected the unreachable cf in the table, got\n%s", buf)
+	}
+}
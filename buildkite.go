@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Buildkite a SecretSink delivering to Buildkite secrets, whose targets are org/pipeline slugs.
+// Secrets belong to the pipeline's cluster, so each key starts with the pipeline's slug, e.g.
+// MY_APP_CF_PASSWORD_STAGING for my-app, and only that pipeline may read it.
+type Buildkite struct {
+	api *apiClient
+}
+
+type buildkiteSecret struct {
+	ID          string `json:"id,omitempty"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	Description string `json:"description,omitempty"`
+	Policy      string `json:"policy,omitempty"`
+}
+
+// buildkitePageSize the most results Buildkite returns in one page
+const buildkitePageSize = 100
+
+// NewBuildkite Create new Buildkite instance. The token is tested and any error is returned.
+func NewBuildkite(apiURL string, token string) (*Buildkite, error) {
+	b := &Buildkite{
+		api: newAPIClient("buildkite", apiURL, nil, http.Header{"Authorization": {"Bearer " + token}}),
+	}
+
+	accessToken := struct {
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := b.api.do(http.MethodGet, "/v2/access-token", nil, &accessToken); err != nil {
+		return nil, fmt.Errorf("Bad buildkite token: %v", err)
+	}
+	if *verbose {
+		log.Printf("Buildkite Token has scopes %v", accessToken.Scopes)
+	}
+	return b, nil
+}
+
+var invalidSecretKeyChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// secretKeyPrefix the start of the keys of the pipeline's secrets, its slug in upper snake case
+func secretKeyPrefix(pipeline string) string {
+	return invalidSecretKeyChars.ReplaceAllString(strings.ToUpper(pipeline), "_") + "_"
+}
+
+// clusterSecretsPath the path of the secrets API of the pipeline's cluster. Pipelines that are not
+// in a cluster cannot have secrets.
+func (b *Buildkite) clusterSecretsPath(orgAndPipeline string) (string, error) {
+	org, pipeline, err := SplitOrgAndRepo(orgAndPipeline)
+	if err != nil {
+		return "", err
+	}
+	p := struct {
+		ClusterID string `json:"cluster_id"`
+	}{}
+	if err := b.api.do(http.MethodGet, fmt.Sprintf("/v2/organizations/%s/pipelines/%s", org, pipeline), nil, &p); err != nil {
+		return "", err
+	}
+	if p.ClusterID == "" {
+		return "", fmt.Errorf("buildkite pipeline %s is not in a cluster, which secrets need", orgAndPipeline)
+	}
+	return fmt.Sprintf("/v2/organizations/%s/clusters/%s/secrets", org, p.ClusterID), nil
+}
+
+// pipelineSecrets the pipeline's secrets in its cluster, by name without the key prefix
+func (b *Buildkite) pipelineSecrets(orgAndPipeline string) (string, map[string]buildkiteSecret, error) {
+	path, err := b.clusterSecretsPath(orgAndPipeline)
+	if err != nil {
+		return "", nil, err
+	}
+	_, pipeline, _ := SplitOrgAndRepo(orgAndPipeline)
+	prefix := secretKeyPrefix(pipeline)
+
+	secrets := map[string]buildkiteSecret{}
+	for page := 1; ; page++ {
+		list := []buildkiteSecret{}
+		if err := b.api.do(http.MethodGet, fmt.Sprintf("%s?per_page=%d&page=%d", path, buildkitePageSize, page), nil, &list); err != nil {
+			return "", nil, err
+		}
+		for _, secret := range list {
+			if strings.HasPrefix(secret.Key, prefix) {
+				secrets[strings.TrimPrefix(secret.Key, prefix)] = secret
+			}
+		}
+		if len(list) < buildkitePageSize {
+			return path, secrets, nil
+		}
+	}
+}
+
+// EnsureTarget ensure the pipeline can be seen and is in a cluster. Buildkite pipelines need
+// nothing enabling.
+func (b *Buildkite) EnsureTarget(orgAndPipeline string) error {
+	if *verbose {
+		log.Printf("Ensuring buildkite pipeline exists: %s", orgAndPipeline)
+	}
+	_, err := b.clusterSecretsPath(orgAndPipeline)
+	return err
+}
+
+// TargetReady whether the pipeline can be seen
+func (b *Buildkite) TargetReady(orgAndPipeline string) (bool, error) {
+	_, err := b.clusterSecretsPath(orgAndPipeline)
+	if isStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SecretNames the names of the pipeline's secrets, without the key prefix. Buildkite never
+// returns the values.
+func (b *Buildkite) SecretNames(orgAndPipeline string) (map[string]bool, error) {
+	_, secrets, err := b.pipelineSecrets(orgAndPipeline)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for name := range secrets {
+		names[name] = true
+	}
+	return names, nil
+}
+
+// SetSecret update the value of the pipeline's secret in place, or create it
+func (b *Buildkite) SetSecret(orgAndPipeline string, name string, value string) error {
+	path, secrets, err := b.pipelineSecrets(orgAndPipeline)
+	if err != nil {
+		return err
+	}
+	if secret, ok := secrets[name]; ok {
+		return b.api.do(http.MethodPut, fmt.Sprintf("%s/%s/value", path, secret.ID), map[string]string{"value": value}, nil)
+	}
+	return b.create(path, orgAndPipeline, name, value)
+}
+
+// SetStaticVars add each var that is not already a secret
+func (b *Buildkite) SetStaticVars(orgAndPipeline string, vars map[string]string) error {
+	path, secrets, err := b.pipelineSecrets(orgAndPipeline)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(vars) {
+		if _, ok := secrets[name]; ok {
+			continue
+		}
+		if err := b.create(path, orgAndPipeline, name, vars[name]); err != nil {
+			return fmt.Errorf("Problem adding secret to %s: %v", orgAndPipeline, err)
+		}
+	}
+	return nil
+}
+
+// create a secret only the pipeline can read
+func (b *Buildkite) create(path string, orgAndPipeline string, name string, value string) error {
+	_, pipeline, err := SplitOrgAndRepo(orgAndPipeline)
+	if err != nil {
+		return err
+	}
+	secret := buildkiteSecret{
+		Key:         secretKeyPrefix(pipeline) + name,
+		Value:       value,
+		Description: fmt.Sprintf("%s for %s, managed by torque", name, orgAndPipeline),
+		Policy:      fmt.Sprintf("- pipeline_slug: %s\n", pipeline),
+	}
+	return b.api.do(http.MethodPost, path, secret, nil)
+}
+
+// Delete the pipeline's secret
+func (b *Buildkite) Delete(orgAndPipeline string, name string) error {
+	path, secrets, err := b.pipelineSecrets(orgAndPipeline)
+	if err != nil {
+		return err
+	}
+	secret, ok := secrets[name]
+	if !ok {
+		return nil
+	}
+	return b.api.do(http.MethodDelete, fmt.Sprintf("%s/%s", path, secret.ID), nil, nil)
+}
+
+// BuildsInProgress the number of the pipeline's builds that are running or scheduled
+func (b *Buildkite) BuildsInProgress(orgAndPipeline string) (int, error) {
+	org, pipeline, err := SplitOrgAndRepo(orgAndPipeline)
+	if err != nil {
+		return 0, err
+	}
+	builds := []struct {
+		ID string `json:"id"`
+	}{}
+	path := fmt.Sprintf("/v2/organizations/%s/pipelines/%s/builds?state[]=running&state[]=scheduled&per_page=%d", org, pipeline, buildkitePageSize)
+	if err := b.api.do(http.MethodGet, path, nil, &builds); err != nil {
+		return 0, err
+	}
+	return len(builds), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBuildkite a Buildkite org with pipelines in one cluster, and the cluster's secrets
+type fakeBuildkite struct {
+	mu      sync.Mutex
+	secrets map[string]buildkiteSecret
+	nextID  int
+}
+
+func newFakeBuildkite() (*fakeBuildkite, *httptest.Server) {
+	f := &fakeBuildkite{secrets: map[string]buildkiteSecret{}}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeBuildkite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, `{"message":"Authentication required"}`, http.StatusUnauthorized)
+		return
+	}
+	const secrets = "/v2/organizations/govau/clusters/cluster-1/secrets"
+	switch {
+	case r.URL.Path == "/v2/access-token":
+		json.NewEncoder(w).Encode(map[string][]string{"scopes": {"read_pipelines", "write_secrets"}})
+	case r.URL.Path == "/v2/organizations/govau/pipelines/my-app":
+		json.NewEncoder(w).Encode(map[string]string{"slug": "my-app", "cluster_id": "cluster-1"})
+	case r.URL.Path == "/v2/organizations/govau/pipelines/my-app/builds":
+		json.NewEncoder(w).Encode([]map[string]string{{"id": "build-1"}})
+	case r.URL.Path == secrets && r.Method == http.MethodGet:
+		list := []buildkiteSecret{}
+		for _, secret := range f.secrets {
+			secret.Value = ""
+			list = append(list, secret)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.URL.Path == secrets && r.Method == http.MethodPost:
+		secret := buildkiteSecret{}
+		json.NewDecoder(r.Body).Decode(&secret)
+		for _, existing := range f.secrets {
+			if existing.Key == secret.Key {
+				http.Error(w, `{"message":"Key has already been taken"}`, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		f.nextID++
+		secret.ID = fmt.Sprintf("secret-%d", f.nextID)
+		f.secrets[secret.ID] = secret
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, secrets+"/"):
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, secrets+"/"), "/")
+		secret, ok := f.secrets[parts[0]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 2 && parts[1] == "value" && r.Method == http.MethodPut:
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			secret.Value = body["value"]
+			f.secrets[secret.ID] = secret
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			delete(f.secrets, secret.ID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// secret the secret with the key
+func (f *fakeBuildkite) secret(key string) (buildkiteSecret, bool) {
+	for _, secret := range f.secrets {
+		if secret.Key == key {
+			return secret, true
+		}
+	}
+	return buildkiteSecret{}, false
+}
+
+func Test_Buildkite_SetsPipelineSecrets(t *testing.T) {
+	fake, server := newFakeBuildkite()
+	defer server.Close()
+
+	b, err := NewBuildkite(server.URL, "test-token")
+	if err != nil {
+		t.Fatalf("NewBuildkite() error: %v", err)
+	}
+	if err := b.EnsureTarget("govau/my-app"); err != nil {
+		t.Fatalf("EnsureTarget() error: %v", err)
+	}
+	if ready, err := b.TargetReady("govau/missing"); err != nil || ready {
+		t.Errorf("TargetReady() expected false for a missing pipeline, got %v, %v", ready, err)
+	}
+
+	if err := b.SetStaticVars("govau/my-app", map[string]string{"CF_ORG": "dta"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := b.SetSecret("govau/my-app", "CF_PASSWORD_STAGING", "first-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	if err := b.SetSecret("govau/my-app", "CF_PASSWORD_STAGING", "second-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	password, ok := fake.secret("MY_APP_CF_PASSWORD_STAGING")
+	if !ok || password.Value != "second-password" {
+		t.Errorf("SetSecret() expected MY_APP_CF_PASSWORD_STAGING to be second-password, got %+v", password)
+	}
+	if !strings.Contains(password.Policy, "pipeline_slug: my-app") {
+		t.Errorf("SetSecret() expected a policy for only my-app, got %q", password.Policy)
+	}
+	if org, _ := fake.secret("MY_APP_CF_ORG"); org.Value != "dta" {
+		t.Errorf("SetStaticVars() expected MY_APP_CF_ORG to be dta, got %+v", org)
+	}
+
+	names, err := b.SecretNames("govau/my-app")
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	if len(names) != 2 || !names["CF_ORG"] || !names["CF_PASSWORD_STAGING"] {
+		t.Errorf("SecretNames() expected CF_ORG and CF_PASSWORD_STAGING, got %v", names)
+	}
+	if inProgress, err := b.BuildsInProgress("govau/my-app"); err != nil || inProgress != 1 {
+		t.Errorf("BuildsInProgress() expected 1, got %d, %v", inProgress, err)
+	}
+
+	if err := b.Delete("govau/my-app", "CF_PASSWORD_STAGING"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, ok := fake.secret("MY_APP_CF_PASSWORD_STAGING"); ok {
+		t.Error("Delete() expected MY_APP_CF_PASSWORD_STAGING to be gone")
+	}
+}
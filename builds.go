@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// buildChecker counts the builds in progress for a repo. Satisfied by *Circle, and by sinks for
+// other CI systems that run builds.
+type buildChecker interface {
+	BuildsInProgress(orgAndRepo string) (int, error)
+}
+
+// waitForBuilds wait until none of the repos have a build running or queued, checking every
+// PollInterval. Returns false if there were still builds in progress after MaxWait.
+func waitForBuilds(checker buildChecker, repos []string, wait config.BuildWait) (bool, error) {
+	deadline := time.Now().Add(wait.MaxWait)
+	for {
+		busy := []string{}
+		for _, repo := range repos {
+			inProgress, err := checker.BuildsInProgress(repo)
+			if err != nil {
+				return false, err
+			}
+			if inProgress > 0 {
+				busy = append(busy, repo)
+			}
+		}
+		if len(busy) == 0 {
+			return true, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+		if *verbose {
+			log.Printf("Waiting for builds in progress in %s", strings.Join(busy, ", "))
+		}
+		if remaining < wait.PollInterval {
+			time.Sleep(remaining)
+		} else {
+			time.Sleep(wait.PollInterval)
+		}
+	}
+}
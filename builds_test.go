@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// fakeBuilds has a number of builds in progress for each repo, one of which finishes each check
+type fakeBuilds map[string]int
+
+func (f fakeBuilds) BuildsInProgress(orgAndRepo string) (int, error) {
+	inProgress := f[orgAndRepo]
+	if inProgress > 0 {
+		f[orgAndRepo]--
+	}
+	return inProgress, nil
+}
+
+func Test_WaitForBuilds_BuildsFinish_ReturnsIdle(t *testing.T) {
+	builds := fakeBuilds{"govau/a": 2, "govau/b": 0}
+	wait := config.BuildWait{PollInterval: time.Millisecond, MaxWait: time.Second}
+
+	idle, err := waitForBuilds(builds, []string{"govau/a", "govau/b"}, wait)
+	if err != nil {
+		t.Fatalf("waitForBuilds() error: %v", err)
+	}
+	if !idle {
+		t.Error("waitForBuilds() expected builds to finish before max wait")
+	}
+}
+
+func Test_WaitForBuilds_BuildsNeverFinish_TimesOut(t *testing.T) {
+	builds := fakeBuilds{"govau/a": 1000000}
+	wait := config.BuildWait{PollInterval: time.Millisecond, MaxWait: 10 * time.Millisecond}
+
+	idle, err := waitForBuilds(builds, []string{"govau/a"}, wait)
+	if err != nil {
+		t.Fatalf("waitForBuilds() error: %v", err)
+	}
+	if idle {
+		t.Error("waitForBuilds() expected to time out with builds in progress")
+	}
+}
+
+func Test_WaitForSpace_ContextOnly_WaitsForItsProjects(t *testing.T) {
+	defer useSettings(t, `
+  build_wait:
+    poll_interval: 1ms
+    max_wait: 20ms
+    on_timeout: skip
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      circleci_context:
+        owner: gh/govau
+        wait_for: [govau/a]
+  `)()
+	cfSpace := settings.Orgs[0].Spaces[0]
+	projects := buildingSink{fakeSink: newFakeSink(), builds: fakeBuilds{"govau/a": 1000000}}
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{
+		config.SinkCircleCI:        projects,
+		config.SinkCircleCIContext: newFakeSink(),
+	}}
+	for _, repo := range append(cfSpace.Repos, cfSpace.WaitForRepos()...) {
+		sinks.repos[repo.String()] = repo
+	}
+	context := repoNames(cfSpace.Repos)
+
+	report := &Report{}
+	if waitForSpace(sinks, settings.Orgs[0], cfSpace, context, report) {
+		t.Error("waitForSpace() expected to skip the space while govau/a is building")
+	}
+	projects.builds["govau/a"] = 2
+	if !waitForSpace(sinks, settings.Orgs[0], cfSpace, context, report) {
+		t.Error("waitForSpace() expected the space to be rotated once govau/a's builds finish")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ccTimeout how long a request to the Cloud Controller may take, so that one that hangs cannot
+// hold up the rest of the run
+const ccTimeout = 30 * time.Second
+
+// Cloud Controller role types torque manages
+const (
+	roleOrgUser        = "organization_user"
+	roleSpaceDeveloper = "space_developer"
+)
+
+// CloudController a client for the parts of the Cloud Controller v3 API torque needs.
+// Client must carry a UAA token with the cloud_controller.admin scope.
+type CloudController struct {
+	APIHref string
+	Client  *http.Client
+}
+
+// ccError an unsuccessful response from the Cloud Controller
+type ccError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ccError) Error() string {
+	return fmt.Sprintf("cloud controller returned %d: %s", e.StatusCode, e.Body)
+}
+
+// ccNotFoundError nothing matched a query that should match one resource
+type ccNotFoundError struct {
+	Kind  string
+	Query string
+}
+
+func (e *ccNotFoundError) Error() string {
+	return fmt.Sprintf("Expected 1 %s matching %s but found 0", e.Kind, e.Query)
+}
+
+type ccResource struct {
+	GUID string `json:"guid"`
+}
+
+type ccList struct {
+	Pagination struct {
+		TotalResults int `json:"total_results"`
+	} `json:"pagination"`
+	Resources []ccResource `json:"resources"`
+}
+
+type ccRelationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+func relationship(guid string) ccRelationship {
+	r := ccRelationship{}
+	r.Data.GUID = guid
+	return r
+}
+
+func (c *CloudController) do(method string, path string, query url.Values, body interface{}, response interface{}) error {
+	u := strings.TrimSuffix(c.APIHref, "/") + path
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	var reqBody *bytes.Buffer
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(b)
+	} else {
+		reqBody = &bytes.Buffer{}
+	}
+
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &ccError{StatusCode: res.StatusCode, Body: string(resBody)}
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(resBody, response)
+}
+
+// findOne the guid of the single resource the query matches
+func (c *CloudController) findOne(kind string, path string, query url.Values) (string, error) {
+	list := ccList{}
+	if err := c.do(http.MethodGet, path, query, nil, &list); err != nil {
+		return "", err
+	}
+	if len(list.Resources) == 0 {
+		return "", &ccNotFoundError{Kind: kind, Query: query.Encode()}
+	}
+	if len(list.Resources) != 1 {
+		return "", fmt.Errorf("Expected 1 %s matching %s but found %d", kind, query.Encode(), len(list.Resources))
+	}
+	return list.Resources[0].GUID, nil
+}
+
+// OrgGUID the guid of the org with this name
+func (c *CloudController) OrgGUID(name string) (string, error) {
+	return c.findOne("org", "/v3/organizations", url.Values{"names": {name}})
+}
+
+// SpaceGUID the guid of the space with this name in the given org
+func (c *CloudController) SpaceGUID(orgGUID string, name string) (string, error) {
+	return c.findOne("space", "/v3/spaces", url.Values{"names": {name}, "organization_guids": {orgGUID}})
+}
+
+// EnsureUser registers the UAA user with this guid in the Cloud Controller, if it is not already
+func (c *CloudController) EnsureUser(userGUID string) error {
+	err := c.do(http.MethodGet, "/v3/users/"+userGUID, nil, nil, nil)
+	if err == nil {
+		return nil
+	}
+	if ccErr, ok := err.(*ccError); !ok || ccErr.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	return c.do(http.MethodPost, "/v3/users", nil, map[string]string{"guid": userGUID}, nil)
+}
+
+// EnsureOrgRole gives the user this role in the org, if they do not already have it
+func (c *CloudController) EnsureOrgRole(roleType string, userGUID string, orgGUID string) error {
+	return c.ensureRole(roleType, userGUID, "organization", orgGUID)
+}
+
+// EnsureSpaceRole gives the user this role in the space, if they do not already have it
+func (c *CloudController) EnsureSpaceRole(roleType string, userGUID string, spaceGUID string) error {
+	return c.ensureRole(roleType, userGUID, "space", spaceGUID)
+}
+
+func (c *CloudController) ensureRole(roleType string, userGUID string, scope string, scopeGUID string) error {
+	list := ccList{}
+	query := url.Values{
+		"types":          {roleType},
+		"user_guids":     {userGUID},
+		scope + "_guids": {scopeGUID},
+	}
+	if err := c.do(http.MethodGet, "/v3/roles", query, nil, &list); err != nil {
+		return err
+	}
+	if list.Pagination.TotalResults > 0 {
+		return nil
+	}
+
+	role := map[string]interface{}{
+		"type": roleType,
+		"relationships": map[string]ccRelationship{
+			"user": relationship(userGUID),
+			scope:  relationship(scopeGUID),
+		},
+	}
+	return c.do(http.MethodPost, "/v3/roles", nil, role, nil)
+}
+
+// RemoveSpaceRole takes this role in the space away from the user, if they have it
+func (c *CloudController) RemoveSpaceRole(roleType string, userGUID string, spaceGUID string) error {
+	list := ccList{}
+	query := url.Values{
+		"types":       {roleType},
+		"user_guids":  {userGUID},
+		"space_guids": {spaceGUID},
+	}
+	if err := c.do(http.MethodGet, "/v3/roles", query, nil, &list); err != nil {
+		return err
+	}
+	for _, role := range list.Resources {
+		if err := c.do(http.MethodDelete, "/v3/roles/"+role.GUID, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
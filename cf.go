@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"time"
 
 	uaa "github.com/cloudfoundry-community/go-uaa"
@@ -20,28 +21,42 @@ type CfInfo struct {
 	APIHref   string
 	UaaOrigin string
 	UaaAPI    *uaa.API
+	CC        *CloudController
+	// Err why torque could not connect to the cf, if it could not. Its ci users are reported as
+	// failed, and the rest of the run carries on.
+	Err error
 }
 
-//NewCfInfo Create new CfInfo instance. A UaaAPI client is created and tested, and any error is returned.
+// NewCfInfo Create new CfInfo instance. A UaaAPI client is created and tested, and any error is returned.
 func NewCfInfo(ID string, APIHref string, UaaOrigin string) (*CfInfo, error) {
 	newCfInfo := &CfInfo{
 		ID:        ID,
 		APIHref:   APIHref,
-		UaaOrigin: settings.UaaOrigin,
+		UaaOrigin: UaaOrigin,
 	}
 
 	target, err := apiToUaaHref(APIHref)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("Problem getting uaa href from %s: %v", APIHref, err)
+	}
+	clientID, err := getEnvVar(fmt.Sprintf("UAA_CLIENT_ID_%s", ID))
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := getEnvVar(fmt.Sprintf("UAA_CLIENT_SECRET_%s", ID))
+	if err != nil {
+		return nil, err
 	}
-	clientID := getEnvVar(fmt.Sprintf("UAA_CLIENT_ID_%s", ID))
-	clientSecret := getEnvVar(fmt.Sprintf("UAA_CLIENT_SECRET_%s", ID))
 	zoneID := ""
 	uaaAPI, err := uaa.NewWithClientCredentials(target, zoneID, clientID, clientSecret, uaa.JSONWebToken, false)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("Problem creating uaa client for %s: %v", target, err)
 	}
+	// Time requests to UAA and the Cloud Controller separately, though they share a token
+	authenticated := uaaAPI.AuthenticatedClient.Transport
+	uaaAPI.AuthenticatedClient.Transport = newTimedTransport("uaa", authenticated)
 	newCfInfo.UaaAPI = uaaAPI
+	newCfInfo.CC = &CloudController{APIHref: APIHref, Client: &http.Client{Transport: newTimedTransport("cloud_controller", authenticated), Timeout: ccTimeout}}
 
 	value, present := os.LookupEnv("UAA_VERBOSE")
 	if present && value != "0" {
@@ -51,7 +66,7 @@ func NewCfInfo(ID string, APIHref string, UaaOrigin string) (*CfInfo, error) {
 	// test the connection
 	users, err := newCfInfo.UaaAPI.ListAllUsers("", "", "", uaa.SortAscending)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("Problem listing users in uaa %s: %v", target, err)
 	}
 	if *verbose {
 		log.Printf("Found %d users in uaa", len(users))
@@ -94,13 +109,16 @@ func apiToUaaHref(apiHref string) (string, error) {
 
 	res, getErr := client.Do(req)
 	if getErr != nil {
-		return "", err
+		return "", getErr
 	}
 	defer res.Body.Close()
 
 	body, readErr := ioutil.ReadAll(res.Body)
 	if readErr != nil {
-		return "", err
+		return "", readErr
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cf api returned %d: %s", res.StatusCode, body)
 	}
 
 	err = json.Unmarshal(body, &ccResourceLinks)
@@ -108,6 +126,9 @@ func apiToUaaHref(apiHref string) (string, error) {
 		return "", err
 	}
 	uaaHref := ccResourceLinks.Links["uaa"].HREF
+	if uaaHref == "" {
+		return "", fmt.Errorf("cf api did not link to a uaa")
+	}
 
 	if *verbose {
 		log.Printf("Got uaa href %s", uaaHref)
@@ -116,38 +137,142 @@ func apiToUaaHref(apiHref string) (string, error) {
 	return uaaHref, nil
 }
 
-// RotateCIUserPassword changes the password of the CI user for this cf org and space
-func (cf *CfInfo) RotateCIUserPassword(cfOrg string, cfSpace string) (string, error) {
-	username := cfUserName(cfOrg, cfSpace)
-	if *verbose {
-		log.Printf("Rotating password for %s", username)
+// FindCIUser fetches the CI user with this username from UAA. Returns nil if the user does not exist.
+func (cf *CfInfo) FindCIUser(username string) (*uaa.User, error) {
+	if cf.Err != nil {
+		return nil, cf.Err
+	}
+	filter := fmt.Sprintf(`userName eq "%s"`, username)
+	if cf.UaaOrigin != "" {
+		filter = fmt.Sprintf(`%s and origin eq "%s"`, filter, cf.UaaOrigin)
 	}
-
 	attributes := ""
-	user, err := cf.UaaAPI.GetUserByUsername(username, cf.UaaOrigin, attributes)
+	users, err := cf.UaaAPI.ListAllUsers(filter, "", attributes, "")
 	if err != nil {
-		// log.Printf("Error getting user %s\n", username)
-		return "", fmt.Errorf("Error getting user %s: %v", username, err)
+		return nil, fmt.Errorf("Error getting user %s: %v", username, err)
+	}
+	switch len(users) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &users[0], nil
+	default:
+		return nil, fmt.Errorf("Found %d users called %s in UAA %s, set uaa_origin to choose one", len(users), username, cf.UaaAPI.TargetURL)
 	}
+}
 
-	// todo confirm this behaviour when user doesnt exist
+// GetCIUser fetches the CI user with this username from UAA
+func (cf *CfInfo) GetCIUser(username string) (*uaa.User, error) {
+	user, err := cf.FindCIUser(username)
+	if err != nil {
+		return nil, err
+	}
 	if user == nil {
-		return "", fmt.Errorf("Unable to fetch user %s, maybe it does not exist in UAA: %s", username, cf.UaaAPI.TargetURL)
+		return nil, fmt.Errorf("User %s does not exist in UAA: %s", username, cf.UaaAPI.TargetURL)
 	}
+	return user, nil
+}
 
-	newPassword := generateNewPassword()
+// EnsureCIUser ensures the CI user with this username exists in UAA, is known to the Cloud
+// Controller, and is a SpaceDeveloper in the space. A new user is given a random password,
+// which is expected to be rotated straight after.
+func (cf *CfInfo) EnsureCIUser(username string, cfOrg string, cfSpace string) (*uaa.User, error) {
+	user, err := cf.FindCIUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if *verbose {
+			log.Printf("Creating user %s in %s", username, cf.UaaAPI.TargetURL)
+		}
+		user, err = cf.UaaAPI.CreateUser(uaa.User{
+			Username: username,
+			Password: generateNewPassword(),
+			Origin:   cf.UaaOrigin,
+			// UAA requires an email address, cf create-user uses the username too
+			Emails: []uaa.Email{{Value: username}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error creating user %s: %v", username, err)
+		}
+	}
 
-	err = cf.UaaAPI.SetPassword(newPassword, "", user.ID)
+	orgGUID, err := cf.CC.OrgGUID(cfOrg)
 	if err != nil {
-		log.Println("Error changing password")
-		return "", err
+		return nil, err
+	}
+	spaceGUID, err := cf.CC.SpaceGUID(orgGUID, cfSpace)
+	if err != nil {
+		return nil, err
+	}
+	if err := cf.CC.EnsureUser(user.ID); err != nil {
+		return nil, fmt.Errorf("Error registering %s with the cloud controller: %v", username, err)
+	}
+	// A space role can only be given to a user in the space's org
+	if err := cf.CC.EnsureOrgRole(roleOrgUser, user.ID, orgGUID); err != nil {
+		return nil, fmt.Errorf("Error adding %s to org %s: %v", username, cfOrg, err)
+	}
+	if err := cf.CC.EnsureSpaceRole(roleSpaceDeveloper, user.ID, spaceGUID); err != nil {
+		return nil, fmt.Errorf("Error making %s a SpaceDeveloper in %s: %v", username, cfSpace, err)
 	}
 
+	return user, nil
+}
+
+// ciUser the CI user to rotate, created first if create_users is set
+func (cf *CfInfo) ciUser(username string, cfOrg string, cfSpace string) (*uaa.User, error) {
+	if settings.CreateUsers {
+		return cf.EnsureCIUser(username, cfOrg, cfSpace)
+	}
+	return cf.GetCIUser(username)
+}
+
+// RotateCIUserPassword changes the password of this CI user, and pushes it to envVarName in each
+// of the repos. The returned rotation records which repos, if any, are left with a stale password.
+func (cf *CfInfo) RotateCIUserPassword(user *uaa.User, sink envVarSink, envVarName string, repos []string) (*rotation, error) {
 	if *verbose {
-		log.Printf("Set password succeeded")
+		log.Printf("Rotating password for %s", user.Username)
+	}
+
+	r := newRotation(sink, repos)
+	r.addCredential(cf.UaaAPI, user.ID, envVarName)
+	return r, r.run()
+}
+
+// tokenRevocation the revocation of the user's tokens in this cf
+func (cf *CfInfo) tokenRevocation(user *uaa.User) revocation {
+	return revocation{revoker: cf, target: fmt.Sprintf("%s %s", cf.ID, user.Username), userID: user.ID}
+}
+
+// RevokeTokens revoke every token UAA has issued to the user. UAA changes the user's revocation
+// salt, so tokens issued from here on are unaffected.
+func (cf *CfInfo) RevokeTokens(userID string) error {
+	u := *cf.UaaAPI.TargetURL
+	u.Path = path.Join(u.Path, "/oauth/token/revoke/user", userID)
+	res, err := cf.UaaAPI.AuthenticatedClient.Get(u.String())
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
 
-	return newPassword, nil
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("uaa returned %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// passwordLastModified when the user's password was last changed. A user that does not exist
+// was never changed.
+func passwordLastModified(user *uaa.User) (time.Time, error) {
+	if user == nil || user.PasswordLastModified == "" {
+		return time.Time{}, nil
+	}
+	lastModified, err := time.Parse(time.RFC3339, user.PasswordLastModified)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to read when the password of %s was last changed: %v", user.Username, err)
+	}
+	return lastModified, nil
 }
 
 func cfUserName(org string, space string) string {
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	uaa "github.com/cloudfoundry-community/go-uaa"
+	"github.com/govau/torque/config"
+	"github.com/govau/torque/state"
+)
+
+// fakeCf the UAA and Cloud Controller of a cf on one server, with its users, orgs, spaces and roles
+type fakeCf struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	users     []*uaa.User
+	passwords map[string]string // by user ID
+	orgs      map[string]string // guid by name
+	spaces    map[string]string // guid by org guid and name
+	ccUsers   map[string]bool   // the user IDs registered with the Cloud Controller
+	roles     map[string]string // type, user ID and org or space guid, by role guid
+	revoked   []string          // the user IDs whose tokens were revoked
+}
+
+func newFakeCf() *fakeCf {
+	f := &fakeCf{
+		passwords: map[string]string{},
+		orgs:      map[string]string{},
+		spaces:    map[string]string{},
+		ccUsers:   map[string]bool{},
+		roles:     map[string]string{},
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// addUser add a UAA user whose password was last changed at lastModified, or never if it is zero
+func (f *fakeCf) addUser(username string, lastModified time.Time) *uaa.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user := &uaa.User{ID: "id-" + username, Username: username, Meta: &uaa.Meta{Version: 1}}
+	if !lastModified.IsZero() {
+		user.PasswordLastModified = lastModified.UTC().Format(time.RFC3339)
+	}
+	f.users = append(f.users, user)
+	return user
+}
+
+// addSpace add the org, if it is new, and the space to the Cloud Controller
+func (f *fakeCf) addSpace(org string, space string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.orgs[org] = "guid-" + org
+	f.spaces["guid-"+org+"/"+space] = "guid-" + org + "-" + space
+}
+
+// user the UAA user with this username, or nil
+func (f *fakeCf) user(username string) *uaa.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, user := range f.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+// hasRole whether the user has the role in the org or space
+func (f *fakeCf) hasRole(roleType string, userID string, scopeGUID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, role := range f.roles {
+		if role == strings.Join([]string{roleType, userID, scopeGUID}, " ") {
+			return true
+		}
+	}
+	return false
+}
+
+// connect a CfInfo to the fake, as NewCfInfo does for a real cf
+func (f *fakeCf) connect(t *testing.T, id string) *CfInfo {
+	os.Setenv("UAA_CLIENT_ID_"+id, "torque")
+	os.Setenv("UAA_CLIENT_SECRET_"+id, "secret")
+	cfInfo, err := NewCfInfo(id, f.server.URL, "")
+	if err != nil {
+		t.Fatalf("NewCfInfo() error: %v", err)
+	}
+	return cfInfo
+}
+
+var filterPattern = regexp.MustCompile(`userName (eq|sw) "([^"]*)"`)
+
+func (f *fakeCf) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.Path
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case path == "/":
+		writeJSON(w, map[string]interface{}{"links": map[string]interface{}{"uaa": map[string]string{"href": f.server.URL}}})
+	case path == "/oauth/token":
+		writeJSON(w, map[string]interface{}{"access_token": "token", "token_type": "bearer", "expires_in": 3600})
+	case strings.HasPrefix(path, "/oauth/token/revoke/user/"):
+		f.revoked = append(f.revoked, parts[len(parts)-1])
+	case path == "/Users" && r.Method == http.MethodGet:
+		users := []uaa.User{}
+		match := filterPattern.FindStringSubmatch(query.Get("filter"))
+		for _, user := range f.users {
+			if match == nil || (match[1] == "eq" && user.Username == match[2]) || (match[1] == "sw" && strings.HasPrefix(user.Username, match[2])) {
+				users = append(users, *user)
+			}
+		}
+		writeJSON(w, map[string]interface{}{"resources": users, "startIndex": 1, "itemsPerPage": 100, "totalResults": len(users)})
+	case path == "/Users" && r.Method == http.MethodPost:
+		user := &uaa.User{}
+		json.NewDecoder(r.Body).Decode(user)
+		user.ID = "id-" + user.Username
+		user.Meta = &uaa.Meta{Version: 1}
+		user.PasswordLastModified = time.Now().UTC().Format(time.RFC3339)
+		f.passwords[user.ID] = user.Password
+		user.Password = ""
+		f.users = append(f.users, user)
+		writeJSON(w, user)
+	case len(parts) == 3 && parts[0] == "Users" && parts[2] == "password" && r.Method == http.MethodPut:
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, user := range f.users {
+			if user.ID == parts[1] {
+				f.passwords[user.ID] = body["password"]
+				user.PasswordLastModified = time.Now().UTC().Format(time.RFC3339)
+				writeJSON(w, map[string]string{"status": "ok"})
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case path == "/v3/organizations":
+		f.writeCCList(w, f.orgs[query.Get("names")])
+	case path == "/v3/spaces":
+		f.writeCCList(w, f.spaces[query.Get("organization_guids")+"/"+query.Get("names")])
+	case len(parts) == 3 && parts[1] == "users" && r.Method == http.MethodGet:
+		if !f.ccUsers[parts[2]] {
+			http.NotFound(w, r)
+		}
+	case path == "/v3/users" && r.Method == http.MethodPost:
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.ccUsers[body["guid"]] = true
+		w.WriteHeader(http.StatusCreated)
+	case path == "/v3/roles" && r.Method == http.MethodGet:
+		scope := query.Get("space_guids") + query.Get("organization_guids")
+		want := strings.Join([]string{query.Get("types"), query.Get("user_guids"), scope}, " ")
+		guids := []string{}
+		for guid, role := range f.roles {
+			if role == want {
+				guids = append(guids, guid)
+			}
+		}
+		f.writeCCList(w, guids...)
+	case path == "/v3/roles" && r.Method == http.MethodPost:
+		body := struct {
+			Type          string                    `json:"type"`
+			Relationships map[string]ccRelationship `json:"relationships"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		scope := body.Relationships["space"].Data.GUID + body.Relationships["organization"].Data.GUID
+		if !f.ccUsers[body.Relationships["user"].Data.GUID] {
+			http.Error(w, "user is not registered", http.StatusUnprocessableEntity)
+			return
+		}
+		f.roles[fmt.Sprintf("role-%d", len(f.roles))] = strings.Join([]string{body.Type, body.Relationships["user"].Data.GUID, scope}, " ")
+		w.WriteHeader(http.StatusCreated)
+	case len(parts) == 3 && parts[1] == "roles" && r.Method == http.MethodDelete:
+		delete(f.roles, parts[2])
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeCCList write a Cloud Controller list of the resources with these guids, ignoring empty ones
+func (f *fakeCf) writeCCList(w http.ResponseWriter, guids ...string) {
+	list := ccList{}
+	for _, guid := range guids {
+		if guid != "" {
+			list.Resources = append(list.Resources, ccResource{GUID: guid})
+		}
+	}
+	list.Pagination.TotalResults = len(list.Resources)
+	writeJSON(w, list)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// useSettings load the config as the settings for the rest of the test, with no state store.
+// The returned func puts the previous settings back.
+func useSettings(t *testing.T, yaml string) func() {
+	s, c, st := settings, cfInfos, stateStore
+	settings = &config.Settings{}
+	if err := config.Load(strings.NewReader(yaml), settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	cfInfos, stateStore = map[string]*CfInfo{}, state.Discard
+	return func() { settings, cfInfos, stateStore = s, c, st }
+}
+
+func Test_RotateSpace_CarriesOnAfterAFailure(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	defer useSettings(t, fmt.Sprintf(`
+  retries: 0
+  cfs:
+  - id: A
+    api_href: https://api.a.example.com
+  - id: B
+    api_href: %s
+  orgs:
+  - name: org
+    spaces:
+    - name: missing
+      repos: [govau/missing]
+    - name: space
+      repos: [govau/a]
+  `, down.URL))()
+
+	a := newFakeCf()
+	defer a.server.Close()
+	a.addUser("ci-org-space", time.Time{})
+	cfInfos["A"] = a.connect(t, "A")
+	cfInfos["B"] = connectCf(settings.Cfs[1], "")
+	if cfInfos["B"].Err == nil {
+		t.Fatal("connectCf() expected an error connecting to a cf that is down")
+	}
+
+	sink := newFakeSink("govau/missing", "govau/a")
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkCircleCI: sink}}
+	for _, cfSpace := range settings.Orgs[0].Spaces {
+		sinks.repos[cfSpace.Repos[0].String()] = cfSpace.Repos[0]
+	}
+
+	report := &Report{}
+	for _, cfSpace := range settings.Orgs[0].Spaces {
+		rotateSpace(sinks, settings.Orgs[0], cfSpace, report)
+	}
+
+	if len(report.Rotated) != 1 || report.Rotated[0] != "A ci-org-space" {
+		t.Errorf("rotateSpace() expected only A ci-org-space to be rotated, got %v", report.Rotated)
+	}
+	if got := sink.envVars["govau/a"]["CF_PASSWORD_A"]; got == "" || got != a.passwords["id-ci-org-space"] {
+		t.Errorf("rotateSpace() expected govau/a to have the new password, got %q", got)
+	}
+	failed := map[string]string{}
+	for _, failure := range report.Failures {
+		failed[failure.Target] = failure.Err.Error()
+	}
+	for target, reason := range map[string]string{
+		"A ci-org-missing": "User ci-org-missing does not exist",
+		"B ci-org-missing": "Problem connecting to cf B",
+		"B ci-org-space":   "Problem connecting to cf B",
+	} {
+		if !strings.Contains(failed[target], reason) {
+			t.Errorf("rotateSpace() expected %s to fail with %q, got %q", target, reason, failed[target])
+		}
+	}
+	if len(report.Failures) != 3 {
+		t.Errorf("rotateSpace() expected 3 failures, got %v", report.Failures)
+	}
+}
+
+func Test_EnsureCIUser_CreatesUserWithSpaceDeveloperRole(t *testing.T) {
+	defer useSettings(t, "")()
+	fake := newFakeCf()
+	defer fake.server.Close()
+	fake.addSpace("org", "space")
+	cfInfo := fake.connect(t, "A")
+	cfInfo.UaaOrigin = "ldap"
+
+	user, err := cfInfo.EnsureCIUser("ci-org-space", "org", "space")
+	if err != nil {
+		t.Fatalf("EnsureCIUser() error: %v", err)
+	}
+	created := fake.user("ci-org-space")
+	if created == nil || user.ID != created.ID {
+		t.Fatalf("EnsureCIUser() expected ci-org-space to be created in UAA, got %+v", user)
+	}
+	if created.Origin != "ldap" || fake.passwords[created.ID] == "" {
+		t.Errorf("EnsureCIUser() expected the user to have the ldap origin and a password, got %+v", created)
+	}
+	if !fake.ccUsers[created.ID] {
+		t.Error("EnsureCIUser() expected the user to be registered with the cloud controller")
+	}
+	if !fake.hasRole(roleOrgUser, created.ID, "guid-org") {
+		t.Error("EnsureCIUser() expected the user to be in the org")
+	}
+	if !fake.hasRole(roleSpaceDeveloper, created.ID, "guid-org-space") {
+		t.Error("EnsureCIUser() expected the user to be a SpaceDeveloper in the space")
+	}
+
+	// Ensuring it again changes nothing
+	if _, err := cfInfo.EnsureCIUser("ci-org-space", "org", "space"); err != nil {
+		t.Fatalf("EnsureCIUser() error: %v", err)
+	}
+	if len(fake.users) != 1 || len(fake.roles) != 2 {
+		t.Errorf("EnsureCIUser() expected one user with two roles, got %d users and roles %v", len(fake.users), fake.roles)
+	}
+}
+
+func Test_EnsureCIUser_ExistingUser_GetsMissingRoles(t *testing.T) {
+	defer useSettings(t, "")()
+	fake := newFakeCf()
+	defer fake.server.Close()
+	fake.addSpace("org", "space")
+	existing := fake.addUser("ci-org-space", time.Now())
+	cfInfo := fake.connect(t, "A")
+
+	user, err := cfInfo.EnsureCIUser("ci-org-space", "org", "space")
+	if err != nil {
+		t.Fatalf("EnsureCIUser() error: %v", err)
+	}
+	if user.ID != existing.ID || len(fake.users) != 1 {
+		t.Errorf("EnsureCIUser() expected the existing user to be used, got %+v", user)
+	}
+	if _, ok := fake.passwords[existing.ID]; ok {
+		t.Error("EnsureCIUser() expected the existing user's password to be left alone")
+	}
+	if !fake.hasRole(roleSpaceDeveloper, existing.ID, "guid-org-space") {
+		t.Error("EnsureCIUser() expected the existing user to be made a SpaceDeveloper in the space")
+	}
+}
+
+func Test_EnsureCIUser_MissingSpace_ReturnsError(t *testing.T) {
+	defer useSettings(t, "")()
+	fake := newFakeCf()
+	defer fake.server.Close()
+	fake.addSpace("org", "other")
+	cfInfo := fake.connect(t, "A")
+
+	if _, err := cfInfo.EnsureCIUser("ci-org-space", "org", "space"); err == nil {
+		t.Error("EnsureCIUser() expected an error for a space that does not exist")
+	}
+	if len(fake.roles) != 0 {
+		t.Errorf("EnsureCIUser() expected no roles to be granted, got %v", fake.roles)
+	}
+}
+
+func Test_Due(t *testing.T) {
+	defer func(old string) { *force = old }(*force)
+	*force = "org/forced"
+
+	for _, test := range []struct {
+		name         string
+		space        string
+		lastModified time.Time
+		maxAge       time.Duration
+		want         bool
+	}{
+		{name: "no max age", space: "space", lastModified: time.Now(), want: true},
+		{name: "never changed", space: "space", maxAge: time.Hour, want: true},
+		{name: "fresh", space: "space", lastModified: time.Now().Add(-time.Minute), maxAge: time.Hour, want: false},
+		{name: "stale", space: "space", lastModified: time.Now().Add(-2 * time.Hour), maxAge: time.Hour, want: true},
+		{name: "forced", space: "forced", lastModified: time.Now(), maxAge: time.Hour, want: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := due("org", test.space, test.lastModified, test.maxAge); got != test.want {
+				t.Errorf("due() expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_PasswordLastModified(t *testing.T) {
+	changed := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name    string
+		user    *uaa.User
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "no user"},
+		{name: "missing", user: &uaa.User{Username: "ci-org-space"}},
+		{name: "valid", user: &uaa.User{Username: "ci-org-space", PasswordLastModified: changed.Format(time.RFC3339)}, want: changed},
+		{name: "unparseable", user: &uaa.User{Username: "ci-org-space", PasswordLastModified: "yesterday"}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := passwordLastModified(test.user)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("passwordLastModified() expected error %v, got %v", test.wantErr, err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("passwordLastModified() expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_CheckForce(t *testing.T) {
+	defer useSettings(t, `
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+  `)()
+	defer func(old string) { *force = old }(*force)
+
+	for value, wantErr := range map[string]bool{
+		"":          false,
+		"org/space": false,
+		"org/spcae": true,
+		"space":     true,
+	} {
+		*force = value
+		if err := checkForce(settings); (err != nil) != wantErr {
+			t.Errorf("checkForce() with -force %q expected error %v, got %v", value, wantErr, err)
+		}
+	}
+}
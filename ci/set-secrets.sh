@@ -80,7 +80,7 @@ for UAA_ID in ${UAA_IDS}; do
     ${UAAC_CMD} client add "${UAA_CLIENT_ID}" \
       --secret "${NEW_UAA_CLIENT_SECRET}" \
       --authorized_grant_types client_credentials,refresh_token \
-      --authorities uaa.admin,password.write \
+      --authorities uaa.admin,password.write,cloud_controller.admin \
       --no-interactive
   fi
 
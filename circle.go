@@ -1,114 +1,311 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"strings"
-
-	circleci "github.com/jszwedko/go-circleci"
 )
 
-//Circle client instance
-type Circle struct {
-	Client circleci.Client
+// circleAPIPath the path of the CircleCI API version 2 on a CircleCI instance
+const circleAPIPath = "/api/v2"
+
+// vcsTypes the short name of each VCS type a CircleCI project slug can start with
+var vcsTypes = map[string]string{
+	"gh":        "gh",
+	"github":    "gh",
+	"bb":        "bb",
+	"bitbucket": "bb",
 }
 
-//NewCircle Create new Circle instance. The circleci token is tested and any error is returned.
-func NewCircle(circleToken string) (*Circle, error) {
-	circle := &Circle{}
+// circleClient the CircleCI API version 2
+type circleClient struct {
+	*apiClient
+}
 
-	circle.Client = circleci.Client{Token: circleToken}
+// circlePage one page of a CircleCI API version 2 list
+type circlePage struct {
+	Items         []json.RawMessage `json:"items"`
+	NextPageToken string            `json:"next_page_token"`
+}
 
-	user, err := circle.Client.Me()
+// newCircleClient create a client for the API, testing the token. caCertFile is for a CircleCI
+// Server whose certificate is signed by a private CA, and may be empty. The login of the token's
+// user is returned too.
+func newCircleClient(apiURL string, circleToken string, caCertFile string) (*circleClient, string, error) {
+	transport, err := newTransport(caCertFile)
 	if err != nil {
-		return nil, fmt.Errorf("Bad circle token: %v", err)
+		return nil, "", fmt.Errorf("Problem reading circleci CA certificate: %v", err)
 	}
+	c := &circleClient{newAPIClient("circleci", apiURL, transport, http.Header{
+		"Accept":       {"application/json"},
+		"Circle-Token": {circleToken},
+	})}
+	user := struct {
+		Login string `json:"login"`
+	}{}
+	if err := c.do(http.MethodGet, "/me", nil, &user); err != nil {
+		return nil, "", fmt.Errorf("Bad circle token: %v", err)
+	}
+	return c, user.Login, nil
+}
 
-	if *verbose {
-		log.Printf("Circle Token belongs to user %s", user.Login)
+// list every item of a paginated list, decoding each with add
+func (c *circleClient) list(path string, add func(item json.RawMessage) error) error {
+	pageToken := ""
+	for {
+		pagePath := path
+		if pageToken != "" {
+			pagePath = addQuery(path, "page-token", pageToken)
+		}
+		page := circlePage{}
+		if err := c.do(http.MethodGet, pagePath, nil, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err := add(item); err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
 	}
+}
 
-	// test the token
-	if _, err := circle.Client.ListProjects(); err != nil {
-		return nil, fmt.Errorf("Problem testing circle token: %v", err)
+// addQuery add a query parameter to the path, which may already have a query
+func addQuery(path string, name string, value string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
 	}
+	return path + separator + name + "=" + url.QueryEscape(value)
+}
 
-	return circle, nil
+// Circle client instance. A SecretSink delivering to project env vars, whose targets are org/repo
+// for GitHub, or a project slug such as gh/org/repo or bb/org/repo.
+type Circle struct {
+	api *circleClient
 }
 
-// EnsureProjectEnabled ensure this project is being built in CircleCI
-func (c *Circle) EnsureProjectEnabled(orgAndRepo string) error {
+// NewCircle Create new Circle instance. The circleci token is tested and any error is returned.
+func NewCircle(apiURL string, circleToken string, caCertFile string) (*Circle, error) {
+	api, login, err := newCircleClient(apiURL, circleToken, caCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if *verbose {
+		log.Printf("Circle Token belongs to user %s", login)
+	}
+
+	return &Circle{api: api}, nil
+}
+
+// projectPath the API path of the project
+func projectPath(orgAndRepo string) (string, error) {
+	slug, err := ProjectSlug(orgAndRepo)
+	if err != nil {
+		return "", err
+	}
+	return "/project/" + slug, nil
+}
+
+// EnsureTarget ensure this project is being built in CircleCI. Unlike the version 1.1 API, version
+// 2 cannot follow a project, so one that is not followed is an error rather than followed.
+func (c *Circle) EnsureTarget(orgAndRepo string) error {
 	if *verbose {
 		log.Printf("Ensuring circleci is building this repo: %s", orgAndRepo)
 	}
-	org, repo, err := SplitOrgAndRepo(orgAndRepo)
+	ready, err := c.TargetReady(orgAndRepo)
 	if err != nil {
 		return err
 	}
-	return c.Client.EnableProject(org, repo)
+	if !ready {
+		return fmt.Errorf("%s is not being built by CircleCI: %s", orgAndRepo, c.ManualSetup())
+	}
+	return nil
+}
+
+// ManualSetup how to set up a project that is not being built, which torque cannot do itself
+func (c *Circle) ManualSetup() string {
+	return "follow the project in the CircleCI app first, as the CircleCI API version 2 cannot follow it"
 }
 
-//SetEnvVar on the given project. If it already exists, it is recreated with the new value.
-func (c *Circle) SetEnvVar(orgAndRepo string, name string, value string) error {
-	org, repo, err := SplitOrgAndRepo(orgAndRepo)
+// TargetReady whether this project is set up in CircleCI
+func (c *Circle) TargetReady(orgAndRepo string) (bool, error) {
+	path, err := projectPath(orgAndRepo)
 	if err != nil {
-		return err
+		return false, err
+	}
+	err = c.api.do(http.MethodGet, path, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	envVars, err := c.Client.ListEnvVars(org, repo)
+// SecretNames the names of the environment variables set on this project. CircleCI never
+// returns the real values, so only the names are useful.
+func (c *Circle) SecretNames(orgAndRepo string) (map[string]bool, error) {
+	path, err := projectPath(orgAndRepo)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, envVar := range envVars {
-		if envVar.Name == name {
-			err := c.Client.DeleteEnvVar(org, repo, envVar.Name)
-			if err != nil {
+
+	names := map[string]bool{}
+	err = c.api.list(path+"/envvar", func(item json.RawMessage) error {
+		envVar := struct {
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(item, &envVar); err != nil {
+			return err
+		}
+		names[envVar.Name] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// MaskedValues the values of the project's env vars, masked by CircleCI to xxxx and their last
+// four characters
+func (c *Circle) MaskedValues(orgAndRepo string) (map[string]string, error) {
+	path, err := projectPath(orgAndRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	err = c.api.list(path+"/envvar", func(item json.RawMessage) error {
+		envVar := struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}{}
+		if err := json.Unmarshal(item, &envVar); err != nil {
+			return err
+		}
+		values[envVar.Name] = envVar.Value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// recentPipelinesToCheck how many of a project's most recent pipelines are checked for
+// workflows in progress, one page
+const recentPipelinesToCheck = 20
+
+// BuildsInProgress the number of workflows of this project's recent pipelines that are running
+func (c *Circle) BuildsInProgress(orgAndRepo string) (int, error) {
+	path, err := projectPath(orgAndRepo)
+	if err != nil {
+		return 0, err
+	}
+
+	pipelines := struct {
+		Items []struct {
+			ID string `json:"id"`
+		} `json:"items"`
+	}{}
+	if err := c.api.do(http.MethodGet, path+"/pipeline", nil, &pipelines); err != nil {
+		return 0, err
+	}
+	if len(pipelines.Items) > recentPipelinesToCheck {
+		pipelines.Items = pipelines.Items[:recentPipelinesToCheck]
+	}
+
+	inProgress := 0
+	for _, pipeline := range pipelines.Items {
+		err := c.api.list(fmt.Sprintf("/pipeline/%s/workflow", pipeline.ID), func(item json.RawMessage) error {
+			workflow := struct {
+				Status string `json:"status"`
+			}{}
+			if err := json.Unmarshal(item, &workflow); err != nil {
 				return err
 			}
+			// failing workflows have a failed job, but others are still running
+			switch workflow.Status {
+			case "running", "failing":
+				inProgress++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
 		}
 	}
-	_, err = c.Client.AddEnvVar(org, repo, name, value)
-	return err
+	return inProgress, nil
 }
 
-// AddEnvVarIfNotAlreadySet set environment variables if not already set in CircleCI for this repo
-func (c *Circle) AddEnvVarIfNotAlreadySet(orgAndRepo string, desiredEnvVars map[string]string) error {
-	org, repo, err := SplitOrgAndRepo(orgAndRepo)
-
+// SetSecret set an env var on the given project. CircleCI replaces an existing env var with the
+// same name.
+func (c *Circle) SetSecret(orgAndRepo string, name string, value string) error {
+	path, err := projectPath(orgAndRepo)
 	if err != nil {
 		return err
 	}
+	return c.api.do(http.MethodPost, path+"/envvar", map[string]string{"name": name, "value": value}, nil)
+}
 
-	envVars, err := c.Client.ListEnvVars(org, repo)
+// SetStaticVars set environment variables if not already set in CircleCI for this repo
+func (c *Circle) SetStaticVars(orgAndRepo string, desiredEnvVars map[string]string) error {
+	names, err := c.SecretNames(orgAndRepo)
 	if err != nil {
 		return err
 	}
 
-	for key, value := range desiredEnvVars {
-		found := false
-		for _, envVar := range envVars {
-			if envVar.Name == key {
-				found = true
-				break
-			}
+	for _, key := range sortedKeys(desiredEnvVars) {
+		if names[key] {
+			continue
 		}
-		if !found {
-			_, err = c.Client.AddEnvVar(org, repo, key, value)
-			if err != nil {
-				return fmt.Errorf("Problem adding environment variable to %s: %v", orgAndRepo, err)
-			}
+		if err := c.SetSecret(orgAndRepo, key, desiredEnvVars[key]); err != nil {
+			return fmt.Errorf("Problem adding environment variable to %s: %v", orgAndRepo, err)
 		}
 	}
 
 	return nil
 }
 
+// Delete the env var from the given project
+func (c *Circle) Delete(orgAndRepo string, name string) error {
+	path, err := projectPath(orgAndRepo)
+	if err != nil {
+		return err
+	}
+	return c.api.do(http.MethodDelete, path+"/envvar/"+url.PathEscape(name), nil, nil)
+}
+
 // SplitOrgAndRepo split a single string with org and repo to separate strings.
-// e.g. govau/torque will return govau,torque
+// e.g. govau/torque and gh/govau/torque will return govau,torque
 func SplitOrgAndRepo(s string) (string, string, error) {
 	stringSlice := strings.Split(s, "/")
-	if len(stringSlice) != 2 {
-		return "", "", fmt.Errorf("bad repo string: %s. Must be like 'org/foo'", s)
+	if len(stringSlice) == 3 && vcsTypes[stringSlice[0]] != "" {
+		stringSlice = stringSlice[1:]
+	}
+	if len(stringSlice) != 2 || stringSlice[0] == "" || stringSlice[1] == "" {
+		return "", "", fmt.Errorf("bad repo string: %s. Must be like 'org/foo' or 'gh/org/foo'", s)
 	}
 	return stringSlice[0], stringSlice[1], nil
 }
+
+// ProjectSlug the CircleCI project slug of the repo, e.g. gh/govau/torque. Repos without a VCS
+// type are on GitHub.
+func ProjectSlug(s string) (string, error) {
+	org, repo, err := SplitOrgAndRepo(s)
+	if err != nil {
+		return "", err
+	}
+	vcsType := "gh"
+	if strings.Count(s, "/") == 2 {
+		vcsType = vcsTypes[strings.SplitN(s, "/", 2)[0]]
+	}
+	return fmt.Sprintf("%s/%s/%s", vcsType, org, repo), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/govau/torque/config"
+)
+
+// CircleContexts a SecretSink delivering to the env vars of CircleCI organisation contexts, whose
+// targets are the owner's slug then the context's name, e.g. gh/govau/cf-dta-prod. Every project
+// whose jobs use the context gets the env vars, so they are set once for all of them.
+type CircleContexts struct {
+	api *circleClient
+	// securityGroups the groups each context is restricted to
+	securityGroups map[string][]string
+	// ids the ID of each context, once it is known
+	ids map[string]string
+}
+
+// NewCircleContexts Create new CircleContexts instance. The circleci token is tested and any
+// error is returned.
+func NewCircleContexts(apiURL string, circleToken string, caCertFile string) (*CircleContexts, error) {
+	api, login, err := newCircleClient(apiURL, circleToken, caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	if *verbose {
+		log.Printf("Circle Token belongs to user %s", login)
+	}
+	return &CircleContexts{
+		api:            api,
+		securityGroups: map[string][]string{},
+		ids:            map[string]string{},
+	}, nil
+}
+
+// ConfigureRepo note the groups the context is restricted to
+func (c *CircleContexts) ConfigureRepo(repo config.Repo) error {
+	if _, _, err := splitOwnerAndContext(repo.Name); err != nil {
+		return err
+	}
+	c.securityGroups[repo.Name] = repo.SecurityGroups
+	return nil
+}
+
+// splitOwnerAndContext split a target into the owner's slug and the context's name
+func splitOwnerAndContext(target string) (string, string, error) {
+	i := strings.LastIndex(target, "/")
+	if i < 0 || !strings.Contains(target[:i], "/") {
+		return "", "", fmt.Errorf("bad circleci context: %s. Must be like 'gh/org/context'", target)
+	}
+	return target[:i], target[i+1:], nil
+}
+
+// contextID the ID of the target's context, or "" if it does not exist
+func (c *CircleContexts) contextID(target string) (string, error) {
+	if id, ok := c.ids[target]; ok {
+		return id, nil
+	}
+	owner, name, err := splitOwnerAndContext(target)
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	err = c.api.list(addQuery("/context", "owner-slug", owner), func(item json.RawMessage) error {
+		context := struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(item, &context); err != nil {
+			return err
+		}
+		if context.Name == name {
+			id = context.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		c.ids[target] = id
+	}
+	return id, nil
+}
+
+// existingContextID the ID of the target's context, which must exist
+func (c *CircleContexts) existingContextID(target string) (string, error) {
+	id, err := c.contextID(target)
+	if err == nil && id == "" {
+		err = fmt.Errorf("circleci context %s does not exist", target)
+	}
+	return id, err
+}
+
+// EnsureTarget create the context if it does not exist, and restrict it to its security groups
+func (c *CircleContexts) EnsureTarget(target string) error {
+	if *verbose {
+		log.Printf("Ensuring circleci context exists: %s", target)
+	}
+	id, err := c.contextID(target)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		owner, name, _ := splitOwnerAndContext(target)
+		context := struct {
+			ID string `json:"id"`
+		}{}
+		body := map[string]interface{}{
+			"name":  name,
+			"owner": map[string]string{"slug": owner, "type": "organization"},
+		}
+		if err := c.api.do(http.MethodPost, "/context", body, &context); err != nil {
+			return fmt.Errorf("Problem creating circleci context %s: %v", target, err)
+		}
+		id = context.ID
+		c.ids[target] = id
+	}
+	return c.ensureRestrictions(target, id)
+}
+
+// ensureRestrictions restrict the context to each of its security groups it is not already
+// restricted to
+func (c *CircleContexts) ensureRestrictions(target string, id string) error {
+	if len(c.securityGroups[target]) == 0 {
+		return nil
+	}
+	restricted := map[string]bool{}
+	err := c.api.list(fmt.Sprintf("/context/%s/restrictions", id), func(item json.RawMessage) error {
+		restriction := struct {
+			Type  string `json:"restriction_type"`
+			Value string `json:"restriction_value"`
+		}{}
+		if err := json.Unmarshal(item, &restriction); err != nil {
+			return err
+		}
+		if restriction.Type == "group" {
+			restricted[restriction.Value] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, group := range c.securityGroups[target] {
+		if restricted[group] {
+			continue
+		}
+		body := map[string]string{"restriction_type": "group", "restriction_value": group}
+		if err := c.api.do(http.MethodPost, fmt.Sprintf("/context/%s/restrictions", id), body, nil); err != nil {
+			return fmt.Errorf("Problem restricting circleci context %s to group %s: %v", target, group, err)
+		}
+	}
+	return nil
+}
+
+// CreatesTargets EnsureTarget creates a context that does not exist
+func (c *CircleContexts) CreatesTargets() {}
+
+// TargetReady whether the context exists
+func (c *CircleContexts) TargetReady(target string) (bool, error) {
+	id, err := c.contextID(target)
+	return id != "", err
+}
+
+// SecretNames the names of the context's env vars. CircleCI never returns the values.
+func (c *CircleContexts) SecretNames(target string) (map[string]bool, error) {
+	id, err := c.existingContextID(target)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	err = c.api.list(fmt.Sprintf("/context/%s/environment-variable", id), func(item json.RawMessage) error {
+		envVar := struct {
+			Variable string `json:"variable"`
+		}{}
+		if err := json.Unmarshal(item, &envVar); err != nil {
+			return err
+		}
+		names[envVar.Variable] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// SetSecret set the context's env var, replacing it in place if it exists
+func (c *CircleContexts) SetSecret(target string, name string, value string) error {
+	id, err := c.existingContextID(target)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/context/%s/environment-variable/%s", id, url.PathEscape(name))
+	return c.api.do(http.MethodPut, path, map[string]string{"value": value}, nil)
+}
+
+// SetStaticVars set each var that is not already set on the context
+func (c *CircleContexts) SetStaticVars(target string, vars map[string]string) error {
+	names, err := c.SecretNames(target)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(vars) {
+		if names[name] {
+			continue
+		}
+		if err := c.SetSecret(target, name, vars[name]); err != nil {
+			return fmt.Errorf("Problem adding environment variable to %s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// Delete the context's env var
+func (c *CircleContexts) Delete(target string, name string) error {
+	id, err := c.existingContextID(target)
+	if err != nil {
+		return err
+	}
+	return c.api.do(http.MethodDelete, fmt.Sprintf("/context/%s/environment-variable/%s", id, url.PathEscape(name)), nil, nil)
+}
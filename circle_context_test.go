@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+// fakeCircleContexts the contexts API of CircleCI, listing one item per page to exercise paging
+type fakeCircleContexts struct {
+	mu           sync.Mutex
+	contexts     map[string]string // name by ID
+	envVars      map[string]map[string]string
+	restrictions map[string][]string
+	puts         int
+}
+
+func newFakeCircleContexts() (*fakeCircleContexts, *httptest.Server) {
+	f := &fakeCircleContexts{
+		contexts:     map[string]string{"ctx-0": "other"},
+		envVars:      map[string]map[string]string{"ctx-0": {}},
+		restrictions: map[string][]string{},
+	}
+	return f, httptest.NewServer(f)
+}
+
+// writeCirclePage write the item at the page token, and the token of the next
+func writeCirclePage(w http.ResponseWriter, r *http.Request, items []interface{}) {
+	i := 0
+	fmt.Sscan(r.URL.Query().Get("page-token"), &i)
+	res := map[string]interface{}{"items": []interface{}{}}
+	if i < len(items) {
+		res["items"] = items[i : i+1]
+	}
+	if i+1 < len(items) {
+		res["next_page_token"] = fmt.Sprint(i + 1)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeCircleContexts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Circle-Token") != "test-token" {
+		http.Error(w, `{"message":"You must log in first."}`, http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/me":
+		json.NewEncoder(w).Encode(map[string]string{"login": "torque"})
+	case r.URL.Path == "/context" && r.Method == http.MethodGet:
+		if r.URL.Query().Get("owner-slug") != "gh/govau" {
+			http.Error(w, `{"message":"owner not found"}`, http.StatusNotFound)
+			return
+		}
+		items := []interface{}{}
+		for i := 0; i < len(f.contexts); i++ {
+			id := fmt.Sprintf("ctx-%d", i)
+			items = append(items, map[string]string{"id": id, "name": f.contexts[id]})
+		}
+		writeCirclePage(w, r, items)
+	case r.URL.Path == "/context" && r.Method == http.MethodPost:
+		body := struct {
+			Name string `json:"name"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		id := fmt.Sprintf("ctx-%d", len(f.contexts))
+		f.contexts[id] = body.Name
+		f.envVars[id] = map[string]string{}
+		json.NewEncoder(w).Encode(map[string]string{"id": id, "name": body.Name})
+	case len(parts) == 3 && parts[2] == "restrictions" && r.Method == http.MethodGet:
+		items := []interface{}{}
+		for _, group := range f.restrictions[parts[1]] {
+			items = append(items, map[string]string{"restriction_type": "group", "restriction_value": group})
+		}
+		writeCirclePage(w, r, items)
+	case len(parts) == 3 && parts[2] == "restrictions" && r.Method == http.MethodPost:
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.restrictions[parts[1]] = append(f.restrictions[parts[1]], body["restriction_value"])
+	case len(parts) == 3 && parts[2] == "environment-variable":
+		// Sorted, so each page is the same from one request to the next
+		items := []interface{}{}
+		for _, name := range sortedKeys(f.envVars[parts[1]]) {
+			items = append(items, map[string]string{"variable": name})
+		}
+		writeCirclePage(w, r, items)
+	case len(parts) == 4 && r.Method == http.MethodPut:
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.envVars[parts[1]][parts[3]] = body["value"]
+		f.puts++
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(f.envVars[parts[1]], parts[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_CircleContexts_CreatesRestrictedContext(t *testing.T) {
+	fake, server := newFakeCircleContexts()
+	defer server.Close()
+
+	c, err := NewCircleContexts(server.URL, "test-token", "")
+	if err != nil {
+		t.Fatalf("NewCircleContexts() error: %v", err)
+	}
+	target := "gh/govau/cf-dta-prod"
+	if err := c.ConfigureRepo(config.Repo{Name: target, Sink: config.SinkCircleCIContext, SecurityGroups: []string{"group-1"}}); err != nil {
+		t.Fatalf("ConfigureRepo() error: %v", err)
+	}
+
+	if ready, err := c.TargetReady(target); err != nil || ready {
+		t.Errorf("TargetReady() expected false before the context exists, got %v, %v", ready, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.EnsureTarget(target); err != nil {
+			t.Fatalf("EnsureTarget() error: %v", err)
+		}
+	}
+	if len(fake.contexts) != 2 || fake.contexts["ctx-1"] != "cf-dta-prod" {
+		t.Fatalf("EnsureTarget() expected the context to be created once, got %v", fake.contexts)
+	}
+	if got := fake.restrictions["ctx-1"]; len(got) != 1 || got[0] != "group-1" {
+		t.Errorf("EnsureTarget() expected the context to be restricted to group-1 once, got %v", got)
+	}
+
+	if err := c.SetStaticVars(target, map[string]string{"CF_ORG": "dta", "CF_SPACE": "prod"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := c.SetSecret(target, "CF_PASSWORD_STAGING", "new-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	if got := fake.envVars["ctx-1"]["CF_PASSWORD_STAGING"]; got != "new-password" {
+		t.Errorf("SetSecret() expected CF_PASSWORD_STAGING to be set on the context, got %q", got)
+	}
+
+	names, err := c.SecretNames(target)
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	if len(names) != 3 || !names["CF_ORG"] || !names["CF_SPACE"] || !names["CF_PASSWORD_STAGING"] {
+		t.Errorf("SecretNames() expected all the pages of env vars, got %v", names)
+	}
+	if err := c.SetStaticVars(target, map[string]string{"CF_ORG": "dta"}); err != nil || fake.puts != 3 {
+		t.Errorf("SetStaticVars() expected existing env vars to be left alone, got %d writes, %v", fake.puts, err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+// fakeCircle the projects API of CircleCI, with one project on each of GitHub and Bitbucket
+type fakeCircle struct {
+	mu       sync.Mutex
+	envVars  map[string]map[string]string // by project slug
+	statuses []string                     // of the workflows of the one pipeline
+	adds     int
+}
+
+func newFakeCircle() (*fakeCircle, *httptest.Server) {
+	f := &fakeCircle{
+		envVars: map[string]map[string]string{
+			"gh/govau/torque": {},
+			"bb/govau/torque": {},
+		},
+		statuses: []string{"success", "running", "failing", "on_hold"},
+	}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeCircle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Circle-Token") != "test-token" {
+		http.Error(w, `{"message":"You must log in first."}`, http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.URL.Path == "/me" {
+		json.NewEncoder(w).Encode(map[string]string{"login": "torque"})
+		return
+	}
+	if len(parts) == 3 && parts[0] == "pipeline" && parts[2] == "workflow" {
+		items := []interface{}{}
+		for _, status := range f.statuses {
+			items = append(items, map[string]string{"status": status})
+		}
+		writeCirclePage(w, r, items)
+		return
+	}
+	if len(parts) < 4 || parts[0] != "project" {
+		http.NotFound(w, r)
+		return
+	}
+	slug := strings.Join(parts[1:4], "/")
+	envVars, ok := f.envVars[slug]
+	if !ok {
+		http.Error(w, `{"message":"Project not found"}`, http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 4:
+		json.NewEncoder(w).Encode(map[string]string{"slug": slug})
+	case len(parts) == 5 && parts[4] == "pipeline":
+		json.NewEncoder(w).Encode(map[string][]map[string]string{"items": {{"id": "pipeline-1"}}})
+	case len(parts) == 5 && parts[4] == "envvar" && r.Method == http.MethodGet:
+		items := []interface{}{}
+		for _, name := range sortedKeys(envVars) {
+			value := envVars[name]
+			if len(value) > 4 {
+				value = value[len(value)-4:]
+			}
+			items = append(items, map[string]string{"name": name, "value": "xxxx" + value})
+		}
+		writeCirclePage(w, r, items)
+	case len(parts) == 5 && parts[4] == "envvar" && r.Method == http.MethodPost:
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		envVars[body["name"]] = body["value"]
+		f.adds++
+		w.WriteHeader(http.StatusCreated)
+	case len(parts) == 6 && parts[4] == "envvar" && r.Method == http.MethodDelete:
+		delete(envVars, parts[5])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_Circle_SetsProjectEnvVars(t *testing.T) {
+	fake, server := newFakeCircle()
+	defer server.Close()
+
+	c, err := NewCircle(server.URL, "test-token", "")
+	if err != nil {
+		t.Fatalf("NewCircle() error: %v", err)
+	}
+	for _, target := range []string{"govau/torque", "bb/govau/torque"} {
+		if err := c.EnsureTarget(target); err != nil {
+			t.Fatalf("EnsureTarget(%s) error: %v", target, err)
+		}
+	}
+	if err := c.EnsureTarget("govau/missing"); err == nil || !strings.Contains(err.Error(), "follow the project in the CircleCI app") {
+		t.Errorf("EnsureTarget() expected an error saying to follow a project not being built, got %v", err)
+	}
+
+	if err := c.SetStaticVars("bb/govau/torque", map[string]string{"CF_ORG": "dta", "CF_SPACE": "prod"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := c.SetSecret("bb/govau/torque", "CF_PASSWORD_STAGING", "new-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	if got := fake.envVars["bb/govau/torque"]["CF_PASSWORD_STAGING"]; got != "new-password" {
+		t.Errorf("SetSecret() expected CF_PASSWORD_STAGING to be set on the bitbucket project, got %q", got)
+	}
+	if len(fake.envVars["gh/govau/torque"]) != 0 {
+		t.Errorf("SetSecret() expected the github project to be left alone, got %v", fake.envVars["gh/govau/torque"])
+	}
+
+	names, err := c.SecretNames("bb/govau/torque")
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	if len(names) != 3 || !names["CF_ORG"] || !names["CF_SPACE"] || !names["CF_PASSWORD_STAGING"] {
+		t.Errorf("SecretNames() expected all the pages of env vars, got %v", names)
+	}
+	if err := c.SetStaticVars("bb/govau/torque", map[string]string{"CF_ORG": "other"}); err != nil || fake.adds != 3 {
+		t.Errorf("SetStaticVars() expected existing env vars to be left alone, got %d writes, %v", fake.adds, err)
+	}
+
+	if inProgress, err := c.BuildsInProgress("govau/torque"); err != nil || inProgress != 2 {
+		t.Errorf("BuildsInProgress() expected the running and failing workflows, got %d, %v", inProgress, err)
+	}
+
+	if err := c.Delete("bb/govau/torque", "CF_PASSWORD_STAGING"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, ok := fake.envVars["bb/govau/torque"]["CF_PASSWORD_STAGING"]; ok {
+		t.Error("Delete() expected CF_PASSWORD_STAGING to be gone")
+	}
+}
+
+func Test_ProjectSlug(t *testing.T) {
+	for s, expected := range map[string]string{
+		"govau/torque":           "gh/govau/torque",
+		"gh/govau/torque":        "gh/govau/torque",
+		"github/govau/torque":    "gh/govau/torque",
+		"bb/govau/torque":        "bb/govau/torque",
+		"bitbucket/govau/torque": "bb/govau/torque",
+		"gl/govau/torque":        "",
+		"torque":                 "",
+		"govau/":                 "",
+	} {
+		slug, err := ProjectSlug(s)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("ProjectSlug(%q) expected an error, got %q", s, slug)
+			}
+			continue
+		}
+		if err != nil || slug != expected {
+			t.Errorf("ProjectSlug(%q) expected %q, got %q, %v", s, expected, slug, err)
+		}
+		if org, repo, err := SplitOrgAndRepo(s); err != nil || org != "govau" || repo != "torque" {
+			t.Errorf("SplitOrgAndRepo(%q) expected govau, torque, got %q, %q, %v", s, org, repo, err)
+		}
+	}
+}
+
+func Test_NewPlan_ProjectNotFollowed_IsAProblem(t *testing.T) {
+	defer useSettings(t, planYaml)()
+	fake, _, sinks := planFixture(t)
+	defer fake.server.Close()
+	_, server := newFakeCircle()
+	defer server.Close()
+	c, err := NewCircle(server.URL, "test-token", "")
+	if err != nil {
+		t.Fatalf("NewCircle() error: %v", err)
+	}
+	sinks.sinks[config.SinkCircleCI] = c
+
+	p := NewPlan(sinks)
+	for _, repo := range []string{"govau/a", "govau/missing"} {
+		found := false
+		for _, problem := range p.Problems {
+			if strings.HasPrefix(problem, repo+" is not set up") && strings.Contains(problem, "follow the project in the CircleCI app") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("NewPlan() expected %s to be a problem saying to follow it, got %v", repo, p.Problems)
+		}
+	}
+	if len(p.ProjectsToEnable) != 0 {
+		t.Errorf("NewPlan() expected no projects to enable, got %v", p.ProjectsToEnable)
+	}
+}
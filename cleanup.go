@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/govau/torque/config"
+	"github.com/govau/torque/state"
+)
+
+// ownedEnvVar whether torque sets env vars with this name. Only these are ever cleaned up, so
+// env vars a team adds to its repo themselves are left alone.
+func ownedEnvVar(name string) bool {
+	switch name {
+	case "CF_ORG", "CF_SPACE", "CF_USERNAME":
+		return true
+	}
+	return strings.HasPrefix(name, "CF_API_") || strings.HasPrefix(name, "CF_PASSWORD_")
+}
+
+// wantedEnvVars the names of the env vars the config says each repo should have, by the repo's
+// String(). A repo in more than one space wants the env vars of each. The space being offboarded,
+// if any, is left out as if it were not in the config.
+func wantedEnvVars(offboarding spaceKey) map[string]map[string]bool {
+	wanted := map[string]map[string]bool{}
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			if (spaceKey{cfOrg.Name, cfSpace.Name}) == offboarding {
+				continue
+			}
+			names := map[string]bool{"CF_USERNAME": true}
+			for name := range staticEnvVars(cfOrg.Name, cfSpace) {
+				names[name] = true
+			}
+			for _, id := range rotatedCfIDs(cfSpace) {
+				if cfSpace.Strategy == config.StrategyDual {
+					for _, side := range dualSides {
+						names[dualPasswordEnvVar(side, id)] = true
+					}
+					continue
+				}
+				names[fmt.Sprintf("CF_PASSWORD_%s", id)] = true
+			}
+			for _, repo := range repoNames(cfSpace.Repos) {
+				if wanted[repo] == nil {
+					wanted[repo] = map[string]bool{}
+				}
+				for name := range names {
+					wanted[repo][name] = true
+				}
+			}
+		}
+	}
+	return wanted
+}
+
+// stateRepo the config of a repo the state store lists for the rotation, as it was recorded, or
+// as far as its name says for state recorded before repo configs were
+func stateRepo(rotation state.Rotation, name string) config.Repo {
+	if repo, ok := rotation.RepoConfigs[name]; ok {
+		return repo
+	}
+	return settings.ParseRepo(name)
+}
+
+// configuredRepos every repo in the config, once each
+func configuredRepos() []config.Repo {
+	repos := []config.Repo{}
+	seen := map[string]bool{}
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			for _, repo := range cfSpace.Repos {
+				if !seen[repo.String()] {
+					seen[repo.String()] = true
+					repos = append(repos, repo)
+				}
+			}
+		}
+	}
+	return repos
+}
+
+// removedRepos the repos the state store says were given a password that are no longer in the
+// config. A rotation replaces the repos listed for its space, so these are read before rotating.
+func removedRepos() ([]config.Repo, error) {
+	rotations, err := stateStore.List()
+	if err != nil {
+		return nil, err
+	}
+	wanted := wantedEnvVars(spaceKey{})
+	removed := map[string]config.Repo{}
+	for _, rotation := range rotations {
+		if rotation.Outcome == state.OutcomeOffboarded {
+			continue
+		}
+		for _, repos := range [][]string{rotation.Repos, rotation.StaleRepos} {
+			for _, repo := range repos {
+				if _, ok := wanted[repo]; !ok {
+					removed[repo] = stateRepo(rotation, repo)
+				}
+			}
+		}
+	}
+	repos := []config.Repo{}
+	for _, name := range sortedReposOf(removed) {
+		repos = append(repos, removed[name])
+	}
+	return repos, nil
+}
+
+// unwantedEnvVars the env vars torque set in each of the repos that the config no longer implies,
+// by repo. Repos no longer in the config are adopted so they can be reached. Protected env vars
+// are never included, and untilPublished is as for unwantedIn. Repos that cannot be read are
+// returned with their errors, by repo.
+func unwantedEnvVars(sinks *repoSinks, repos []config.Repo, untilPublished bool) (map[string][]string, map[string]error) {
+	unwanted := map[string][]string{}
+	failed := map[string]error{}
+
+	wanted := wantedEnvVars(spaceKey{})
+	for _, repo := range repos {
+		name := repo.String()
+		if err := sinks.adopt(repo); err != nil {
+			failed[name] = err
+			continue
+		}
+		names, err := unwantedIn(sinks, name, wanted[name], untilPublished)
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+		if len(names) > 0 {
+			unwanted[name] = names
+		}
+	}
+	return unwanted, failed
+}
+
+// unwantedIn the env vars torque set in the repo that are not wanted, leaving out protected ones.
+// With untilPublished, passwords are left while the repo is missing any password it wants, so one
+// the config now names differently, e.g. after switching the space to the dual strategy, is not
+// removed before its replacement has been published.
+func unwantedIn(sinks *repoSinks, repo string, wanted map[string]bool, untilPublished bool) ([]string, error) {
+	ready, err := sinks.TargetReady(repo)
+	if err != nil || !ready {
+		// Nothing can have been set in a repo that is not ready
+		return nil, err
+	}
+	names, err := sinks.SecretNames(repo)
+	if err != nil {
+		return nil, err
+	}
+	keepPasswords := false
+	for name := range wanted {
+		if strings.HasPrefix(name, "CF_PASSWORD_") && !names[name] {
+			keepPasswords = untilPublished
+		}
+	}
+	protected := map[string]bool{}
+	for _, name := range settings.Cleanup.Protected {
+		protected[name] = true
+	}
+	unwanted := []string{}
+	for name := range names {
+		if keepPasswords && strings.HasPrefix(name, "CF_PASSWORD_") {
+			continue
+		}
+		if ownedEnvVar(name) && !wanted[name] && !protected[name] {
+			unwanted = append(unwanted, name)
+		}
+	}
+	sort.Strings(unwanted)
+	return unwanted, nil
+}
+
+// cleanUp remove the env vars torque set in the repos that the config no longer implies, if
+// cleanup is enabled
+func cleanUp(sinks *repoSinks, repos []config.Repo, report *Report) {
+	if !settings.Cleanup.Enabled {
+		return
+	}
+	unwanted, failed := unwantedEnvVars(sinks, repos, true)
+	for _, repo := range sortedErrors(failed) {
+		report.Fail(repo, "Problem finding env vars to clean up in %s: %v", repo, failed[repo])
+	}
+	for _, repo := range sortedRepos(unwanted) {
+		for _, name := range unwanted[repo] {
+			log.Printf("Removing %s from %s, as the config no longer sets it", name, repo)
+			if err := sinks.Delete(repo, name); err != nil {
+				report.Fail(repo, "Problem removing %s from %s: %v", name, repo, err)
+				continue
+			}
+			report.Removed = append(report.Removed, fmt.Sprintf("%s %s", repo, name))
+		}
+	}
+}
+
+// reposToCleanUp every repo in the config and those removed from it, reading the state store
+// for the removed ones. A problem reading it is reported, and only the configured repos returned.
+func reposToCleanUp(report *Report) []config.Repo {
+	removed, err := removedRepos()
+	if err != nil {
+		report.Fail("state", "Problem reading state: %v", err)
+	}
+	return append(configuredRepos(), removed...)
+}
+
+// sortedErrors the repos of a map of errors by repo in a stable order
+func sortedErrors(m map[string]error) []string {
+	repos := []string{}
+	for repo := range m {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// sortedRepos the repos of a map by repo in a stable order
+func sortedRepos(m map[string][]string) []string {
+	repos := []string{}
+	for repo := range m {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// sortedReposOf the repos of a map of repo configs in a stable order
+func sortedReposOf(m map[string]config.Repo) []string {
+	repos := []string{}
+	for repo := range m {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/govau/torque/config"
+	"github.com/govau/torque/state"
+)
+
+// listStore a state store that only lists the rotations it was given
+type listStore []state.Rotation
+
+func (l listStore) Get(key state.Key) (*state.Rotation, error) { return nil, nil }
+func (l listStore) Put(rotation state.Rotation) error          { return nil }
+func (l listStore) List() ([]state.Rotation, error)            { return l, nil }
+
+func Test_CleanUp_RemovesEnvVarsNoLongerConfigured(t *testing.T) {
+	defer func(s *config.Settings, c map[string]*CfInfo, st state.Store) {
+		settings, cfInfos, stateStore = s, c, st
+	}(settings, cfInfos, stateStore)
+	settings = &config.Settings{
+		Cleanup: config.Cleanup{Enabled: true, Protected: []string{"CF_API_OLD"}},
+		Orgs: []config.CfOrg{{
+			Name: "org",
+			Spaces: []config.CfSpace{{
+				Name:     "space",
+				Strategy: config.StrategySingle,
+				SkipIDs:  []string{"B"},
+				Repos:    []config.Repo{{Name: "govau/a", Sink: config.SinkCircleCI}},
+			}},
+		}},
+	}
+	cfInfos = map[string]*CfInfo{
+		"A": {ID: "A", APIHref: "https://api.a.example.com"},
+		"B": {ID: "B", APIHref: "https://api.b.example.com"},
+	}
+	stateStore = listStore{{Repos: []string{"govau/a", "govau/removed"}}}
+
+	sink := newFakeSink()
+	sink.envVars["govau/a"] = map[string]string{
+		"CF_ORG": "org", "CF_SPACE": "space", "CF_USERNAME": "ci-org-space",
+		"CF_API_A": "https://api.a.example.com", "CF_PASSWORD_A": "a",
+		"CF_API_B": "https://api.b.example.com", "CF_PASSWORD_B": "b",
+		"CF_API_OLD": "https://api.old.example.com", "DOCKER_PASSWORD": "theirs",
+	}
+	sink.envVars["govau/removed"] = map[string]string{"CF_PASSWORD_A": "a", "NPM_TOKEN": "theirs"}
+	sinks := &repoSinks{
+		settings: settings,
+		repos:    map[string]config.Repo{"govau/a": settings.Orgs[0].Spaces[0].Repos[0]},
+		sinks:    map[string]SecretSink{config.SinkCircleCI: sink},
+	}
+
+	report := &Report{}
+	cleanUp(sinks, reposToCleanUp(report), report)
+	if report.Failed() {
+		t.Fatalf("cleanUp() failed: %v", report.Failures)
+	}
+	want := []string{"govau/a CF_API_B", "govau/a CF_PASSWORD_B", "govau/removed CF_PASSWORD_A"}
+	if len(report.Removed) != len(want) {
+		t.Fatalf("cleanUp() expected to remove %v, got %v", want, report.Removed)
+	}
+	for i := range want {
+		if report.Removed[i] != want[i] {
+			t.Errorf("cleanUp() expected to remove %v, got %v", want, report.Removed)
+		}
+	}
+	for _, name := range []string{"CF_API_A", "CF_PASSWORD_A", "CF_API_OLD", "DOCKER_PASSWORD"} {
+		if _, ok := sink.envVars["govau/a"][name]; !ok {
+			t.Errorf("cleanUp() expected %s to be left in govau/a", name)
+		}
+	}
+	if _, ok := sink.envVars["govau/removed"]["NPM_TOKEN"]; !ok {
+		t.Error("cleanUp() expected env vars torque does not set to be left in govau/removed")
+	}
+}
+
+func Test_RemovedRepos_KeepsTheRecordedConfig(t *testing.T) {
+	defer func(s *config.Settings, st state.Store) { settings, stateStore = s, st }(settings, stateStore)
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateStore = state.NewFileStore(filepath.Join(dir, "state.json"))
+
+	group := config.Repo{Name: "team", Sink: config.SinkGitLab, Group: true}
+	settings = &config.Settings{Orgs: []config.CfOrg{{
+		Name:   "org",
+		Spaces: []config.CfSpace{{Name: "space", Repos: []config.Repo{group}}},
+	}}}
+	target := rotationTarget{cfIDs: []string{"A"}, org: "org", space: "space", username: "ci-org-space"}
+	recordState(target, &rotation{repos: []string{group.String()}, committed: true, committedAt: time.Now()}, nil, &Report{})
+
+	// The group is removed from the config
+	settings.Orgs[0].Spaces[0].Repos = nil
+	removed, err := removedRepos()
+	if err != nil {
+		t.Fatalf("removedRepos() error: %v", err)
+	}
+	if len(removed) != 1 || removed[0].Name != "team" || removed[0].Sink != config.SinkGitLab || !removed[0].Group {
+		t.Errorf("removedRepos() expected the gitlab group team, got %+v", removed)
+	}
+}
+
+func Test_CleanUp_KeepsPasswordsUntilTheirReplacementsArePublished(t *testing.T) {
+	defer func(s *config.Settings, c map[string]*CfInfo, st state.Store) {
+		settings, cfInfos, stateStore = s, c, st
+	}(settings, cfInfos, stateStore)
+	// The space has just been switched to the dual strategy
+	settings = &config.Settings{
+		Cleanup: config.Cleanup{Enabled: true},
+		Orgs: []config.CfOrg{{
+			Name: "org",
+			Spaces: []config.CfSpace{{
+				Name:     "space",
+				Strategy: config.StrategyDual,
+				Repos:    []config.Repo{{Name: "govau/a", Sink: config.SinkCircleCI}},
+			}},
+		}},
+	}
+	cfInfos = map[string]*CfInfo{"A": {ID: "A", APIHref: "https://api.a.example.com"}}
+	stateStore = listStore{}
+
+	sink := newFakeSink()
+	sink.envVars["govau/a"] = map[string]string{"CF_USERNAME": "ci-org-space", "CF_PASSWORD_A": "single"}
+	sinks := &repoSinks{
+		settings: settings,
+		repos:    map[string]config.Repo{"govau/a": settings.Orgs[0].Spaces[0].Repos[0]},
+		sinks:    map[string]SecretSink{config.SinkCircleCI: sink},
+	}
+
+	report := &Report{}
+	cleanUp(sinks, configuredRepos(), report)
+	if len(report.Removed) != 0 {
+		t.Errorf("cleanUp() expected CF_PASSWORD_A to be kept until the dual passwords are published, got %v", report.Removed)
+	}
+
+	sink.envVars["govau/a"]["CF_PASSWORD_A_A"] = "a"
+	sink.envVars["govau/a"]["CF_PASSWORD_B_A"] = "b"
+	cleanUp(sinks, configuredRepos(), report)
+	if len(report.Removed) != 1 || report.Removed[0] != "govau/a CF_PASSWORD_A" {
+		t.Errorf("cleanUp() expected CF_PASSWORD_A to be removed once the dual passwords are published, got %v", report.Removed)
+	}
+}
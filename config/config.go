@@ -1,19 +1,293 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"text/template"
+	"time"
 
+	"github.com/govau/torque/schedule"
 	"gopkg.in/yaml.v2"
 )
 
+// Defaults for settings that are not given in the config file
+const (
+	DefaultRetries           = 3
+	DefaultRetryDelay        = 5 * time.Second
+	DefaultBuildPollInterval = 30 * time.Second
+	DefaultBuildMaxWait      = 15 * time.Minute
+	DefaultBuildOnTimeout    = OnTimeoutProceed
+	// DefaultSchedule 6am daily, as the pipeline this replaces ran
+	DefaultSchedule           = "0 6 * * *"
+	DefaultJitter             = 5 * time.Minute
+	DefaultConfigPollInterval = 30 * time.Second
+)
+
+// What to do when builds are still running after BuildWait.MaxWait
+const (
+	// OnTimeoutProceed rotate the password anyway
+	OnTimeoutProceed = "proceed"
+	// OnTimeoutSkip leave the password alone until the next run
+	OnTimeoutSkip = "skip"
+)
+
+// Rotation strategies for a space's ci user
+const (
+	// StrategySingle one ci user, whose password is changed in place
+	StrategySingle = "single"
+	// StrategyDual two ci users, ci-org-space-a and ci-org-space-b. The inactive one is rotated
+	// and becomes active, leaving the previously active one valid until the next rotation.
+	StrategyDual = "dual"
+)
+
+// What to do with static env vars, such as CF_ORG, that are already set to a different value
+const (
+	// StaticVarsEnforce rewrite them with the value the config gives, the default
+	StaticVarsEnforce = "enforce"
+	// StaticVarsAddOnly leave them alone, only adding those that are missing
+	StaticVarsAddOnly = "add-only"
+)
+
+// Sinks the types of sink a repo's credentials can be delivered through
+const (
+	// SinkCircleCI CircleCI project env vars, the default
+	SinkCircleCI = "circleci"
+	// SinkGitHub GitHub Actions repository and environment secrets
+	SinkGitHub = "github"
+	// SinkGitLab GitLab project and group CI/CD variables
+	SinkGitLab = "gitlab"
+	// SinkCredHub CredHub credentials, e.g. for Concourse pipelines
+	SinkCredHub = "credhub"
+	// SinkVault HashiCorp Vault KV version 2 secrets
+	SinkVault = "vault"
+	// SinkKubernetes Kubernetes Secrets
+	SinkKubernetes = "kubernetes"
+	// SinkBuildkite Buildkite cluster secrets
+	SinkBuildkite = "buildkite"
+	// SinkCircleCIContext the env vars of a CircleCI organisation context, see CfSpace.CircleCIContext
+	SinkCircleCIContext = "circleci-context"
+)
+
+// Default URLs of the hosted sinks
+const (
+	// DefaultGitHubAPIURL the API of github.com
+	DefaultGitHubAPIURL = "https://api.github.com"
+	// DefaultGitLabURL gitlab.com
+	DefaultGitLabURL = "https://gitlab.com"
+	// DefaultBuildkiteAPIURL the Buildkite REST API
+	DefaultBuildkiteAPIURL = "https://api.buildkite.com"
+)
+
+// The CircleCI endpoint repos are on unless they name another
+const (
+	// DefaultCircleCIEndpoint the name of circleci.com's endpoint
+	DefaultCircleCIEndpoint = "circleci"
+	// DefaultCircleCIURL circleci.com
+	DefaultCircleCIURL = "https://circleci.com"
+	// DefaultCircleCITokenEnv the env var of the token for circleci.com
+	DefaultCircleCITokenEnv = "CIRCLE_TOKEN"
+)
+
+// DefaultCredHubPath where Concourse looks up a pipeline's credentials, for a repo named
+// team/pipeline
+const DefaultCredHubPath = "/concourse/{{.Repo}}"
+
+// Defaults for the vault sink
+const (
+	DefaultVaultMount = "secret"
+	// DefaultVaultPath one secret for each cf a space deploys to
+	DefaultVaultPath = "torque/{{.Org}}/{{.Space}}/{{.CfID}}"
+)
+
+// How the vault sink logs in to Vault
+const (
+	// VaultAuthToken use the token in VAULT_TOKEN, the default
+	VaultAuthToken = "token"
+	// VaultAuthAppRole log in with the role ID and secret ID in VAULT_ROLE_ID and VAULT_SECRET_ID
+	VaultAuthAppRole = "approle"
+	// VaultAuthKubernetes log in with the pod's service account token
+	VaultAuthKubernetes = "kubernetes"
+)
+
+// sinkTypes every known sink type
+var sinkTypes = []string{SinkCircleCI, SinkGitHub, SinkGitLab, SinkCredHub, SinkVault, SinkKubernetes, SinkBuildkite, SinkCircleCIContext}
+
 // Settings The application settings
 type Settings struct {
 	UaaOrigin string `yaml:"uaa_origin"`
-  Cfs  []Cf
-	Orgs []CfOrg
+	Cfs       []Cf
+	Orgs      []CfOrg
+	// Retries how many more times a new password is pushed to a repo after the first attempt fails
+	Retries *int
+	// RetryDelay how long to wait between attempts to push a new password
+	RetryDelay time.Duration `yaml:"retry_delay"`
+	BuildWait  BuildWait     `yaml:"build_wait"`
+	// CreateUsers whether to create missing ci users, and give them the SpaceDeveloper role
+	CreateUsers bool `yaml:"create_users"`
+	State       State
+	// MaxAge how old a password can get before it is rotated. Zero rotates on every run.
+	// Can be overridden per org and per space.
+	MaxAge time.Duration `yaml:"max_age"`
+	// StaticVars whether static env vars that have drifted from the config are rewritten,
+	// enforce or add-only. Can be overridden per space.
+	StaticVars string `yaml:"static_vars"`
+	// RevokeTokens whether the UAA tokens of a ci user are revoked after its password is
+	// rotated. Can be overridden per space.
+	RevokeTokens RevokeTokens `yaml:"revoke_tokens"`
+	Cleanup      Cleanup
+	Offboard     Offboard
+	Serve        Serve
+	CircleCI     CircleCI `yaml:"circleci"`
+	GitHub       GitHub   `yaml:"github"`
+	GitLab       GitLab   `yaml:"gitlab"`
+	CredHub      CredHub  `yaml:"credhub"`
+	Vault        Vault
+	Kubernetes   Kubernetes
+	Buildkite    Buildkite
+}
+
+// RevokeTokens settings for revoking the UAA tokens issued to a ci user before its password was
+// rotated, which changing the password leaves working
+type RevokeTokens struct {
+	// Enabled whether the tokens are revoked, off unless set
+	Enabled *bool
+}
+
+// Cleanup settings for removing env vars torque set in a repo that the config no longer implies,
+// e.g. CF_PASSWORD_<ID> after the cf is added to the space's skip_ids
+type Cleanup struct {
+	// Enabled whether the env vars are removed. They are listed by -plan either way.
+	Enabled bool
+	// Protected names of env vars that are never removed from any repo
+	Protected []string
+}
+
+// Offboard settings for retiring spaces that are removed from the config
+type Offboard struct {
+	// Orphans whether each run offboards the spaces the state store has rotated that are no
+	// longer in the config, rather than waiting for torque offboard
+	Orphans bool
+	// DeleteUsers whether offboarded ci users are deleted from UAA, rather than deactivated
+	DeleteUsers bool `yaml:"delete_users"`
+}
+
+// CircleCI settings for the circleci and circleci-context sinks
+type CircleCI struct {
+	// Endpoints the CircleCI instances repos can be on, e.g. CircleCI Server. circleci.com is
+	// always one, named circleci, unless an endpoint of that name is given.
+	Endpoints []CircleCIEndpoint
+}
+
+// CircleCIEndpoint a CircleCI instance
+type CircleCIEndpoint struct {
+	// Name repos use to say they are on this instance
+	Name string
+	// URL of the instance, e.g. https://circleci.example.gov.au
+	URL string
+	// TokenEnv the env var holding the API token for this instance
+	TokenEnv string `yaml:"token_env"`
+	// CACert the file of the CA certificate the instance's certificate is signed by, if it is not
+	// trusted by the system
+	CACert string `yaml:"ca_cert"`
+}
+
+// GitHub settings for the github sink
+type GitHub struct {
+	// APIURL the GitHub API, for GitHub Enterprise Server. Defaults to github.com.
+	APIURL string `yaml:"api_url"`
+}
+
+// GitLab settings for the gitlab sink
+type GitLab struct {
+	// URL of the GitLab instance, for self-hosted GitLab. Defaults to gitlab.com.
+	URL string
+}
+
+// CredHub settings for the credhub sink
+type CredHub struct {
+	// URL of the CredHub API
+	URL string
+	// CACert the file of the CA certificate CredHub's certificate is signed by, if it is not
+	// trusted by the system
+	CACert string `yaml:"ca_cert"`
+	// Path the template of the path credentials are set under, see Repo.Path.
+	// Can be overridden per space.
+	Path string
+}
+
+// Vault settings for the vault sink
+type Vault struct {
+	// Address of Vault, e.g. https://vault.example.gov.au:8200
+	Address string
+	// CACert the file of the CA certificate Vault's certificate is signed by, if it is not
+	// trusted by the system
+	CACert string `yaml:"ca_cert"`
+	// Mount the path the KV version 2 secrets engine is mounted at
+	Mount string
+	// Path the template of the path of each secret in the mount, see Repo.Name.
+	// Can be overridden per space.
+	Path string
+	Auth VaultAuth
+}
+
+// VaultAuth how the vault sink logs in to Vault
+type VaultAuth struct {
+	// Method token, approle or kubernetes
+	Method string
+	// Mount the path the auth method is mounted at. Defaults to the method's name.
+	Mount string
+	// Role the Vault role, for kubernetes
+	Role string
+}
+
+// Kubernetes settings for the kubernetes sink
+type Kubernetes struct {
+	// Kubeconfig the kubeconfig file to use, or empty to use the pod's service account when
+	// running in the cluster
+	Kubeconfig string
+	// Context in the kubeconfig file. Defaults to its current context.
+	Context string
+	// Namespace of Secrets whose repo name has no namespace. Defaults to the context's namespace,
+	// or the pod's.
+	Namespace string
+}
+
+// Buildkite settings for the buildkite sink
+type Buildkite struct {
+	// APIURL the Buildkite REST API. Defaults to api.buildkite.com.
+	APIURL string `yaml:"api_url"`
+}
+
+// Serve settings for torque serve, which stays running and rotates each space on a schedule
+type Serve struct {
+	// Schedule when to rotate spaces, a cron expression or "@every <duration>".
+	// Can be overridden per org and per space.
+	Schedule string
+	// Jitter the longest random delay added to each scheduled run, so spaces on the same
+	// schedule do not all hit UAA and CircleCI at once
+	Jitter time.Duration
+	// ConfigPollInterval how often to check the config file for changes
+	ConfigPollInterval time.Duration `yaml:"config_poll_interval"`
+}
+
+// State where torque records what it did between runs
+type State struct {
+	// Type of store, "file" or empty to keep nothing
+	Type string
+	// Path of the file, for the file store
+	Path string
+}
+
+// BuildWait how long to wait for CircleCI builds that are running or queued before rotating a
+// space's password, so a deploy does not have its password changed part way through
+type BuildWait struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+	MaxWait      time.Duration `yaml:"max_wait"`
+	OnTimeout    string        `yaml:"on_timeout"`
 }
 
 // Cf CloudFoundry instance settings
@@ -24,20 +298,432 @@ type Cf struct {
 
 // CfOrg CloudFoundry Organisation settings
 type CfOrg struct {
-	Name   string
-	Spaces []CfSpace
+	Name     string
+	Spaces   []CfSpace
+	MaxAge   time.Duration `yaml:"max_age"`
+	Schedule string
 }
 
 // CfSpace CloudFoundry Space settings
 type CfSpace struct {
-	Name  string
-	Repos []string
-	SkipIDs []string `yaml:"skip_ids"`
+	Name     string
+	Repos    []Repo
+	SkipIDs  []string `yaml:"skip_ids"`
+	Strategy string
+	MaxAge   time.Duration `yaml:"max_age"`
+	Schedule string
+	// CredHubPath the template of the CredHub path for this space's credhub repos
+	CredHubPath string `yaml:"credhub_path"`
+	// VaultPath the template of the Vault path for this space's vault repos
+	VaultPath string `yaml:"vault_path"`
+	// StaticVars whether this space's static env vars that have drifted are rewritten
+	StaticVars string `yaml:"static_vars"`
+	// RevokeTokens whether this space's ci users have their tokens revoked after a rotation
+	RevokeTokens RevokeTokens `yaml:"revoke_tokens"`
+	// CircleCIContext a CircleCI context to deliver the credentials to once for all the projects
+	// that use it, rather than to each project
+	CircleCIContext *CircleCIContext `yaml:"circleci_context"`
+}
+
+// CircleCIContext a CircleCI organisation context for a space
+type CircleCIContext struct {
+	// Owner the slug of the CircleCI organisation, e.g. gh/govau
+	Owner string
+	// Name of the context. Defaults to cf-<org>-<space>.
+	Name string
+	// SecurityGroups the IDs of the groups the context is restricted to, if any
+	SecurityGroups []string `yaml:"security_groups"`
+	// Endpoint the name of the CircleCI endpoint the organisation is on. Defaults to circleci.com.
+	Endpoint string
+	// WaitFor the CircleCI projects that use the context, e.g. govau/myrepo1. Their builds are
+	// waited for before the space is rotated, but nothing is set on them. Must be set for a space
+	// with no other repos.
+	WaitFor []string `yaml:"wait_for"`
+}
+
+// Repo somewhere a space's credentials are delivered to. In the config file it is either just the
+// name, for a CircleCI project, or a map with the name and sink.
+type Repo struct {
+	// Name of the repo, e.g. govau/torque. For the vault sink, the template of the path of each
+	// secret in the mount, where {{.Org}}, {{.Space}} and {{.CfID}} are replaced by the space's org,
+	// the space and each cf it deploys to. Defaults to the space's vault_path. For the kubernetes
+	// sink, the Secret's name, optionally after its namespace, e.g. deploy/cf-dta-prod.
+	Name string `json:"name"`
+	// Sink the type of sink the credentials are delivered through, circleci by default
+	Sink string `json:"sink,omitempty"`
+	// Environments for the github sink, the GitHub Actions environment to put each cf's
+	// secrets in, by cf ID. Secrets for other cfs, and those for every cf, go in the repo.
+	Environments map[string]string `json:"environments,omitempty"`
+	// Group for the gitlab sink, whether Name is a group rather than a project. Every project in
+	// the group inherits its variables.
+	Group bool `json:"group,omitempty"`
+	// SecurityGroups for the circleci-context sink, the IDs of the groups the context is
+	// restricted to
+	SecurityGroups []string `yaml:"security_groups" json:"security_groups,omitempty"`
+	// Path for the credhub sink, the template of the path credentials are set under. {{.Repo}} is
+	// replaced by Name. Defaults to the space's credhub_path.
+	Path string `json:"path,omitempty"`
+	// Endpoint for the circleci and circleci-context sinks, the name of the CircleCI endpoint the
+	// repo is on. Defaults to circleci.com.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// UnmarshalYAML accept either a name or a map
+func (r *Repo) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*r = Repo{Name: name}
+		return nil
+	}
+	type plain Repo
+	return unmarshal((*plain)(r))
+}
+
+// String identifies the repo in logs, reports and the state store. CircleCI projects on
+// circleci.com are just their name, as they were before there were other sinks.
+func (r Repo) String() string {
+	if r.SinkName() == SinkCircleCI {
+		return r.Name
+	}
+	return r.SinkName() + ":" + r.Name
+}
+
+// ParseRepo the repo whose String() is name, for a repo that is no longer in the config and whose
+// config was not recorded. Only what String() includes, and the defaults that do not depend on the
+// repo's space, are filled in.
+func (s *Settings) ParseRepo(name string) Repo {
+	i := strings.Index(name, ":")
+	if i < 0 {
+		return Repo{Name: name, Sink: SinkCircleCI, Endpoint: DefaultCircleCIEndpoint}
+	}
+	repo := Repo{Name: name[i+1:], Sink: name[:i]}
+	if j := strings.Index(repo.Sink, "@"); j >= 0 {
+		repo.Sink, repo.Endpoint = repo.Sink[:j], repo.Sink[j+1:]
+	}
+	if repo.isCircleCI() && repo.Endpoint == "" {
+		repo.Endpoint = DefaultCircleCIEndpoint
+	}
+	if repo.Sink == SinkCredHub {
+		repo.Path = s.CredHub.Path
+	}
+	return repo
+}
+
+// SinkName identifies the sink the repo is delivered through, which is its type, and for the
+// CircleCI sinks on an endpoint other than circleci.com, the type then @ and the endpoint's name
+func (r Repo) SinkName() string {
+	sink := r.Sink
+	if sink == "" {
+		sink = SinkCircleCI
+	}
+	if r.Endpoint != "" && r.Endpoint != DefaultCircleCIEndpoint {
+		return sink + "@" + r.Endpoint
+	}
+	return sink
+}
+
+// isCircleCI whether the repo is delivered through one of the CircleCI sinks
+func (r Repo) isCircleCI() bool {
+	return r.Sink == SinkCircleCI || r.Sink == SinkCircleCIContext
+}
+
+// CircleCIEndpoint the CircleCI endpoint with this name
+func (s *Settings) CircleCIEndpoint(name string) (CircleCIEndpoint, bool) {
+	for _, endpoint := range s.CircleCI.Endpoints {
+		if endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return CircleCIEndpoint{}, false
+}
+
+// MaxAgeFor how old the password of this space's ci user can get before it is rotated
+func (s *Settings) MaxAgeFor(cfOrg CfOrg, cfSpace CfSpace) time.Duration {
+	if cfSpace.MaxAge != 0 {
+		return cfSpace.MaxAge
+	}
+	if cfOrg.MaxAge != 0 {
+		return cfOrg.MaxAge
+	}
+	return s.MaxAge
+}
+
+// StaticVarsFor whether this space's static env vars that have drifted from the config are
+// rewritten
+func (s *Settings) StaticVarsFor(cfSpace CfSpace) string {
+	if cfSpace.StaticVars != "" {
+		return cfSpace.StaticVars
+	}
+	return s.StaticVars
+}
+
+// RevokeTokensFor whether the tokens of this space's ci users are revoked after a rotation
+func (s *Settings) RevokeTokensFor(cfSpace CfSpace) bool {
+	if cfSpace.RevokeTokens.Enabled != nil {
+		return *cfSpace.RevokeTokens.Enabled
+	}
+	return s.RevokeTokens.Enabled != nil && *s.RevokeTokens.Enabled
+}
+
+// WaitForRepos the CircleCI projects using the space's context, whose builds are waited for but
+// which are not delivered to
+func (c CfSpace) WaitForRepos() []Repo {
+	repos := []Repo{}
+	if c.CircleCIContext == nil {
+		return repos
+	}
+	endpoint := c.CircleCIContext.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultCircleCIEndpoint
+	}
+	for _, name := range c.CircleCIContext.WaitFor {
+		repos = append(repos, Repo{Name: name, Sink: SinkCircleCI, Endpoint: endpoint})
+	}
+	return repos
+}
+
+// CredHubPathFor the template of the CredHub path for this space's credhub repos
+func (s *Settings) CredHubPathFor(cfSpace CfSpace) string {
+	if cfSpace.CredHubPath != "" {
+		return cfSpace.CredHubPath
+	}
+	return s.CredHub.Path
+}
+
+// VaultPathFor the template of the Vault path for this space's vault repos
+func (s *Settings) VaultPathFor(cfSpace CfSpace) string {
+	if cfSpace.VaultPath != "" {
+		return cfSpace.VaultPath
+	}
+	return s.Vault.Path
+}
+
+// ScheduleFor when torque serve rotates this space
+func (s *Settings) ScheduleFor(cfOrg CfOrg, cfSpace CfSpace) string {
+	if cfSpace.Schedule != "" {
+		return cfSpace.Schedule
+	}
+	if cfOrg.Schedule != "" {
+		return cfOrg.Schedule
+	}
+	return s.Serve.Schedule
+}
+
+func setDefaults(s *Settings) {
+	if s.Retries == nil {
+		retries := DefaultRetries
+		s.Retries = &retries
+	}
+	if s.RetryDelay == 0 {
+		s.RetryDelay = DefaultRetryDelay
+	}
+	if s.BuildWait.PollInterval == 0 {
+		s.BuildWait.PollInterval = DefaultBuildPollInterval
+	}
+	if s.BuildWait.MaxWait == 0 {
+		s.BuildWait.MaxWait = DefaultBuildMaxWait
+	}
+	if s.BuildWait.OnTimeout == "" {
+		s.BuildWait.OnTimeout = DefaultBuildOnTimeout
+	}
+	if _, ok := s.CircleCIEndpoint(DefaultCircleCIEndpoint); !ok {
+		s.CircleCI.Endpoints = append(s.CircleCI.Endpoints, CircleCIEndpoint{
+			Name:     DefaultCircleCIEndpoint,
+			URL:      DefaultCircleCIURL,
+			TokenEnv: DefaultCircleCITokenEnv,
+		})
+	}
+	for i := range s.CircleCI.Endpoints {
+		s.CircleCI.Endpoints[i].URL = strings.TrimSuffix(s.CircleCI.Endpoints[i].URL, "/")
+	}
+	if s.StaticVars == "" {
+		s.StaticVars = StaticVarsEnforce
+	}
+	if s.GitHub.APIURL == "" {
+		s.GitHub.APIURL = DefaultGitHubAPIURL
+	}
+	if s.GitLab.URL == "" {
+		s.GitLab.URL = DefaultGitLabURL
+	}
+	if s.Buildkite.APIURL == "" {
+		s.Buildkite.APIURL = DefaultBuildkiteAPIURL
+	}
+	if s.CredHub.Path == "" {
+		s.CredHub.Path = DefaultCredHubPath
+	}
+	if s.Vault.Mount == "" {
+		s.Vault.Mount = DefaultVaultMount
+	}
+	if s.Vault.Path == "" {
+		s.Vault.Path = DefaultVaultPath
+	}
+	if s.Vault.Auth.Method == "" {
+		s.Vault.Auth.Method = VaultAuthToken
+	}
+	if s.Vault.Auth.Mount == "" {
+		s.Vault.Auth.Mount = s.Vault.Auth.Method
+	}
+	if s.Serve.Schedule == "" {
+		s.Serve.Schedule = DefaultSchedule
+	}
+	if s.Serve.Jitter == 0 {
+		s.Serve.Jitter = DefaultJitter
+	}
+	if s.Serve.ConfigPollInterval == 0 {
+		s.Serve.ConfigPollInterval = DefaultConfigPollInterval
+	}
+	for i := range s.Orgs {
+		for j := range s.Orgs[i].Spaces {
+			if s.Orgs[i].Spaces[j].Strategy == "" {
+				s.Orgs[i].Spaces[j].Strategy = StrategySingle
+			}
+			if context := s.Orgs[i].Spaces[j].CircleCIContext; context != nil {
+				if context.Name == "" {
+					context.Name = fmt.Sprintf("cf-%s-%s", s.Orgs[i].Name, s.Orgs[i].Spaces[j].Name)
+				}
+				s.Orgs[i].Spaces[j].Repos = append(s.Orgs[i].Spaces[j].Repos, Repo{
+					Name:           context.Owner + "/" + context.Name,
+					Sink:           SinkCircleCIContext,
+					SecurityGroups: context.SecurityGroups,
+					Endpoint:       context.Endpoint,
+				})
+			}
+			for k := range s.Orgs[i].Spaces[j].Repos {
+				repo := &s.Orgs[i].Spaces[j].Repos[k]
+				if repo.Sink == "" {
+					repo.Sink = SinkCircleCI
+				}
+				if repo.isCircleCI() && repo.Endpoint == "" {
+					repo.Endpoint = DefaultCircleCIEndpoint
+				}
+				if repo.Sink == SinkCredHub && repo.Path == "" {
+					repo.Path = s.CredHubPathFor(s.Orgs[i].Spaces[j])
+				}
+				if repo.Sink == SinkVault {
+					if repo.Name == "" {
+						repo.Name = s.VaultPathFor(s.Orgs[i].Spaces[j])
+					}
+					// A bad template is left as it is, for validate to report
+					if name, err := spaceVaultPath(repo.Name, s.Orgs[i].Name, s.Orgs[i].Spaces[j].Name); err == nil {
+						repo.Name = name
+					}
+				}
+			}
+		}
+	}
 }
 
 func validate(s *Settings) error {
+	if *s.Retries < 0 {
+		return fmt.Errorf("Config: retries must not be negative: %d", *s.Retries)
+	}
+	if s.BuildWait.OnTimeout != OnTimeoutProceed && s.BuildWait.OnTimeout != OnTimeoutSkip {
+		return fmt.Errorf("Config: build_wait on_timeout must be %s or %s: %s", OnTimeoutProceed, OnTimeoutSkip, s.BuildWait.OnTimeout)
+	}
+
+	if s.Serve.Jitter < 0 || s.Serve.ConfigPollInterval < 0 {
+		return fmt.Errorf("Config: serve jitter and config_poll_interval must not be negative")
+	}
+
+	switch s.Vault.Auth.Method {
+	case VaultAuthToken, VaultAuthAppRole:
+	case VaultAuthKubernetes:
+		if s.Vault.Auth.Role == "" {
+			return fmt.Errorf("Config: vault auth role must be set for %s", VaultAuthKubernetes)
+		}
+	default:
+		return fmt.Errorf("Config: vault auth method must be %s, %s or %s: %s", VaultAuthToken, VaultAuthAppRole, VaultAuthKubernetes, s.Vault.Auth.Method)
+	}
+
+	endpoints := map[string]bool{}
+	for _, endpoint := range s.CircleCI.Endpoints {
+		if endpoint.Name == "" || endpoint.URL == "" || endpoint.TokenEnv == "" {
+			return fmt.Errorf("Config: circleci endpoints must have a name, url and token_env: %+v", endpoint)
+		}
+		if endpoints[endpoint.Name] {
+			return fmt.Errorf("Config: circleci endpoint %s is given more than once", endpoint.Name)
+		}
+		endpoints[endpoint.Name] = true
+	}
+
+	if s.State.Type == "file" && s.State.Path == "" {
+		return fmt.Errorf("Config: state path must be set for the file store")
+	}
+	// Repos removed from the config are only known from the state store
+	if s.Cleanup.Enabled && s.State.Type == "" {
+		return fmt.Errorf("Config: cleanup needs a state store, to find the repos removed from the config")
+	}
+
 	for _, cfOrg := range s.Orgs {
 		for _, cfSpace := range cfOrg.Spaces {
+			if s.MaxAgeFor(cfOrg, cfSpace) < 0 {
+				return fmt.Errorf("Config: max_age must not be negative for %s %s", cfOrg.Name, cfSpace.Name)
+			}
+			if _, err := schedule.Parse(s.ScheduleFor(cfOrg, cfSpace)); err != nil {
+				return fmt.Errorf("Config: %v for %s %s", err, cfOrg.Name, cfSpace.Name)
+			}
+			if cfSpace.Strategy != StrategySingle && cfSpace.Strategy != StrategyDual {
+				return fmt.Errorf("Config: strategy must be %s or %s: %s", StrategySingle, StrategyDual, cfSpace.Strategy)
+			}
+			if staticVars := s.StaticVarsFor(cfSpace); staticVars != StaticVarsEnforce && staticVars != StaticVarsAddOnly {
+				return fmt.Errorf("Config: static_vars must be %s or %s: %s", StaticVarsEnforce, StaticVarsAddOnly, staticVars)
+			}
+			// A context runs no builds, so without wait_for a rotation would not wait for any
+			if cfSpace.CircleCIContext != nil && len(cfSpace.CircleCIContext.WaitFor) == 0 && len(cfSpace.Repos) == 1 {
+				return fmt.Errorf("Config: circleci_context wait_for must list the projects using the context, as %s %s has no other repos", cfOrg.Name, cfSpace.Name)
+			}
+
+			for _, repo := range cfSpace.Repos {
+				if repo.Name == "" {
+					return fmt.Errorf("Config: repo name must be set in %s %s", cfOrg.Name, cfSpace.Name)
+				}
+				if !knownSink(repo.Sink) {
+					return fmt.Errorf("Config: unknown sink %s for repo %s, must be one of %v", repo.Sink, repo.Name, sinkTypes)
+				}
+				if len(repo.Environments) > 0 && repo.Sink != SinkGitHub {
+					return fmt.Errorf("Config: environments are only for the %s sink, in repo %s", SinkGitHub, repo.Name)
+				}
+				if len(repo.SecurityGroups) > 0 && repo.Sink != SinkCircleCIContext {
+					return fmt.Errorf("Config: security_groups are only for the %s sink, in repo %s", SinkCircleCIContext, repo.Name)
+				}
+				if repo.Sink == SinkCircleCIContext && strings.Count(repo.Name, "/") < 2 {
+					return fmt.Errorf("Config: circleci context %s must be like 'gh/org/context', the owner's slug then the context's name", repo.Name)
+				}
+				if repo.Endpoint != "" && !repo.isCircleCI() {
+					return fmt.Errorf("Config: endpoint is only for the %s and %s sinks, in repo %s", SinkCircleCI, SinkCircleCIContext, repo.Name)
+				}
+				if repo.isCircleCI() && !endpoints[repo.Endpoint] {
+					return fmt.Errorf("Config: circleci endpoint %s not found, in repo %s", repo.Endpoint, repo.Name)
+				}
+				if repo.Group && repo.Sink != SinkGitLab {
+					return fmt.Errorf("Config: group is only for the %s sink, in repo %s", SinkGitLab, repo.Name)
+				}
+				if repo.Path != "" && repo.Sink != SinkCredHub {
+					return fmt.Errorf("Config: path is only for the %s sink, in repo %s", SinkCredHub, repo.Name)
+				}
+				if repo.Sink == SinkVault {
+					if s.Vault.Address == "" {
+						return fmt.Errorf("Config: vault address must be set for repo %s", repo.Name)
+					}
+					if _, err := VaultPath(repo.Name, ""); err != nil {
+						return fmt.Errorf("Config: bad vault path %s: %v", repo.Name, err)
+					}
+				}
+				if repo.Sink == SinkCredHub {
+					if s.CredHub.URL == "" {
+						return fmt.Errorf("Config: credhub url must be set for repo %s", repo.Name)
+					}
+					if _, err := CredHubPath(repo); err != nil {
+						return fmt.Errorf("Config: bad credhub path for repo %s: %v", repo.Name, err)
+					}
+				}
+				for id := range repo.Environments {
+					if !s.hasCf(id) {
+						return fmt.Errorf("Config: environment ID not found in CFs: %s", id)
+					}
+				}
+			}
+
 			// Check SkipIDs exist in Cfs
 			for _, skipID := range cfSpace.SkipIDs {
 				found := false
@@ -56,6 +742,63 @@ func validate(s *Settings) error {
 	return nil
 }
 
+// CredHubPath the path the repo's credentials are set under
+func CredHubPath(repo Repo) (string, error) {
+	path, err := executePath(repo.Path, struct{ Repo string }{repo.Name})
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("must start with /: %s", path)
+	}
+	return strings.TrimSuffix(path, "/"), nil
+}
+
+// spaceVaultPath fill in the org and space of a vault path template, leaving {{.CfID}} for
+// VaultPath
+func spaceVaultPath(path string, org string, space string) (string, error) {
+	return executePath(path, struct{ Org, Space, CfID string }{org, space, "{{.CfID}}"})
+}
+
+// VaultPath the path of the secret for the cf, for a vault repo's name
+func VaultPath(name string, cfID string) (string, error) {
+	path, err := executePath(name, struct{ CfID string }{cfID})
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(path, "/"), nil
+}
+
+func executePath(path string, data interface{}) (string, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(path)
+	if err != nil {
+		return "", err
+	}
+	var executed bytes.Buffer
+	if err := tmpl.Execute(&executed, data); err != nil {
+		return "", err
+	}
+	return executed.String(), nil
+}
+
+func (s *Settings) hasCf(id string) bool {
+	for _, cf := range s.Cfs {
+		if cf.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func knownSink(sinkType string) bool {
+	for _, t := range sinkTypes {
+		if sinkType == t {
+			return true
+		}
+	}
+	return false
+}
+
 // Load settings from the given io.Reader
 func Load(reader io.Reader, settings *Settings) error {
 	bytes, err := ioutil.ReadAll(reader)
@@ -68,6 +811,7 @@ func Load(reader io.Reader, settings *Settings) error {
 		return err
 	}
 
+	setDefaults(settings)
 	return validate(settings)
 }
 
@@ -57,3 +57,461 @@ func Test_Load_BadCfId_ReturnsError(t *testing.T) {
 		}
 	})
 }
+
+func Test_Load_NoRetries_UsesDefaults(t *testing.T) {
+	testYaml := `
+  cfs:
+    - id: TEST
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if *settings.Retries != config.DefaultRetries {
+		t.Errorf("Load() expected Retries to be %d but was %d", config.DefaultRetries, *settings.Retries)
+	}
+	if settings.RetryDelay != config.DefaultRetryDelay {
+		t.Errorf("Load() expected RetryDelay to be %v but was %v", config.DefaultRetryDelay, settings.RetryDelay)
+	}
+}
+
+func Test_Load_Retries_ReturnsSettings(t *testing.T) {
+	testYaml := `
+  retries: 0
+  retry_delay: 1m
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if *settings.Retries != 0 {
+		t.Errorf("Load() expected Retries to be 0 but was %d", *settings.Retries)
+	}
+	if settings.RetryDelay.Minutes() != 1 {
+		t.Errorf("Load() expected RetryDelay to be 1m but was %v", settings.RetryDelay)
+	}
+}
+
+func Test_Load_BadBuildWaitOnTimeout_ReturnsError(t *testing.T) {
+	testYaml := `
+  build_wait:
+    on_timeout: explode
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err == nil {
+		t.Errorf("Load() expected an error due to bad on_timeout")
+	}
+}
+
+func Test_Load_NoStrategy_DefaultsToSingle(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: test-org
+      spaces:
+      - name: single
+      - name: dual
+        strategy: dual
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	spaces := settings.Orgs[0].Spaces
+	if spaces[0].Strategy != config.StrategySingle {
+		t.Errorf("Load() expected default strategy to be %s but was %s", config.StrategySingle, spaces[0].Strategy)
+	}
+	if spaces[1].Strategy != config.StrategyDual {
+		t.Errorf("Load() expected strategy to be %s but was %s", config.StrategyDual, spaces[1].Strategy)
+	}
+}
+
+func Test_MaxAgeFor_Overrides(t *testing.T) {
+	testYaml := `
+  max_age: 168h
+  orgs:
+    - name: default
+      spaces:
+      - name: default
+    - name: org
+      max_age: 24h
+      spaces:
+      - name: org
+      - name: space
+        max_age: 1h
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	for _, test := range []struct {
+		org, space int
+		want       string
+	}{
+		{0, 0, "168h0m0s"},
+		{1, 0, "24h0m0s"},
+		{1, 1, "1h0m0s"},
+	} {
+		cfOrg := settings.Orgs[test.org]
+		cfSpace := cfOrg.Spaces[test.space]
+		if got := settings.MaxAgeFor(cfOrg, cfSpace).String(); got != test.want {
+			t.Errorf("MaxAgeFor(%s, %s) expected %s but was %s", cfOrg.Name, cfSpace.Name, test.want, got)
+		}
+	}
+}
+
+func Test_RevokeTokensFor_Overrides(t *testing.T) {
+	testYaml := `
+  revoke_tokens:
+    enabled: true
+  orgs:
+    - name: org
+      spaces:
+      - name: default
+      - name: off
+        revoke_tokens:
+          enabled: false
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	for i, want := range []bool{true, false} {
+		cfSpace := settings.Orgs[0].Spaces[i]
+		if enabled := settings.RevokeTokensFor(cfSpace); enabled != want {
+			t.Errorf("RevokeTokensFor(%s) expected %v but was %v", cfSpace.Name, want, enabled)
+		}
+	}
+	if (&config.Settings{}).RevokeTokensFor(config.CfSpace{}) {
+		t.Error("RevokeTokensFor() expected tokens not to be revoked unless enabled")
+	}
+}
+
+func Test_Load_NoSchedule_DefaultsToDaily(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: org
+      spaces:
+      - name: default
+      - name: hourly
+        schedule: "@every 1h"
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	cfOrg := settings.Orgs[0]
+	if got := settings.ScheduleFor(cfOrg, cfOrg.Spaces[0]); got != config.DefaultSchedule {
+		t.Errorf("ScheduleFor() expected %s but was %s", config.DefaultSchedule, got)
+	}
+	if got := settings.ScheduleFor(cfOrg, cfOrg.Spaces[1]); got != "@every 1h" {
+		t.Errorf("ScheduleFor() expected @every 1h but was %s", got)
+	}
+}
+
+func Test_Load_BadSchedule_ReturnsError(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: org
+      schedule: "0 25 * * *"
+      spaces:
+      - name: space
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to a bad schedule")
+	}
+}
+
+func Test_Load_Repos_NameOrMap(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: org
+      spaces:
+      - name: space
+        repos:
+          - govau/plain
+          - name: govau/explicit
+            sink: circleci
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	want := []config.Repo{
+		{Name: "govau/plain", Sink: config.SinkCircleCI},
+		{Name: "govau/explicit", Sink: config.SinkCircleCI},
+	}
+	repos := settings.Orgs[0].Spaces[0].Repos
+	if len(repos) != len(want) {
+		t.Fatalf("Load() expected %d repos but was %d", len(want), len(repos))
+	}
+	for i := range want {
+		if repos[i].Name != want[i].Name || repos[i].Sink != want[i].Sink {
+			t.Errorf("Load() expected repo %+v but was %+v", want[i], repos[i])
+		}
+	}
+}
+
+func Test_Load_UnknownSink_ReturnsError(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: org
+      spaces:
+      - name: space
+        repos:
+          - name: govau/repo
+            sink: jenkins
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to an unknown sink")
+	}
+}
+
+func Test_Load_EnvironmentForUnknownCf_ReturnsError(t *testing.T) {
+	testYaml := `
+  cfs:
+    - id: STAGING
+  orgs:
+    - name: org
+      spaces:
+      - name: space
+        repos:
+          - name: govau/repo
+            sink: github
+            environments:
+              PROD: production
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to an environment for an unknown cf")
+	}
+}
+
+func Test_Load_GroupWithoutGitLab_ReturnsError(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: org
+      spaces:
+      - name: space
+        repos:
+          - name: govau
+            group: true
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to a group for the circleci sink")
+	}
+}
+
+func Test_Load_CredHubPath_SpaceOverride(t *testing.T) {
+	testYaml := `
+  credhub:
+    url: https://credhub.example.gov.au:8844
+  orgs:
+    - name: org
+      spaces:
+      - name: default
+        repos:
+          - name: dta/deploy
+            sink: credhub
+      - name: override
+        credhub_path: /concourse/dta/{{.Repo}}
+        repos:
+          - name: deploy
+            sink: credhub
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	for i, want := range []string{"/concourse/dta/deploy", "/concourse/dta/deploy"} {
+		got, err := config.CredHubPath(settings.Orgs[0].Spaces[i].Repos[0])
+		if err != nil || got != want {
+			t.Errorf("CredHubPath() expected %s but was %s, %v", want, got, err)
+		}
+	}
+}
+
+func Test_Load_BadCredHubPath_ReturnsError(t *testing.T) {
+	testYaml := `
+  credhub:
+    url: https://credhub.example.gov.au:8844
+  orgs:
+    - name: org
+      spaces:
+      - name: space
+        credhub_path: /concourse/{{.Pipeline}}
+        repos:
+          - name: dta/deploy
+            sink: credhub
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to an unknown field in the credhub path")
+	}
+}
+
+func Test_Load_VaultPath_FilledInForSpace(t *testing.T) {
+	testYaml := `
+  vault:
+    address: https://vault.example.gov.au:8200
+  orgs:
+    - name: dta
+      spaces:
+      - name: prod
+        repos:
+          - sink: vault
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	got, err := config.VaultPath(settings.Orgs[0].Spaces[0].Repos[0].Name, "STAGING")
+	if want := "torque/dta/prod/STAGING"; err != nil || got != want {
+		t.Errorf("VaultPath() expected %s but was %s, %v", want, got, err)
+	}
+}
+
+func Test_Load_VaultKubernetesWithoutRole_ReturnsError(t *testing.T) {
+	testYaml := `
+  vault:
+    address: https://vault.example.gov.au:8200
+    auth:
+      method: kubernetes
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to kubernetes auth without a role")
+	}
+}
+
+func Test_Load_CleanupWithoutState_ReturnsError(t *testing.T) {
+	testYaml := `
+  cleanup:
+    enabled: true
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to cleanup without a state store")
+	}
+	testYaml += `
+  state:
+    type: file
+    path: /var/lib/torque/state.json
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err != nil {
+		t.Errorf("Load() error: %v", err)
+	}
+}
+
+func Test_Load_CircleCIContext_AddsRepo(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: dta
+      spaces:
+      - name: prod
+        circleci_context:
+          owner: gh/govau
+          security_groups: [group-1]
+          wait_for: [govau/myrepo1]
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	repos := settings.Orgs[0].Spaces[0].Repos
+	if len(repos) != 1 || repos[0].Name != "gh/govau/cf-dta-prod" || repos[0].Sink != config.SinkCircleCIContext {
+		t.Fatalf("Load() expected the context gh/govau/cf-dta-prod, got %+v", repos)
+	}
+	if len(repos[0].SecurityGroups) != 1 || repos[0].SecurityGroups[0] != "group-1" {
+		t.Errorf("Load() expected the context to be restricted to group-1, got %v", repos[0].SecurityGroups)
+	}
+	waitFor := settings.Orgs[0].Spaces[0].WaitForRepos()
+	if len(waitFor) != 1 || waitFor[0].String() != "govau/myrepo1" || waitFor[0].Endpoint != config.DefaultCircleCIEndpoint {
+		t.Errorf("WaitForRepos() expected the circleci project govau/myrepo1, got %+v", waitFor)
+	}
+}
+
+func Test_Load_CircleCIContext_OnlyRepoWithoutWaitFor_ReturnsError(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: dta
+      spaces:
+      - name: prod
+        circleci_context:
+          owner: gh/govau
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error for a context with no projects to wait for")
+	}
+
+	withRepos := testYaml + `
+        repos: [govau/myrepo1]
+  `
+	if err := config.Load(strings.NewReader(withRepos), &config.Settings{}); err != nil {
+		t.Errorf("Load() error for a context with repos to wait for: %v", err)
+	}
+}
+
+func Test_Load_CircleCIEndpoints(t *testing.T) {
+	testYaml := `
+  circleci:
+    endpoints:
+      - name: server
+        url: https://circleci.example.gov.au/
+        token_env: CIRCLE_SERVER_TOKEN
+        ca_cert: /etc/ssl/private-ca.pem
+  orgs:
+    - name: dta
+      spaces:
+      - name: prod
+        repos:
+          - govau/cloud
+          - name: govau/server
+            endpoint: server
+  `
+	var settings config.Settings
+	if err := config.Load(strings.NewReader(testYaml), &settings); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	server, ok := settings.CircleCIEndpoint("server")
+	if !ok || server.URL != "https://circleci.example.gov.au" || server.TokenEnv != "CIRCLE_SERVER_TOKEN" {
+		t.Errorf("Load() expected the server endpoint, got %+v", server)
+	}
+	if cloud, ok := settings.CircleCIEndpoint(config.DefaultCircleCIEndpoint); !ok || cloud.URL != config.DefaultCircleCIURL {
+		t.Errorf("Load() expected circleci.com to still be an endpoint, got %+v", cloud)
+	}
+
+	repos := settings.Orgs[0].Spaces[0].Repos
+	if repos[0].String() != "govau/cloud" || repos[0].SinkName() != config.SinkCircleCI {
+		t.Errorf("Load() expected the circleci.com repo to keep its plain name, got %s, %s", repos[0], repos[0].SinkName())
+	}
+	if repos[1].String() != "circleci@server:govau/server" || repos[1].SinkName() != "circleci@server" {
+		t.Errorf("Load() expected the server repo to name its endpoint, got %s, %s", repos[1], repos[1].SinkName())
+	}
+}
+
+func Test_Load_UnknownCircleCIEndpoint_ReturnsError(t *testing.T) {
+	testYaml := `
+  orgs:
+    - name: dta
+      spaces:
+      - name: prod
+        repos:
+          - name: govau/server
+            endpoint: server
+  `
+	if err := config.Load(strings.NewReader(testYaml), &config.Settings{}); err == nil {
+		t.Error("Load() expected an error due to an endpoint that is not configured")
+	}
+}
+
+func Test_ParseRepo_ReversesString(t *testing.T) {
+	settings := config.Settings{CredHub: config.CredHub{Path: config.DefaultCredHubPath}}
+	for _, repo := range []config.Repo{
+		{Name: "govau/a", Sink: config.SinkCircleCI, Endpoint: config.DefaultCircleCIEndpoint},
+		{Name: "govau/a", Sink: config.SinkCircleCI, Endpoint: "server"},
+		{Name: "gh/govau/cf-dta-prod", Sink: config.SinkCircleCIContext, Endpoint: config.DefaultCircleCIEndpoint},
+		{Name: "govau/a", Sink: config.SinkGitHub},
+		{Name: "main/app", Sink: config.SinkCredHub, Path: config.DefaultCredHubPath},
+	} {
+		got := settings.ParseRepo(repo.String())
+		if got.Name != repo.Name || got.Sink != repo.Sink || got.Endpoint != repo.Endpoint || got.Path != repo.Path {
+			t.Errorf("ParseRepo(%q) expected %+v, got %+v", repo.String(), repo, got)
+		}
+	}
+}
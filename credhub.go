@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/govau/torque/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// CredHub a SecretSink delivering to CredHub, whose targets are the names of credhub repos, e.g.
+// team/pipeline for Concourse. Each secret is set under the repo's path, named in lower case, so
+// CF_PASSWORD_STAGING becomes /concourse/team/pipeline/cf_password_staging and a pipeline uses it
+// as ((cf_password_staging)).
+type CredHub struct {
+	api *apiClient
+	// paths the path each repo's credentials are set under
+	paths map[string]string
+}
+
+type credhubCredential struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// NewCredHub Create new CredHub instance, authenticating with UAA client credentials against the
+// UAA CredHub trusts. The credentials are tested and any error is returned.
+func NewCredHub(credhubURL string, caCertFile string, clientID string, clientSecret string) (*CredHub, error) {
+	base, err := newTransport(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("Bad credhub ca_cert: %v", err)
+	}
+	c := &CredHub{
+		api:   newAPIClient("credhub", credhubURL, base, nil),
+		paths: map[string]string{},
+	}
+
+	info := struct {
+		AuthServer struct {
+			URL string `json:"url"`
+		} `json:"auth-server"`
+	}{}
+	if err := c.api.do(http.MethodGet, "/info", nil, &info); err != nil {
+		return nil, fmt.Errorf("Problem getting credhub info: %v", err)
+	}
+
+	tokenSource := (&clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     strings.TrimSuffix(info.AuthServer.URL, "/") + "/oauth/token",
+	}).TokenSource(context.WithValue(context.Background(), oauth2.HTTPClient, newSinkClient("uaa", base)))
+	if _, err := tokenSource.Token(); err != nil {
+		return nil, fmt.Errorf("Bad credhub client credentials: %v", err)
+	}
+	if *verbose {
+		log.Printf("Authenticated to credhub as %s", clientID)
+	}
+	c.api.client = &http.Client{Transport: &oauth2.Transport{Source: tokenSource, Base: c.api.client.Transport}, Timeout: sinkTimeout}
+	return c, nil
+}
+
+// ConfigureRepo note the path the repo's credentials are set under
+func (c *CredHub) ConfigureRepo(repo config.Repo) error {
+	credentialPath, err := config.CredHubPath(repo)
+	if err != nil {
+		return err
+	}
+	c.paths[repo.Name] = credentialPath
+	return nil
+}
+
+// credentialPath the path the target's credentials are set under
+func (c *CredHub) credentialPath(target string) (string, error) {
+	credentialPath, ok := c.paths[target]
+	if !ok {
+		return "", fmt.Errorf("credhub repo %s is not configured", target)
+	}
+	return credentialPath, nil
+}
+
+// credentialName the full name in CredHub of the target's secret
+func (c *CredHub) credentialName(target string, name string) (string, error) {
+	credentialPath, err := c.credentialPath(target)
+	if err != nil {
+		return "", err
+	}
+	return credentialPath + "/" + strings.ToLower(name), nil
+}
+
+// EnsureTarget CredHub paths need nothing creating
+func (c *CredHub) EnsureTarget(target string) error {
+	_, err := c.credentialPath(target)
+	return err
+}
+
+// TargetReady CredHub paths are always ready
+func (c *CredHub) TargetReady(target string) (bool, error) {
+	_, err := c.credentialPath(target)
+	return err == nil, err
+}
+
+// SecretNames the names of the credentials directly under the target's path, in upper case as
+// torque names them
+func (c *CredHub) SecretNames(target string) (map[string]bool, error) {
+	credentialPath, err := c.credentialPath(target)
+	if err != nil {
+		return nil, err
+	}
+
+	found := struct {
+		Credentials []struct {
+			Name string `json:"name"`
+		} `json:"credentials"`
+	}{}
+	if err := c.api.do(http.MethodGet, "/api/v1/data?path="+url.QueryEscape(credentialPath), nil, &found); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, credential := range found.Credentials {
+		if path.Dir(credential.Name) == credentialPath {
+			names[strings.ToUpper(path.Base(credential.Name))] = true
+		}
+	}
+	return names, nil
+}
+
+// SetSecret set a new version of a password credential
+func (c *CredHub) SetSecret(target string, name string, value string) error {
+	return c.set(target, name, "password", value)
+}
+
+// SetStaticVars set each var that is not already set, as a value credential
+func (c *CredHub) SetStaticVars(target string, vars map[string]string) error {
+	names, err := c.SecretNames(target)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(vars) {
+		if names[name] {
+			continue
+		}
+		if err := c.set(target, name, "value", vars[name]); err != nil {
+			return fmt.Errorf("Problem adding credential to %s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// set a new version of the credential. CredHub cannot change the type of a credential, e.g. when
+// CF_USERNAME goes from a static var to a secret as its space switches to the dual strategy, so
+// one of another type is deleted first.
+func (c *CredHub) set(target string, name string, credentialType string, value string) error {
+	credentialName, err := c.credentialName(target, name)
+	if err != nil {
+		return err
+	}
+	current, err := c.currentType(credentialName)
+	if err != nil {
+		return err
+	}
+	if current != "" && current != credentialType {
+		if *verbose {
+			log.Printf("Replacing %s credential %s with a %s credential", current, credentialName, credentialType)
+		}
+		if err := c.api.do(http.MethodDelete, "/api/v1/data?name="+url.QueryEscape(credentialName), nil, nil); err != nil {
+			return fmt.Errorf("Problem deleting %s credential %s to change its type: %v", current, credentialName, err)
+		}
+	}
+	return c.api.do(http.MethodPut, "/api/v1/data", credhubCredential{Name: credentialName, Type: credentialType, Value: value}, nil)
+}
+
+// currentType the type of the credential's current version, empty if it does not exist
+func (c *CredHub) currentType(credentialName string) (string, error) {
+	found := struct {
+		Data []struct {
+			Type string `json:"type"`
+		} `json:"data"`
+	}{}
+	err := c.api.do(http.MethodGet, "/api/v1/data?current=true&name="+url.QueryEscape(credentialName), nil, &found)
+	if isStatus(err, http.StatusNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(found.Data) == 0 {
+		return "", nil
+	}
+	return found.Data[0].Type, nil
+}
+
+// Delete every version of the credential
+func (c *CredHub) Delete(target string, name string) error {
+	credentialName, err := c.credentialName(target, name)
+	if err != nil {
+		return err
+	}
+	return c.api.do(http.MethodDelete, "/api/v1/data?name="+url.QueryEscape(credentialName), nil, nil)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+// fakeCredHub a CredHub, and the UAA it trusts, holding the current version of each credential
+type fakeCredHub struct {
+	server *httptest.Server
+
+	mu          sync.Mutex
+	credentials map[string]credhubCredential
+}
+
+func newFakeCredHub() *fakeCredHub {
+	f := &fakeCredHub{credentials: map[string]credhubCredential{}}
+	f.server = httptest.NewTLSServer(f)
+	return f
+}
+
+func (f *fakeCredHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/info":
+		json.NewEncoder(w).Encode(map[string]map[string]string{"auth-server": {"url": f.server.URL + "/uaa"}})
+		return
+	case "/uaa/oauth/token":
+		if id, secret, _ := r.BasicAuth(); id != "torque" || secret != "test-secret" {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "test-token", "token_type": "bearer", "expires_in": 3600})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/api/v1/data" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("name") != "":
+		credential, ok := f.credentials[r.URL.Query().Get("name")]
+		if !ok {
+			http.Error(w, `{"error":"The request could not be completed because the credential does not exist or you do not have sufficient authorization."}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": []credhubCredential{credential}})
+	case r.Method == http.MethodGet:
+		found := []map[string]string{}
+		for name := range f.credentials {
+			if strings.HasPrefix(name, r.URL.Query().Get("path")+"/") {
+				found = append(found, map[string]string{"name": name})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"credentials": found})
+	case r.Method == http.MethodPut:
+		credential := credhubCredential{}
+		json.NewDecoder(r.Body).Decode(&credential)
+		if existing, ok := f.credentials[credential.Name]; ok && existing.Type != credential.Type {
+			http.Error(w, `{"error":"The credential type cannot be modified. Please delete the credential if you wish to create it with a different type."}`, http.StatusBadRequest)
+			return
+		}
+		f.credentials[credential.Name] = credential
+		json.NewEncoder(w).Encode(credential)
+	case r.Method == http.MethodDelete:
+		delete(f.credentials, r.URL.Query().Get("name"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeCACert write the fake's certificate to a file in dir, as ca_cert
+func (f *fakeCredHub) writeCACert(t *testing.T, dir string) string {
+	file := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.server.Certificate().Raw})
+	if err := ioutil.WriteFile(file, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func Test_CredHub_SetsCredentialsUnderThePath(t *testing.T) {
+	fake := newFakeCredHub()
+	defer fake.server.Close()
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCredHub(fake.server.URL, fake.writeCACert(t, dir), "torque", "test-secret")
+	if err != nil {
+		t.Fatalf("NewCredHub() error: %v", err)
+	}
+	if err := c.ConfigureRepo(config.Repo{Name: "dta/deploy", Sink: config.SinkCredHub, Path: config.DefaultCredHubPath}); err != nil {
+		t.Fatalf("ConfigureRepo() error: %v", err)
+	}
+	// Another pipeline's credential, which is not the repo's
+	fake.credentials["/concourse/dta/deploy-other/cf_org"] = credhubCredential{Name: "/concourse/dta/deploy-other/cf_org"}
+
+	if err := c.SetStaticVars("dta/deploy", map[string]string{"CF_ORG": "org"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := c.SetSecret("dta/deploy", "CF_PASSWORD_STAGING", "new-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	if got := fake.credentials["/concourse/dta/deploy/cf_password_staging"]; got.Value != "new-password" || got.Type != "password" {
+		t.Errorf("SetSecret() expected a password credential, got %+v", got)
+	}
+	if got := fake.credentials["/concourse/dta/deploy/cf_org"]; got.Value != "org" || got.Type != "value" {
+		t.Errorf("SetStaticVars() expected a value credential, got %+v", got)
+	}
+
+	names, err := c.SecretNames("dta/deploy")
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	if len(names) != 2 || !names["CF_ORG"] || !names["CF_PASSWORD_STAGING"] {
+		t.Errorf("SecretNames() expected CF_ORG and CF_PASSWORD_STAGING, got %v", names)
+	}
+
+	if err := c.Delete("dta/deploy", "CF_PASSWORD_STAGING"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, ok := fake.credentials["/concourse/dta/deploy/cf_password_staging"]; ok {
+		t.Error("Delete() expected cf_password_staging to be gone")
+	}
+}
+
+func Test_CredHub_BadClientSecret_ReturnsError(t *testing.T) {
+	fake := newFakeCredHub()
+	defer fake.server.Close()
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewCredHub(fake.server.URL, fake.writeCACert(t, dir), "torque", "wrong-secret"); err == nil {
+		t.Error("NewCredHub() expected an error for a bad client secret")
+	}
+}
+
+func Test_CredHub_SetSecret_ReplacesCredentialOfAnotherType(t *testing.T) {
+	fake := newFakeCredHub()
+	defer fake.server.Close()
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCredHub(fake.server.URL, fake.writeCACert(t, dir), "torque", "test-secret")
+	if err != nil {
+		t.Fatalf("NewCredHub() error: %v", err)
+	}
+	if err := c.ConfigureRepo(config.Repo{Name: "dta/deploy", Sink: config.SinkCredHub, Path: config.DefaultCredHubPath}); err != nil {
+		t.Fatalf("ConfigureRepo() error: %v", err)
+	}
+
+	// A single strategy space sets CF_USERNAME as a static var, and the dual strategy as a secret
+	if err := c.SetStaticVars("dta/deploy", map[string]string{"CF_USERNAME": "ci-org-space"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := c.SetSecret("dta/deploy", "CF_USERNAME", "ci-org-space-a"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	if got := fake.credentials["/concourse/dta/deploy/cf_username"]; got.Value != "ci-org-space-a" || got.Type != "password" {
+		t.Errorf("SetSecret() expected cf_username to be replaced with a password credential, got %+v", got)
+	}
+}
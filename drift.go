@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/govau/torque/config"
+)
+
+// maskedVisibleChars how many of a value's last characters CircleCI leaves visible when masking it
+const maskedVisibleChars = 4
+
+// maskedMatches whether a value the sink masked could be the given value. Only the last few
+// characters can be compared, so a changed value with the same ending is not noticed.
+func maskedMatches(masked string, value string) bool {
+	visible := value
+	if len(visible) > maskedVisibleChars {
+		visible = visible[len(visible)-maskedVisibleChars:]
+	}
+	return strings.HasSuffix(masked, visible)
+}
+
+// driftedStaticVars the repo's static env vars whose values no longer match the config, with the
+// masked value of each. Sinks that hide values completely never report drift.
+func driftedStaticVars(sinks *repoSinks, repo string, desiredEnvVars map[string]string) (map[string]string, error) {
+	drifted := map[string]string{}
+	values, ok, err := sinks.MaskedValues(repo)
+	if err != nil || !ok {
+		return drifted, err
+	}
+	for name, value := range desiredEnvVars {
+		masked, ok := values[name]
+		if ok && !maskedMatches(masked, value) {
+			drifted[name] = masked
+		}
+	}
+	return drifted, nil
+}
+
+// correctDriftedStaticVars rewrite the repo's static env vars that have drifted from the config,
+// e.g. after the repo moved space or a cf's api_href changed. Under the add-only policy they are
+// only warned about.
+func correctDriftedStaticVars(sinks *repoSinks, cfSpace config.CfSpace, repo string, desiredEnvVars map[string]string) error {
+	drifted, err := driftedStaticVars(sinks, repo, desiredEnvVars)
+	if err != nil {
+		return err
+	}
+	enforce := settings.StaticVarsFor(cfSpace) == config.StaticVarsEnforce
+	for _, name := range sortedKeys(drifted) {
+		if !enforce {
+			log.Printf("WARNING: %s in %s is %s, which does not match the config, leaving it as static_vars is %s", name, repo, drifted[name], config.StaticVarsAddOnly)
+			continue
+		}
+		log.Printf("Correcting %s in %s, which was %s and does not match the config", name, repo, drifted[name])
+		if err := sinks.SetSecret(repo, name, desiredEnvVars[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
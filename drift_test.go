@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+func Test_MaskedMatches(t *testing.T) {
+	for _, test := range []struct {
+		masked  string
+		value   string
+		matches bool
+	}{
+		{"xxxx.com", "https://api.example.com", true},
+		{"xxxx.com", "https://api.example.gov.au", false},
+		{"xxxxprod", "prod", true},
+		{"xxxxprod", "staging", false},
+		{"xxxxdta", "dta", true},
+	} {
+		if got := maskedMatches(test.masked, test.value); got != test.matches {
+			t.Errorf("maskedMatches(%q, %q) expected %v, got %v", test.masked, test.value, test.matches, got)
+		}
+	}
+}
+
+func Test_DriftedStaticVars(t *testing.T) {
+	fake, server := newFakeCircle()
+	defer server.Close()
+	fake.envVars["gh/govau/torque"] = map[string]string{"CF_ORG": "dta", "CF_SPACE": "staging"}
+
+	circle, err := NewCircle(server.URL, "test-token", "")
+	if err != nil {
+		t.Fatalf("NewCircle() error: %v", err)
+	}
+	sinks := &repoSinks{
+		repos: map[string]config.Repo{"govau/torque": {Name: "govau/torque", Sink: config.SinkCircleCI}},
+		sinks: map[string]SecretSink{config.SinkCircleCI: circle},
+	}
+
+	desired := map[string]string{"CF_ORG": "dta", "CF_SPACE": "prod", "CF_API_TEST": "https://api.example.com"}
+	drifted, err := driftedStaticVars(sinks, "govau/torque", desired)
+	if err != nil {
+		t.Fatalf("driftedStaticVars() error: %v", err)
+	}
+	if len(drifted) != 1 || drifted["CF_SPACE"] != "xxxxging" {
+		t.Errorf("driftedStaticVars() expected only CF_SPACE to have drifted, got %v", drifted)
+	}
+}
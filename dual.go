@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// dualSides the suffixes of the two ci users of a space using the dual strategy
+var dualSides = []string{"a", "b"}
+
+func dualUserName(org string, space string, side string) string {
+	return fmt.Sprintf("%s-%s", cfUserName(org, space), side)
+}
+
+// dualPasswordEnvVar the env var holding the password of one side's ci user in the cf, e.g.
+// CF_PASSWORD_A_STAGING. It ends in the cf's ID like CF_PASSWORD_STAGING does for the single
+// strategy, so sinks that keep each cf's env vars apart still can.
+func dualPasswordEnvVar(side string, id string) string {
+	return fmt.Sprintf("CF_PASSWORD_%s_%s", strings.ToUpper(side), id)
+}
+
+// otherSide the side of a dual strategy space that is not this one
+func otherSide(side string) string {
+	if side == dualSides[0] {
+		return dualSides[1]
+	}
+	return dualSides[0]
+}
+
+// inactiveSide the side of a dual strategy space to rotate next, which is the one whose password
+// was changed least recently, and when the active side was last changed. UAA is the record of which
+// side is active, so there is no other state to keep. Only the first cf is looked at, and every cf
+// is rotated to the same side so that the one CF_USERNAME is right for all of them.
+func inactiveSide(cfOrg string, cfSpace string, ids []string) (string, time.Time, error) {
+	if len(ids) == 0 {
+		return dualSides[0], time.Time{}, nil
+	}
+	cfInfo := cfInfos[ids[0]]
+
+	modified := []time.Time{}
+	for _, side := range dualSides {
+		user, err := cfInfo.FindCIUser(dualUserName(cfOrg, cfSpace, side))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		lastModified, err := passwordLastModified(user)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		modified = append(modified, lastModified)
+	}
+
+	if modified[1].Before(modified[0]) {
+		return dualSides[1], modified[0], nil
+	}
+	return dualSides[0], modified[1], nil
+}
+
+// rotatedCfIDs the IDs of the cfs this space deploys to
+func rotatedCfIDs(cfSpace config.CfSpace) []string {
+	ids := []string{}
+	for _, id := range sortedCfIDs() {
+		if !skipped(id, cfSpace.SkipIDs) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// rotateDualSpace rotate the inactive side of a dual strategy space in every cf as one rotation,
+// and then switch CF_USERNAME to it. Each side's passwords have their own env vars, so the new ones
+// are all in place before CF_USERNAME points at them, and builds that already read the old username
+// keep working, as the previously active user is left alone until the next rotation.
+func rotateDualSpace(sinks *repoSinks, cfOrg config.CfOrg, cfSpace config.CfSpace, repos []string, report *Report) []stalledRotation {
+	ids := rotatedCfIDs(cfSpace)
+	space := fmt.Sprintf("%s %s", cfOrg.Name, cfSpace.Name)
+
+	side, activeModified, err := inactiveSide(cfOrg.Name, cfSpace.Name, ids)
+	if err != nil {
+		report.Fail(space, "Problem finding the inactive ci user: %v", err)
+		return nil
+	}
+	target := rotationTarget{
+		cfIDs:    ids,
+		org:      cfOrg.Name,
+		space:    cfSpace.Name,
+		username: dualUserName(cfOrg.Name, cfSpace.Name, side),
+	}
+	active := target
+	active.username = dualUserName(cfOrg.Name, cfSpace.Name, otherSide(side))
+
+	observePasswordChanged(active, activeModified)
+	// The space is due when the password in use, the active side's, gets too old
+	if !rotationDue(active, activeModified, settings.MaxAgeFor(cfOrg, cfSpace), report) {
+		return nil
+	}
+	if !waitForSpace(sinks, cfOrg, cfSpace, repos, report) {
+		return nil
+	}
+
+	r := newRotation(sinks, repos)
+	r.envVars = map[string]string{"CF_USERNAME": target.username}
+	revocations := []revocation{}
+	for _, id := range ids {
+		cfInfo := cfInfos[id]
+		user, err := cfInfo.ciUser(target.username, cfOrg.Name, cfSpace.Name)
+		if err != nil {
+			return recordRotation(target, nil, err, report)
+		}
+		if settings.RevokeTokensFor(cfSpace) {
+			revocations = append(revocations, cfInfo.tokenRevocation(user))
+		}
+		r.addCredential(cfInfo.UaaAPI, user.ID, dualPasswordEnvVar(side, id))
+	}
+
+	if err = r.prepare(); err == nil {
+		err = r.commit()
+	}
+	if err != nil {
+		return recordRotation(target, r, err, report)
+	}
+	// Nothing has used the inactive user since it was last active, a rotation ago, so any tokens
+	// it still has can go before CF_USERNAME points at it
+	revokeTokens(revocations, report)
+	return recordRotation(target, r, r.publish(), report)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+func Test_InactiveSide(t *testing.T) {
+	defer useSettings(t, "")()
+	now := time.Now().Truncate(time.Second)
+
+	for _, test := range []struct {
+		name           string
+		a, b           time.Time
+		createA        bool
+		createB        bool
+		wantSide       string
+		wantActiveTime time.Time
+	}{
+		{name: "neither exists", wantSide: "a"},
+		{name: "only b exists", b: now, createB: true, wantSide: "a", wantActiveTime: now},
+		{name: "a is older", a: now.Add(-2 * time.Hour), b: now.Add(-time.Hour), createA: true, createB: true, wantSide: "a", wantActiveTime: now.Add(-time.Hour)},
+		{name: "b is older", a: now.Add(-time.Hour), b: now.Add(-2 * time.Hour), createA: true, createB: true, wantSide: "b", wantActiveTime: now.Add(-time.Hour)},
+		{name: "a was never changed", b: now, createA: true, createB: true, wantSide: "a", wantActiveTime: now},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeCf()
+			defer fake.server.Close()
+			if test.createA {
+				fake.addUser("ci-org-space-a", test.a)
+			}
+			if test.createB {
+				fake.addUser("ci-org-space-b", test.b)
+			}
+			cfInfos["A"] = fake.connect(t, "A")
+
+			side, activeModified, err := inactiveSide("org", "space", []string{"A"})
+			if err != nil {
+				t.Fatalf("inactiveSide() error: %v", err)
+			}
+			if side != test.wantSide || !activeModified.Equal(test.wantActiveTime) {
+				t.Errorf("inactiveSide() expected %s and %v, got %s and %v", test.wantSide, test.wantActiveTime, side, activeModified)
+			}
+		})
+	}
+}
+
+func Test_RotateDualSpace_PublishesPasswordsBeforeSwitchingUsername(t *testing.T) {
+	defer useSettings(t, `
+  retries: 0
+  cfs:
+  - id: A
+    api_href: https://api.a.example.com
+  - id: B
+    api_href: https://api.b.example.com
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      strategy: dual
+      repos: [govau/a]
+  `)()
+	now := time.Now()
+	a, b := newFakeCf(), newFakeCf()
+	defer a.server.Close()
+	defer b.server.Close()
+	for _, fake := range []*fakeCf{a, b} {
+		fake.addUser("ci-org-space-a", now.Add(-2*time.Hour))
+		fake.addUser("ci-org-space-b", now.Add(-time.Hour))
+	}
+	cfInfos["A"], cfInfos["B"] = a.connect(t, "A"), b.connect(t, "B")
+
+	sink := newFakeSink("govau/a")
+	sink.envVars["govau/a"]["CF_USERNAME"] = "ci-org-space-b"
+	sink.envVars["govau/a"]["CF_PASSWORD_B_A"] = "b-password"
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkCircleCI: sink}}
+	sinks.repos["govau/a"] = settings.Orgs[0].Spaces[0].Repos[0]
+
+	report := &Report{}
+	if stalled := rotateDualSpace(sinks, settings.Orgs[0], settings.Orgs[0].Spaces[0], []string{"govau/a"}, report); stalled != nil || report.Failed() {
+		t.Fatalf("rotateDualSpace() failed: %v %v", stalled, report.Failures)
+	}
+
+	if want := []string{"A,B ci-org-space-a"}; !reflect.DeepEqual(report.Rotated, want) {
+		t.Errorf("rotateDualSpace() expected %v to be rotated, got %v", want, report.Rotated)
+	}
+	envVars := sink.envVars["govau/a"]
+	for id, fake := range map[string]*fakeCf{"A": a, "B": b} {
+		if got := envVars["CF_PASSWORD_A_"+id]; got == "" || got != fake.passwords["id-ci-org-space-a"] {
+			t.Errorf("rotateDualSpace() expected CF_PASSWORD_A_%s to be the new password, got %q", id, got)
+		}
+		if _, ok := fake.passwords["id-ci-org-space-b"]; ok {
+			t.Errorf("rotateDualSpace() expected the active user in %s to be left alone", id)
+		}
+	}
+	if got := envVars["CF_PASSWORD_B_A"]; got != "b-password" {
+		t.Errorf("rotateDualSpace() expected CF_PASSWORD_B_A to be left alone, got %q", got)
+	}
+	if want := []string{"CF_PASSWORD_A_A", "CF_PASSWORD_A_B", "CF_USERNAME"}; !reflect.DeepEqual(sink.written["govau/a"], want) {
+		t.Errorf("rotateDualSpace() expected %v to be written in order, got %v", want, sink.written["govau/a"])
+	}
+	if got := envVars["CF_USERNAME"]; got != "ci-org-space-a" {
+		t.Errorf("rotateDualSpace() expected CF_USERNAME to be ci-org-space-a, got %q", got)
+	}
+}
+
+func Test_RotateDualSpace_NotDue_ReportsTheActiveUser(t *testing.T) {
+	defer useSettings(t, `
+  max_age: 24h
+  cfs:
+  - id: A
+    api_href: https://api.a.example.com
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      strategy: dual
+      repos: [govau/a]
+  `)()
+	fake := newFakeCf()
+	defer fake.server.Close()
+	fake.addUser("ci-org-space-a", time.Now().Add(-2*time.Hour))
+	fake.addUser("ci-org-space-b", time.Now().Add(-time.Hour))
+	cfInfos["A"] = fake.connect(t, "A")
+
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkCircleCI: newFakeSink("govau/a")}}
+	report := &Report{}
+	rotateDualSpace(sinks, settings.Orgs[0], settings.Orgs[0].Spaces[0], []string{"govau/a"}, report)
+
+	if len(report.Fresh) != 1 || !strings.HasPrefix(report.Fresh[0], "A ci-org-space-b:") {
+		t.Errorf("rotateDualSpace() expected the active user ci-org-space-b to be reported fresh, got %v", report.Fresh)
+	}
+}
+
+func Test_WantedEnvVars_Dual_KeepsBothSidesPasswords(t *testing.T) {
+	defer useSettings(t, `
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      strategy: dual
+      repos: [govau/a]
+  `)()
+	cfInfos["STAGING"] = &CfInfo{ID: "STAGING", APIHref: "https://api.staging.example.com"}
+
+	wanted := wantedEnvVars(spaceKey{})["govau/a"]
+	for _, name := range []string{"CF_USERNAME", "CF_PASSWORD_A_STAGING", "CF_PASSWORD_B_STAGING"} {
+		if !wanted[name] {
+			t.Errorf("wantedEnvVars() expected %s to be wanted, got %v", name, wanted)
+		}
+	}
+	if wanted["CF_PASSWORD_STAGING"] {
+		t.Error("wantedEnvVars() expected CF_PASSWORD_STAGING not to be wanted by a dual space")
+	}
+}
+
+// revokedWhenWritten a fakeSink noting which users' tokens had been revoked when each secret was set
+type revokedWhenWritten struct {
+	*fakeSink
+	fake    *fakeCf
+	revoked map[string][]string
+}
+
+func (r revokedWhenWritten) SetSecret(orgAndRepo string, name string, value string) error {
+	r.revoked[name] = append([]string{}, r.fake.revoked...)
+	return r.fakeSink.SetSecret(orgAndRepo, name, value)
+}
+
+func Test_RotateDualSpace_RevokesTokensBeforePublishing(t *testing.T) {
+	defer useSettings(t, `
+  revoke_tokens:
+    enabled: true
+  cfs:
+  - id: A
+    api_href: https://api.a.example.com
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      strategy: dual
+      repos: [govau/a]
+  `)()
+	fake := newFakeCf()
+	defer fake.server.Close()
+	fake.addUser("ci-org-space-a", time.Now().Add(-2*time.Hour))
+	fake.addUser("ci-org-space-b", time.Now().Add(-time.Hour))
+	cfInfos["A"] = fake.connect(t, "A")
+
+	sink := revokedWhenWritten{fakeSink: newFakeSink("govau/a"), fake: fake, revoked: map[string][]string{}}
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkCircleCI: sink}}
+	sinks.repos["govau/a"] = settings.Orgs[0].Spaces[0].Repos[0]
+
+	report := &Report{}
+	rotateDualSpace(sinks, settings.Orgs[0], settings.Orgs[0].Spaces[0], []string{"govau/a"}, report)
+	if report.Failed() {
+		t.Fatalf("rotateDualSpace() failed: %v", report.Failures)
+	}
+
+	want := []string{"id-ci-org-space-a"}
+	if !reflect.DeepEqual(fake.revoked, want) {
+		t.Errorf("rotateDualSpace() expected only the rotated user's tokens to be revoked, got %v", fake.revoked)
+	}
+	if got := sink.revoked["CF_PASSWORD_A_A"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rotateDualSpace() expected the tokens to be revoked before the password was published, got %v", got)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/govau/torque/config"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// GitHub a SecretSink delivering to GitHub Actions secrets, whose targets are owner/repo.
+// Secrets for a cf can go in a GitHub Actions environment instead of the repo, see ConfigureRepo.
+type GitHub struct {
+	api *apiClient
+	// environments the environment each cf's secrets go in, by cf ID, for each repo
+	environments map[string]map[string]string
+}
+
+type githubPublicKey struct {
+	KeyID string `json:"key_id"`
+	Key   string `json:"key"`
+}
+
+type githubSecrets struct {
+	TotalCount int `json:"total_count"`
+	Secrets    []struct {
+		Name string `json:"name"`
+	} `json:"secrets"`
+}
+
+// githubPageSize the most secrets GitHub returns in one page
+const githubPageSize = 100
+
+// NewGitHub Create new GitHub instance. The token is tested and any error is returned.
+func NewGitHub(apiURL string, token string) (*GitHub, error) {
+	g := &GitHub{
+		api: newAPIClient("github", apiURL, nil, http.Header{
+			"Accept":        {"application/vnd.github+json"},
+			"Authorization": {"Bearer " + token},
+		}),
+		environments: map[string]map[string]string{},
+	}
+
+	user := struct {
+		Login string `json:"login"`
+	}{}
+	if err := g.api.do(http.MethodGet, "/user", nil, &user); err != nil {
+		return nil, fmt.Errorf("Bad github token: %v", err)
+	}
+	if *verbose {
+		log.Printf("GitHub Token belongs to user %s", user.Login)
+	}
+	return g, nil
+}
+
+// ConfigureRepo note which environment each cf's secrets go in for this repo
+func (g *GitHub) ConfigureRepo(repo config.Repo) error {
+	if _, _, err := SplitOrgAndRepo(repo.Name); err != nil {
+		return err
+	}
+	g.environments[repo.Name] = repo.Environments
+	return nil
+}
+
+// secretsPath the path of the secrets API for the repo, or for one of its environments
+func secretsPath(ownerAndRepo string, environment string) string {
+	if environment == "" {
+		return fmt.Sprintf("/repos/%s/actions/secrets", ownerAndRepo)
+	}
+	return fmt.Sprintf("/repos/%s/environments/%s/secrets", ownerAndRepo, url.PathEscape(environment))
+}
+
+// environmentFor the environment a secret goes in, or "" for the repo
+func (g *GitHub) environmentFor(ownerAndRepo string, name string) string {
+	id := cfIDOf(name, sortedKeys(g.environments[ownerAndRepo]))
+	if id == "" {
+		return ""
+	}
+	return g.environments[ownerAndRepo][id]
+}
+
+// scopes the repo, as "", and each of its environments
+func (g *GitHub) scopes(ownerAndRepo string) []string {
+	scopes := []string{""}
+	seen := map[string]bool{}
+	for _, id := range sortedKeys(g.environments[ownerAndRepo]) {
+		environment := g.environments[ownerAndRepo][id]
+		if !seen[environment] {
+			seen[environment] = true
+			scopes = append(scopes, environment)
+		}
+	}
+	return scopes
+}
+
+// EnsureTarget ensure the repo can be seen, and create its environments if they do not exist
+func (g *GitHub) EnsureTarget(ownerAndRepo string) error {
+	if *verbose {
+		log.Printf("Ensuring github repo exists: %s", ownerAndRepo)
+	}
+	if err := g.api.do(http.MethodGet, "/repos/"+ownerAndRepo, nil, nil); err != nil {
+		return err
+	}
+	for _, environment := range g.scopes(ownerAndRepo)[1:] {
+		// Creates the environment, and leaves an existing one as it is
+		if err := g.api.do(http.MethodPut, fmt.Sprintf("/repos/%s/environments/%s", ownerAndRepo, url.PathEscape(environment)), nil, nil); err != nil {
+			return fmt.Errorf("Problem creating environment %s: %v", environment, err)
+		}
+	}
+	return nil
+}
+
+// CreatesTargets EnsureTarget creates the repo's environments that do not exist. The repo itself
+// has to exist already.
+func (g *GitHub) CreatesTargets() {}
+
+// TargetReady whether the repo can be seen and has all its environments
+func (g *GitHub) TargetReady(ownerAndRepo string) (bool, error) {
+	for _, environment := range g.scopes(ownerAndRepo) {
+		path := "/repos/" + ownerAndRepo
+		if environment != "" {
+			path = fmt.Sprintf("%s/environments/%s", path, url.PathEscape(environment))
+		}
+		err := g.api.do(http.MethodGet, path, nil, nil)
+		if isStatus(err, http.StatusNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// SecretNames the names of the secrets in the repo and its environments. GitHub never returns
+// the values.
+func (g *GitHub) SecretNames(ownerAndRepo string) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, environment := range g.scopes(ownerAndRepo) {
+		for page := 1; ; page++ {
+			secrets := githubSecrets{}
+			path := fmt.Sprintf("%s?per_page=%d&page=%d", secretsPath(ownerAndRepo, environment), githubPageSize, page)
+			if err := g.api.do(http.MethodGet, path, nil, &secrets); err != nil {
+				return nil, err
+			}
+			for _, secret := range secrets.Secrets {
+				names[secret.Name] = true
+			}
+			if len(secrets.Secrets) < githubPageSize {
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// SetSecret encrypt the value with the repo's or environment's public key and set it
+func (g *GitHub) SetSecret(ownerAndRepo string, name string, value string) error {
+	path := secretsPath(ownerAndRepo, g.environmentFor(ownerAndRepo, name))
+
+	publicKey := githubPublicKey{}
+	if err := g.api.do(http.MethodGet, path+"/public-key", nil, &publicKey); err != nil {
+		return fmt.Errorf("Problem getting public key: %v", err)
+	}
+	encrypted, err := sealSecret(publicKey.Key, value)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{"encrypted_value": encrypted, "key_id": publicKey.KeyID}
+	return g.api.do(http.MethodPut, path+"/"+url.PathEscape(name), body, nil)
+}
+
+// SetStaticVars set each var that is not already a secret. They are stored as secrets too, so
+// that workflows read every CF_* value the same way.
+func (g *GitHub) SetStaticVars(ownerAndRepo string, vars map[string]string) error {
+	names, err := g.SecretNames(ownerAndRepo)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(vars) {
+		if names[name] {
+			continue
+		}
+		if err := g.SetSecret(ownerAndRepo, name, vars[name]); err != nil {
+			return fmt.Errorf("Problem adding secret to %s: %v", ownerAndRepo, err)
+		}
+	}
+	return nil
+}
+
+// Delete the secret from the repo or environment it belongs in
+func (g *GitHub) Delete(ownerAndRepo string, name string) error {
+	path := secretsPath(ownerAndRepo, g.environmentFor(ownerAndRepo, name))
+	return g.api.do(http.MethodDelete, path+"/"+url.PathEscape(name), nil, nil)
+}
+
+// BuildsInProgress the number of workflow runs in progress or queued in the repo
+func (g *GitHub) BuildsInProgress(ownerAndRepo string) (int, error) {
+	inProgress := 0
+	for _, status := range []string{"in_progress", "queued"} {
+		runs := struct {
+			TotalCount int `json:"total_count"`
+		}{}
+		path := fmt.Sprintf("/repos/%s/actions/runs?status=%s&per_page=1", ownerAndRepo, status)
+		if err := g.api.do(http.MethodGet, path, nil, &runs); err != nil {
+			return 0, err
+		}
+		inProgress += runs.TotalCount
+	}
+	return inProgress, nil
+}
+
+// sealSecret encrypt the value with a libsodium sealed box for the base64 encoded public key, as
+// GitHub requires
+func sealSecret(publicKey string, value string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("Bad github public key: %v", err)
+	}
+	if len(decoded) != 32 {
+		return "", fmt.Errorf("Bad github public key: expected 32 bytes but got %d", len(decoded))
+	}
+	var recipient [32]byte
+	copy(recipient[:], decoded)
+
+	sealed, err := box.SealAnonymous(nil, []byte(value), &recipient, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/govau/torque/config"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeGitHub a GitHub API with one repo, holding secrets for the repo and each environment.
+// Secrets are decrypted as they are set, so tests can check what a workflow would see.
+type fakeGitHub struct {
+	t          *testing.T
+	repo       string
+	publicKey  *[32]byte
+	privateKey *[32]byte
+
+	mu sync.Mutex
+	// secrets by scope, "" for the repo or the environment's name
+	secrets map[string]map[string]string
+}
+
+func newFakeGitHub(t *testing.T, repo string) (*fakeGitHub, *httptest.Server) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeGitHub{
+		t:          t,
+		repo:       repo,
+		publicKey:  publicKey,
+		privateKey: privateKey,
+		secrets:    map[string]map[string]string{"": {}},
+	}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/user" {
+		json.NewEncoder(w).Encode(map[string]string{"login": "torque"})
+		return
+	}
+
+	prefix := "/repos/" + f.repo
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+
+	// The secrets API is the same for the repo and for an environment
+	scope := ""
+	switch {
+	case path == "":
+		return
+	case strings.HasPrefix(path, "/actions/secrets"):
+		path = strings.TrimPrefix(path, "/actions/secrets")
+	case strings.HasPrefix(path, "/environments/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/environments/"), "/", 2)
+		scope = parts[0]
+		if len(parts) == 1 {
+			if r.Method == http.MethodPut {
+				if _, ok := f.secrets[scope]; !ok {
+					f.secrets[scope] = map[string]string{}
+				}
+			} else if _, ok := f.secrets[scope]; !ok {
+				http.NotFound(w, r)
+			}
+			return
+		}
+		path = strings.TrimPrefix("/"+parts[1], "/secrets")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	secrets, ok := f.secrets[scope]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case path == "/public-key":
+		json.NewEncoder(w).Encode(githubPublicKey{KeyID: "key-1", Key: base64.StdEncoding.EncodeToString(f.publicKey[:])})
+	case path == "" && r.Method == http.MethodGet:
+		list := githubSecrets{TotalCount: len(secrets)}
+		for name := range secrets {
+			list.Secrets = append(list.Secrets, struct {
+				Name string `json:"name"`
+			}{name})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut:
+		body := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["key_id"] != "key-1" {
+			http.Error(w, "bad request", http.StatusUnprocessableEntity)
+			return
+		}
+		sealed, _ := base64.StdEncoding.DecodeString(body["encrypted_value"])
+		value, ok := box.OpenAnonymous(nil, sealed, f.publicKey, f.privateKey)
+		if !ok {
+			f.t.Errorf("fake github could not open the sealed secret %s", path)
+			http.Error(w, "bad encryption", http.StatusUnprocessableEntity)
+			return
+		}
+		secrets[strings.TrimPrefix(path, "/")] = string(value)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		delete(secrets, strings.TrimPrefix(path, "/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_GitHub_SetsSealedSecretsPerEnvironment(t *testing.T) {
+	fake, server := newFakeGitHub(t, "govau/a")
+	defer server.Close()
+
+	g, err := NewGitHub(server.URL, "test-token")
+	if err != nil {
+		t.Fatalf("NewGitHub() error: %v", err)
+	}
+	if err := g.ConfigureRepo(config.Repo{Name: "govau/a", Sink: config.SinkGitHub, Environments: map[string]string{"STAGING": "staging"}}); err != nil {
+		t.Fatalf("ConfigureRepo() error: %v", err)
+	}
+
+	if ready, err := g.TargetReady("govau/a"); err != nil || ready {
+		t.Errorf("TargetReady() expected false before the environment exists, got %v, %v", ready, err)
+	}
+	if err := g.EnsureTarget("govau/a"); err != nil {
+		t.Fatalf("EnsureTarget() error: %v", err)
+	}
+	if err := g.SetStaticVars("govau/a", map[string]string{"CF_ORG": "org", "CF_API_STAGING": "https://api.staging"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := g.SetSecret("govau/a", "CF_PASSWORD_STAGING", "new-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	if got := fake.secrets["staging"]["CF_PASSWORD_STAGING"]; got != "new-password" {
+		t.Errorf("SetSecret() expected the staging environment to have the password, got %q", got)
+	}
+	if got := fake.secrets["staging"]["CF_API_STAGING"]; got != "https://api.staging" {
+		t.Errorf("SetStaticVars() expected the staging environment to have CF_API_STAGING, got %q", got)
+	}
+	if got := fake.secrets[""]["CF_ORG"]; got != "org" {
+		t.Errorf("SetStaticVars() expected the repo to have CF_ORG, got %q", got)
+	}
+	if _, ok := fake.secrets[""]["CF_PASSWORD_STAGING"]; ok {
+		t.Error("SetSecret() expected CF_PASSWORD_STAGING not to be set on the repo")
+	}
+
+	names, err := g.SecretNames("govau/a")
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	for _, name := range []string{"CF_ORG", "CF_API_STAGING", "CF_PASSWORD_STAGING"} {
+		if !names[name] {
+			t.Errorf("SecretNames() expected %s, got %v", name, names)
+		}
+	}
+
+	if err := g.Delete("govau/a", "CF_PASSWORD_STAGING"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, ok := fake.secrets["staging"]["CF_PASSWORD_STAGING"]; ok {
+		t.Error("Delete() expected CF_PASSWORD_STAGING to be gone")
+	}
+}
+
+func Test_GitHub_EnvironmentFor_OverlappingIDs(t *testing.T) {
+	g := &GitHub{environments: map[string]map[string]string{
+		"govau/a": {"PROD": "prod", "AU_PROD": "au-prod", "STAGING": "staging"},
+	}}
+	for name, expected := range map[string]string{
+		"CF_PASSWORD_PROD":    "prod",
+		"CF_PASSWORD_AU_PROD": "au-prod",
+		"CF_API_AU_PROD":      "au-prod",
+		"CF_API_STAGING":      "staging",
+		"CF_ORG":              "",
+	} {
+		// Map order is random, so try each a few times
+		for i := 0; i < 10; i++ {
+			if got := g.environmentFor("govau/a", name); got != expected {
+				t.Fatalf("environmentFor(%s) expected %q but was %q", name, expected, got)
+			}
+		}
+	}
+}
+
+func Test_GitHub_BadToken_ReturnsError(t *testing.T) {
+	_, server := newFakeGitHub(t, "govau/a")
+	defer server.Close()
+
+	if _, err := NewGitHub(server.URL, "wrong-token"); err == nil {
+		t.Error("NewGitHub() expected an error for a bad token")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/govau/torque/config"
+)
+
+// GitLab a SecretSink delivering to GitLab CI/CD variables, whose targets are project or group
+// paths, optionally starting with the GitLab host, e.g. gitlab.example.gov.au/team/app.
+// Passwords are masked and protected, static vars are plain.
+type GitLab struct {
+	URL string
+	api *apiClient
+	// groups the targets that are groups rather than projects
+	groups map[string]bool
+}
+
+type gitlabVariable struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Masked    bool   `json:"masked"`
+	Protected bool   `json:"protected"`
+}
+
+// gitlabPageSize the most variables GitLab returns in one page
+const gitlabPageSize = 100
+
+// NewGitLab Create new GitLab instance. The token is tested and any error is returned.
+func NewGitLab(gitlabURL string, token string) (*GitLab, error) {
+	g := &GitLab{
+		URL:    strings.TrimSuffix(gitlabURL, "/"),
+		groups: map[string]bool{},
+	}
+	g.api = newAPIClient("gitlab", g.URL+"/api/v4", nil, http.Header{"PRIVATE-TOKEN": {token}})
+
+	user := struct {
+		Username string `json:"username"`
+	}{}
+	if err := g.api.do(http.MethodGet, "/user", nil, &user); err != nil {
+		return nil, fmt.Errorf("Bad gitlab token: %v", err)
+	}
+	if *verbose {
+		log.Printf("GitLab Token belongs to user %s", user.Username)
+	}
+	return g, nil
+}
+
+// ConfigureRepo check the repo is on this GitLab, and note whether it is a group
+func (g *GitLab) ConfigureRepo(repo config.Repo) error {
+	g.groups[repo.Name] = repo.Group
+	_, err := g.resource(repo.Name)
+	return err
+}
+
+// resource the API path of the project or group, e.g. /projects/team%2Fapp
+func (g *GitLab) resource(target string) (string, error) {
+	path := target
+	if u, err := url.Parse(g.URL); err == nil && strings.HasPrefix(path, u.Host+"/") {
+		path = strings.TrimPrefix(path, u.Host+"/")
+	}
+	if !strings.Contains(path, "/") && !g.groups[target] {
+		return "", fmt.Errorf("bad gitlab project: %s. Must be like 'group/project' on %s", target, g.URL)
+	}
+	if strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+		return "", fmt.Errorf("gitlab repo %s is not on %s", target, g.URL)
+	}
+
+	kind := "projects"
+	if g.groups[target] {
+		kind = "groups"
+	}
+	return fmt.Sprintf("/%s/%s", kind, url.PathEscape(path)), nil
+}
+
+// EnsureTarget ensure the project or group can be seen. GitLab projects need nothing enabling.
+func (g *GitLab) EnsureTarget(target string) error {
+	if *verbose {
+		log.Printf("Ensuring gitlab project exists: %s", target)
+	}
+	resource, err := g.resource(target)
+	if err != nil {
+		return err
+	}
+	return g.api.do(http.MethodGet, resource, nil, nil)
+}
+
+// TargetReady whether the project or group can be seen
+func (g *GitLab) TargetReady(target string) (bool, error) {
+	resource, err := g.resource(target)
+	if err != nil {
+		return false, err
+	}
+	err = g.api.do(http.MethodGet, resource, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SecretNames the keys of the project's or group's variables
+func (g *GitLab) SecretNames(target string) (map[string]bool, error) {
+	resource, err := g.resource(target)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for page := 1; ; page++ {
+		variables := []gitlabVariable{}
+		path := fmt.Sprintf("%s/variables?per_page=%d&page=%d", resource, gitlabPageSize, page)
+		if err := g.api.do(http.MethodGet, path, nil, &variables); err != nil {
+			return nil, err
+		}
+		for _, variable := range variables {
+			names[variable.Key] = true
+		}
+		if len(variables) < gitlabPageSize {
+			return names, nil
+		}
+	}
+}
+
+// SetSecret set a masked and protected variable. An existing variable is updated in place, so
+// there is no moment when it is missing.
+func (g *GitLab) SetSecret(target string, name string, value string) error {
+	return g.setVariable(target, gitlabVariable{Key: name, Value: value, Masked: true, Protected: true}, true)
+}
+
+// SetStaticVars add each var that is not already set, as a plain variable
+func (g *GitLab) SetStaticVars(target string, vars map[string]string) error {
+	names, err := g.SecretNames(target)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(vars) {
+		if names[name] {
+			continue
+		}
+		if err := g.setVariable(target, gitlabVariable{Key: name, Value: vars[name]}, false); err != nil {
+			return fmt.Errorf("Problem adding variable to %s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// setVariable update the variable, or create it if it does not exist
+func (g *GitLab) setVariable(target string, variable gitlabVariable, update bool) error {
+	resource, err := g.resource(target)
+	if err != nil {
+		return err
+	}
+	if update {
+		err := g.api.do(http.MethodPut, resource+"/variables/"+url.PathEscape(variable.Key), variable, nil)
+		if !isStatus(err, http.StatusNotFound) {
+			return err
+		}
+	}
+	return g.api.do(http.MethodPost, resource+"/variables", variable, nil)
+}
+
+// Delete the variable from the project or group
+func (g *GitLab) Delete(target string, name string) error {
+	resource, err := g.resource(target)
+	if err != nil {
+		return err
+	}
+	return g.api.do(http.MethodDelete, resource+"/variables/"+url.PathEscape(name), nil, nil)
+}
+
+// BuildsInProgress the number of the project's pipelines that are running or pending. Groups do
+// not run pipelines themselves.
+func (g *GitLab) BuildsInProgress(target string) (int, error) {
+	if g.groups[target] {
+		return 0, nil
+	}
+	resource, err := g.resource(target)
+	if err != nil {
+		return 0, err
+	}
+
+	inProgress := 0
+	for _, status := range []string{"running", "pending"} {
+		pipelines := []struct {
+			ID int `json:"id"`
+		}{}
+		path := fmt.Sprintf("%s/pipelines?status=%s&per_page=%d", resource, status, gitlabPageSize)
+		if err := g.api.do(http.MethodGet, path, nil, &pipelines); err != nil {
+			return 0, err
+		}
+		inProgress += len(pipelines)
+	}
+	return inProgress, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+// fakeGitLab a GitLab API holding CI/CD variables for projects and groups, by their escaped path
+// such as projects/team%2Fapp
+type fakeGitLab struct {
+	mu        sync.Mutex
+	variables map[string]map[string]gitlabVariable
+	// puts the number of variables updated in place
+	puts int
+}
+
+func newFakeGitLab(resources ...string) (*fakeGitLab, *httptest.Server) {
+	f := &fakeGitLab{variables: map[string]map[string]gitlabVariable{}}
+	for _, resource := range resources {
+		f.variables[resource] = map[string]gitlabVariable{}
+	}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("PRIVATE-TOKEN") != "test-token" {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/")
+	if path == "user" {
+		json.NewEncoder(w).Encode(map[string]string{"username": "torque"})
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 4)
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	variables, ok := f.variables[parts[0]+"/"+parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 2:
+		json.NewEncoder(w).Encode(map[string]int{"id": 1})
+	case parts[2] == "pipelines":
+		json.NewEncoder(w).Encode([]map[string]int{{"id": 1}})
+	case parts[2] != "variables":
+		http.NotFound(w, r)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		list := []gitlabVariable{}
+		for _, variable := range variables {
+			list = append(list, variable)
+		}
+		json.NewEncoder(w).Encode(list)
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		variable := gitlabVariable{}
+		json.NewDecoder(r.Body).Decode(&variable)
+		if _, exists := variables[variable.Key]; exists {
+			http.Error(w, `{"message":{"key":["has already been taken"]}}`, http.StatusBadRequest)
+			return
+		}
+		variables[variable.Key] = variable
+		w.WriteHeader(http.StatusCreated)
+	case len(parts) == 4 && r.Method == http.MethodPut:
+		if _, exists := variables[parts[3]]; !exists {
+			http.NotFound(w, r)
+			return
+		}
+		variable := gitlabVariable{}
+		json.NewDecoder(r.Body).Decode(&variable)
+		variables[parts[3]] = variable
+		f.puts++
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(variables, parts[3])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_GitLab_SetsMaskedProtectedPasswords(t *testing.T) {
+	fake, server := newFakeGitLab("projects/team%2Fapp")
+	defer server.Close()
+
+	g, err := NewGitLab(server.URL, "test-token")
+	if err != nil {
+		t.Fatalf("NewGitLab() error: %v", err)
+	}
+	// The repo is named with the GitLab host, as people copy it from the browser
+	target := strings.TrimPrefix(server.URL, "http://") + "/team/app"
+	if err := g.ConfigureRepo(config.Repo{Name: target, Sink: config.SinkGitLab}); err != nil {
+		t.Fatalf("ConfigureRepo() error: %v", err)
+	}
+
+	if err := g.EnsureTarget(target); err != nil {
+		t.Fatalf("EnsureTarget() error: %v", err)
+	}
+	if err := g.SetStaticVars(target, map[string]string{"CF_ORG": "org"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := g.SetSecret(target, "CF_PASSWORD", "first-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	if err := g.SetSecret(target, "CF_PASSWORD", "second-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	variables := fake.variables["projects/team%2Fapp"]
+	if got := variables["CF_PASSWORD"]; got.Value != "second-password" || !got.Masked || !got.Protected {
+		t.Errorf("SetSecret() expected a masked, protected second-password, got %+v", got)
+	}
+	if fake.puts != 1 {
+		t.Errorf("SetSecret() expected the existing password to be updated in place, got %d updates", fake.puts)
+	}
+	if got := variables["CF_ORG"]; got.Value != "org" || got.Masked || got.Protected {
+		t.Errorf("SetStaticVars() expected a plain CF_ORG, got %+v", got)
+	}
+
+	names, err := g.SecretNames(target)
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	if !names["CF_ORG"] || !names["CF_PASSWORD"] {
+		t.Errorf("SecretNames() expected CF_ORG and CF_PASSWORD, got %v", names)
+	}
+	if inProgress, err := g.BuildsInProgress(target); err != nil || inProgress != 2 {
+		t.Errorf("BuildsInProgress() expected a running and a pending pipeline, got %d, %v", inProgress, err)
+	}
+
+	if err := g.Delete(target, "CF_PASSWORD"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if _, ok := variables["CF_PASSWORD"]; ok {
+		t.Error("Delete() expected CF_PASSWORD to be gone")
+	}
+}
+
+func Test_GitLab_Group_SetsGroupVariables(t *testing.T) {
+	fake, server := newFakeGitLab("groups/team")
+	defer server.Close()
+
+	g, err := NewGitLab(server.URL, "test-token")
+	if err != nil {
+		t.Fatalf("NewGitLab() error: %v", err)
+	}
+	if err := g.ConfigureRepo(config.Repo{Name: "team", Sink: config.SinkGitLab, Group: true}); err != nil {
+		t.Fatalf("ConfigureRepo() error: %v", err)
+	}
+	if err := g.SetSecret("team", "CF_PASSWORD", "password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	if got := fake.variables["groups/team"]["CF_PASSWORD"].Value; got != "password" {
+		t.Errorf("SetSecret() expected the group to have the password, got %q", got)
+	}
+	if inProgress, err := g.BuildsInProgress("team"); err != nil || inProgress != 0 {
+		t.Errorf("BuildsInProgress() expected nothing to wait for on a group, got %d, %v", inProgress, err)
+	}
+}
+
+func Test_GitLab_RepoOnOtherHost_ReturnsError(t *testing.T) {
+	_, server := newFakeGitLab()
+	defer server.Close()
+
+	g, err := NewGitLab(server.URL, "test-token")
+	if err != nil {
+		t.Fatalf("NewGitLab() error: %v", err)
+	}
+	if err := g.ConfigureRepo(config.Repo{Name: "gitlab.example.gov.au/team/app", Sink: config.SinkGitLab}); err == nil {
+		t.Error("ConfigureRepo() expected an error for a repo on another GitLab")
+	}
+}
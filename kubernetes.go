@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// serviceAccountDir where Kubernetes mounts the pod's service account token, CA and namespace
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Labels torque puts on the Secrets it manages
+const (
+	kubernetesLabelPrefix = "torque.govau/"
+	// kubernetesRotatedLabel followed by a cf ID, when that cf's password was last set, in Unix time
+	kubernetesRotatedLabel = kubernetesLabelPrefix + "rotated-"
+)
+
+// Kubernetes a SecretSink delivering to Kubernetes Secrets, whose targets are namespace/name, or
+// just the name in the default namespace. Each Secret's keys are the env vars. It is labelled
+// with the org and space from CF_ORG and CF_SPACE, and when each cf's password was last set.
+type Kubernetes struct {
+	Server    string
+	Namespace string
+	api       *apiClient
+	// cfIDs every cf, sorted
+	cfIDs []string
+}
+
+// kubeConfig how to reach the API server
+type kubeConfig struct {
+	server    string
+	token     string
+	namespace string
+	tls       *tls.Config
+}
+
+type kubernetesSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubernetesMeta    `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string]string `json:"data"`
+}
+
+type kubernetesMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+// NewKubernetes Create new Kubernetes instance from the kubeconfig file, or the pod's service
+// account if there is none. Access to the default namespace's Secrets is tested and any error is
+// returned.
+func NewKubernetes(kubeconfig string, context string, namespace string, cfIDs []string) (*Kubernetes, error) {
+	var cfg kubeConfig
+	var err error
+	if kubeconfig == "" {
+		cfg, err = inClusterConfig()
+	} else {
+		cfg, err = loadKubeconfig(kubeconfig, context)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = cfg.namespace
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	sorted := append([]string{}, cfIDs...)
+	sort.Strings(sorted)
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg.tls}
+	header := http.Header{"Accept": {"application/json"}}
+	if cfg.token != "" {
+		header.Set("Authorization", "Bearer "+cfg.token)
+	}
+	k := &Kubernetes{
+		Server:    strings.TrimSuffix(cfg.server, "/"),
+		Namespace: namespace,
+		api:       newAPIClient("kubernetes", cfg.server, transport, header),
+		cfIDs:     sorted,
+	}
+
+	if err := k.api.do(http.MethodGet, k.secretsPath(namespace)+"?limit=1", nil, nil); err != nil {
+		return nil, fmt.Errorf("Problem listing secrets in namespace %s: %v", namespace, err)
+	}
+	if *verbose {
+		log.Printf("Kubernetes can list secrets in namespace %s on %s", namespace, k.Server)
+	}
+	return k, nil
+}
+
+// inClusterConfig the config of the pod's service account
+func inClusterConfig() (kubeConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return kubeConfig{}, fmt.Errorf("Not running in a kubernetes cluster, set kubernetes kubeconfig")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return kubeConfig{}, fmt.Errorf("Problem reading service account token: %v", err)
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return kubeConfig{}, fmt.Errorf("Problem reading service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return kubeConfig{}, fmt.Errorf("Bad service account CA")
+	}
+	namespace, _ := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+
+	return kubeConfig{
+		server:    "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+		tls:       &tls.Config{RootCAs: pool},
+	}, nil
+}
+
+// kubeconfigFile the parts of a kubeconfig file torque uses
+type kubeconfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Exec                  interface{}
+		}
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+}
+
+// loadKubeconfig the config of a context in the kubeconfig file, or its current context. Files
+// it names are relative to the kubeconfig file, as kubectl reads them.
+func loadKubeconfig(file string, context string) (kubeConfig, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return kubeConfig{}, fmt.Errorf("Problem reading kubeconfig: %v", err)
+	}
+	var kc kubeconfigFile
+	if err := yaml.Unmarshal(contents, &kc); err != nil {
+		return kubeConfig{}, fmt.Errorf("Bad kubeconfig: %v", err)
+	}
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	dir := filepath.Dir(file)
+
+	cfg := kubeConfig{tls: &tls.Config{}}
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			clusterName, userName, cfg.namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+		}
+	}
+	if clusterName == "" {
+		return kubeConfig{}, fmt.Errorf("Bad kubeconfig: context %q not found", context)
+	}
+
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		cfg.server = c.Cluster.Server
+		cfg.tls.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		caCert, err := kubeconfigData(dir, c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return kubeConfig{}, err
+		}
+		if caCert != nil {
+			cfg.tls.RootCAs = x509.NewCertPool()
+			if !cfg.tls.RootCAs.AppendCertsFromPEM(caCert) {
+				return kubeConfig{}, fmt.Errorf("Bad kubeconfig: no certificates in cluster %s's certificate authority", clusterName)
+			}
+		}
+	}
+	if cfg.server == "" {
+		return kubeConfig{}, fmt.Errorf("Bad kubeconfig: cluster %q not found", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil {
+			return kubeConfig{}, fmt.Errorf("Bad kubeconfig: exec credential plugins are not supported, use a token or client certificate for user %s", userName)
+		}
+		cfg.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(kubeconfigPath(dir, u.User.TokenFile))
+			if err != nil {
+				return kubeConfig{}, fmt.Errorf("Problem reading kubeconfig token file: %v", err)
+			}
+			cfg.token = strings.TrimSpace(string(token))
+		}
+		cert, err := kubeconfigData(dir, u.User.ClientCertificate, u.User.ClientCertificateData)
+		if err != nil {
+			return kubeConfig{}, err
+		}
+		key, err := kubeconfigData(dir, u.User.ClientKey, u.User.ClientKeyData)
+		if err != nil {
+			return kubeConfig{}, err
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return kubeConfig{}, fmt.Errorf("Bad kubeconfig client certificate for user %s: %v", userName, err)
+			}
+			cfg.tls.Certificates = []tls.Certificate{pair}
+		}
+	}
+	return cfg, nil
+}
+
+// kubeconfigData the contents of a kubeconfig field that is either a file or base64 data
+func kubeconfigData(dir string, file string, data string) ([]byte, error) {
+	if data != "" {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("Bad kubeconfig data: %v", err)
+		}
+		return decoded, nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(kubeconfigPath(dir, file))
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading kubeconfig file: %v", err)
+	}
+	return contents, nil
+}
+
+func kubeconfigPath(dir string, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+func (k *Kubernetes) secretsPath(namespace string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets", namespace)
+}
+
+// splitTarget the namespace and name of the target's Secret
+func (k *Kubernetes) splitTarget(target string) (string, string) {
+	if i := strings.Index(target, "/"); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return k.Namespace, target
+}
+
+// getSecret the target's Secret, or nil if it does not exist
+func (k *Kubernetes) getSecret(target string) (*kubernetesSecret, error) {
+	namespace, name := k.splitTarget(target)
+	secret := &kubernetesSecret{}
+	err := k.api.do(http.MethodGet, k.secretsPath(namespace)+"/"+name, nil, secret)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secret.Data == nil {
+		secret.Data = map[string]string{}
+	}
+	return secret, nil
+}
+
+// updateSecret change the target's Secret with update, which returns whether it changed anything.
+// A Secret changed since it was read is not overwritten, as its resourceVersion no longer matches.
+func (k *Kubernetes) updateSecret(target string, update func(secret *kubernetesSecret) bool) error {
+	secret, err := k.getSecret(target)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("Secret %s does not exist", target)
+	}
+	if !update(secret) {
+		return nil
+	}
+	k.labelSecret(secret)
+
+	namespace, name := k.splitTarget(target)
+	return k.api.do(http.MethodPut, k.secretsPath(namespace)+"/"+name, secret, nil)
+}
+
+// labelSecret label the Secret with its org and space
+func (k *Kubernetes) labelSecret(secret *kubernetesSecret) {
+	if secret.Metadata.Labels == nil {
+		secret.Metadata.Labels = map[string]string{}
+	}
+	secret.Metadata.Labels["app.kubernetes.io/managed-by"] = "torque"
+	for label, key := range map[string]string{"org": "CF_ORG", "space": "CF_SPACE"} {
+		if value, err := base64.StdEncoding.DecodeString(secret.Data[key]); err == nil && len(value) > 0 {
+			secret.Metadata.Labels[kubernetesLabelPrefix+label] = labelValue(string(value))
+		}
+	}
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// labelValue the value made valid as a label value: at most 63 characters that are alphanumeric,
+// '-', '_' or '.', starting and ending with an alphanumeric
+func labelValue(value string) string {
+	value = invalidLabelChars.ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// EnsureTarget create the Secret if it does not exist
+func (k *Kubernetes) EnsureTarget(target string) error {
+	if *verbose {
+		log.Printf("Ensuring kubernetes secret exists: %s", target)
+	}
+	secret, err := k.getSecret(target)
+	if err != nil || secret != nil {
+		return err
+	}
+	namespace, name := k.splitTarget(target)
+	secret = &kubernetesSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   kubernetesMeta{Name: name, Namespace: namespace},
+		Type:       "Opaque",
+		Data:       map[string]string{},
+	}
+	k.labelSecret(secret)
+	return k.api.do(http.MethodPost, k.secretsPath(namespace), secret, nil)
+}
+
+// TargetReady whether the Secret exists
+func (k *Kubernetes) TargetReady(target string) (bool, error) {
+	secret, err := k.getSecret(target)
+	return secret != nil, err
+}
+
+// SecretNames the keys in the Secret
+func (k *Kubernetes) SecretNames(target string) (map[string]bool, error) {
+	secret, err := k.getSecret(target)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	if secret != nil {
+		for name := range secret.Data {
+			names[name] = true
+		}
+	}
+	return names, nil
+}
+
+// SetSecret set the key in the Secret, and label the Secret with when the cf's password was set
+func (k *Kubernetes) SetSecret(target string, name string, value string) error {
+	return k.updateSecret(target, func(secret *kubernetesSecret) bool {
+		secret.Data[name] = base64.StdEncoding.EncodeToString([]byte(value))
+		if id := cfIDOf(name, k.cfIDs); id != "" {
+			if secret.Metadata.Labels == nil {
+				secret.Metadata.Labels = map[string]string{}
+			}
+			secret.Metadata.Labels[kubernetesRotatedLabel+id] = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		return true
+	})
+}
+
+// SetStaticVars add the vars missing from the Secret
+func (k *Kubernetes) SetStaticVars(target string, vars map[string]string) error {
+	return k.updateSecret(target, func(secret *kubernetesSecret) bool {
+		changed := false
+		for name, value := range vars {
+			if _, ok := secret.Data[name]; !ok {
+				secret.Data[name] = base64.StdEncoding.EncodeToString([]byte(value))
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// Delete remove the key from the Secret
+func (k *Kubernetes) Delete(target string, name string) error {
+	return k.updateSecret(target, func(secret *kubernetesSecret) bool {
+		_, ok := secret.Data[name]
+		delete(secret.Data, name)
+		return ok
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubernetes an API server holding Secrets by namespace/name, that checks resourceVersion on
+// updates as the real one does
+type fakeKubernetes struct {
+	mu      sync.Mutex
+	secrets map[string]kubernetesSecret
+	version int
+}
+
+func newFakeKubernetes() (*fakeKubernetes, *httptest.Server) {
+	f := &fakeKubernetes{secrets: map[string]kubernetesSecret{}}
+	return f, httptest.NewTLSServer(f)
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, `{"kind":"Status","code":401}`, http.StatusUnauthorized)
+		return
+	}
+	// /api/v1/namespaces/{namespace}/secrets[/{name}]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "secrets" {
+		http.NotFound(w, r)
+		return
+	}
+	namespace := parts[0]
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "SecretList", "items": []interface{}{}})
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		secret := kubernetesSecret{}
+		json.NewDecoder(r.Body).Decode(&secret)
+		key := namespace + "/" + secret.Metadata.Name
+		if _, ok := f.secrets[key]; ok {
+			http.Error(w, `{"kind":"Status","code":409}`, http.StatusConflict)
+			return
+		}
+		f.store(key, secret)
+		w.WriteHeader(http.StatusCreated)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		secret, ok := f.secrets[namespace+"/"+parts[2]]
+		if !ok {
+			http.Error(w, `{"kind":"Status","code":404}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case len(parts) == 3 && r.Method == http.MethodPut:
+		secret := kubernetesSecret{}
+		json.NewDecoder(r.Body).Decode(&secret)
+		key := namespace + "/" + parts[2]
+		if f.secrets[key].Metadata.ResourceVersion != secret.Metadata.ResourceVersion {
+			http.Error(w, `{"kind":"Status","code":409}`, http.StatusConflict)
+			return
+		}
+		f.store(key, secret)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeKubernetes) store(key string, secret kubernetesSecret) {
+	f.version++
+	secret.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.secrets[key] = secret
+}
+
+// writeKubeconfig write a kubeconfig for the fake to a file in dir
+func writeKubeconfig(t *testing.T, dir string, server *httptest.Server) string {
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	kubeconfig := fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: torque
+  user:
+    token: test-token
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: torque
+    namespace: deploy
+`, server.URL, base64.StdEncoding.EncodeToString(caCert))
+	file := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(file, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func Test_Kubernetes_WritesLabelledSecret(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k, err := NewKubernetes(writeKubeconfig(t, dir, server), "", "", []string{"STAGING"})
+	if err != nil {
+		t.Fatalf("NewKubernetes() error: %v", err)
+	}
+
+	if ready, err := k.TargetReady("cf-dta-prod"); err != nil || ready {
+		t.Errorf("TargetReady() expected false before the Secret exists, got %v, %v", ready, err)
+	}
+	if err := k.EnsureTarget("cf-dta-prod"); err != nil {
+		t.Fatalf("EnsureTarget() error: %v", err)
+	}
+	if err := k.SetStaticVars("cf-dta-prod", map[string]string{"CF_ORG": "dta", "CF_SPACE": "prod"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := k.SetSecret("cf-dta-prod", "CF_PASSWORD_STAGING", "new-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	// The context's namespace is used, as the name has none
+	secret, ok := fake.secrets["deploy/cf-dta-prod"]
+	if !ok {
+		t.Fatalf("expected Secret deploy/cf-dta-prod, got %v", fake.secrets)
+	}
+	if got, _ := base64.StdEncoding.DecodeString(secret.Data["CF_PASSWORD_STAGING"]); string(got) != "new-password" {
+		t.Errorf("SetSecret() expected CF_PASSWORD_STAGING to be new-password, got %q", got)
+	}
+	labels := secret.Metadata.Labels
+	if labels["torque.govau/org"] != "dta" || labels["torque.govau/space"] != "prod" {
+		t.Errorf("expected the Secret to be labelled with the org and space, got %v", labels)
+	}
+	if _, err := strconv.ParseInt(labels["torque.govau/rotated-STAGING"], 10, 64); err != nil {
+		t.Errorf("SetSecret() expected the Secret to be labelled with when STAGING was rotated, got %v", labels)
+	}
+
+	if err := k.Delete("deploy/cf-dta-prod", "CF_PASSWORD_STAGING"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	names, err := k.SecretNames("cf-dta-prod")
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	if len(names) != 2 || !names["CF_ORG"] || !names["CF_SPACE"] {
+		t.Errorf("SecretNames() expected CF_ORG and CF_SPACE, got %v", names)
+	}
+}
+
+func Test_LabelValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"dta":                     "dta",
+		"my org":                  "my-org",
+		"-leading":                "leading",
+		strings.Repeat("a", 70):   strings.Repeat("a", 63),
+		"ends.in.invalid/char/":   "ends.in.invalid-char",
+		"team_space.with-dashes!": "team_space.with-dashes",
+	} {
+		if got := labelValue(value); got != want {
+			t.Errorf("labelValue(%q) expected %q but was %q", value, want, got)
+		}
+	}
+}
+
+func Test_Kubernetes_SetSecret_OverlappingIDs_LabelsLongest(t *testing.T) {
+	fake, server := newFakeKubernetes()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k, err := NewKubernetes(writeKubeconfig(t, dir, server), "", "", []string{"PROD", "SYD_PROD"})
+	if err != nil {
+		t.Fatalf("NewKubernetes() error: %v", err)
+	}
+	if err := k.EnsureTarget("cf-dta-prod"); err != nil {
+		t.Fatalf("EnsureTarget() error: %v", err)
+	}
+	if err := k.SetSecret("cf-dta-prod", "CF_PASSWORD_SYD_PROD", "new-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	labels := fake.secrets["deploy/cf-dta-prod"].Metadata.Labels
+	if _, ok := labels["torque.govau/rotated-SYD_PROD"]; !ok {
+		t.Errorf("SetSecret() expected the Secret to be labelled with when SYD_PROD was rotated, got %v", labels)
+	}
+	if _, ok := labels["torque.govau/rotated-PROD"]; ok {
+		t.Errorf("SetSecret() expected PROD's label to be left alone, got %v", labels)
+	}
+}
@@ -5,149 +5,534 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	uaa "github.com/cloudfoundry-community/go-uaa"
 	"github.com/govau/torque/config"
+	"github.com/govau/torque/state"
 )
 
 var (
 	configFile = flag.String("config.file", "config.yaml", "Path to configuration file.")
 	verbose    = flag.Bool("verbose", false, "Enable verbose logging")
+	plan       = flag.Bool("plan", false, "Print the changes a run would make without making them")
+	planFormat = flag.String("plan.format", "text", "Format of the plan output: text or json")
+	force      = flag.String("force", "", "Rotate this org/space now, however young its password is")
+	listenAddr = flag.String("web.listen-address", ":8080", "Address to serve /metrics on, for serve")
+	textfile   = flag.String("metrics.textfile", "", "File to write metrics to at the end of a run, for the node exporter textfile collector")
 	settings   = &config.Settings{}
 	cfInfos    = map[string]*CfInfo{}
+	stateStore = state.Discard
 )
 
-func getEnvVar(key string) string {
+// getEnvVar the value of the environment variable, which must be set
+func getEnvVar(key string) (string, error) {
 	value, present := os.LookupEnv(key)
 	if !present {
-		log.Fatalf("ERROR: Must set %s environment variable", key)
+		return "", fmt.Errorf("Must set %s environment variable", key)
 	}
-	return value
+	return value, nil
 }
 
-func initCfInfos() {
+// newCfInfos connect to each cf in the settings
+func newCfInfos(s *config.Settings) map[string]*CfInfo {
+	infos := map[string]*CfInfo{}
+	for _, cf := range s.Cfs {
+		infos[cf.ID] = connectCf(cf, s.UaaOrigin)
+	}
+	return infos
+}
+
+// connectCf connect to the cf. A cf that cannot be connected to is returned with Err set, so that
+// the spaces are still rotated in the other cfs.
+func connectCf(cf config.Cf, uaaOrigin string) *CfInfo {
+	cfInfo, err := NewCfInfo(cf.ID, cf.APIHref, uaaOrigin)
+	if err != nil {
+		err = fmt.Errorf("Problem connecting to cf %s: %v", cf.ID, err)
+		log.Printf("WARNING: %v", err)
+		return &CfInfo{ID: cf.ID, APIHref: cf.APIHref, UaaOrigin: uaaOrigin, Err: err}
+	}
+	return cfInfo
+}
+
+// reconnectCfs try again to connect to each cf that could not be connected to, so that one that
+// was down when torque started is rotated once it is back
+func reconnectCfs() {
 	for _, cf := range settings.Cfs {
-		newCfInfo, err := NewCfInfo(cf.ID, cf.APIHref, settings.UaaOrigin)
-		if err != nil {
-			log.Fatalln(err)
+		if cfInfo, ok := cfInfos[cf.ID]; ok && cfInfo.Err != nil {
+			cfInfos[cf.ID] = connectCf(cf, settings.UaaOrigin)
 		}
-		cfInfos[cf.ID] = newCfInfo
 	}
 }
 
-// ensureStaticCircleEnvVarsSet ensure the circle project has all the static environment variables
-// a project needs to deploy to cf. This is all the env vars except the password
-// Since we cannot read env vars from CircleCI, if they already exist we do not touch them.
-func ensureStaticCircleEnvVarsSet(circle *Circle, cfOrg string, cfSpace string, skipIDs []string, repo string) error {
-	if *verbose {
-		log.Printf("Ensuring static circle env vars exist for %s", repo)
+func initCfInfos() {
+	cfInfos = newCfInfos(settings)
+}
+
+// initSinks create the sinks of the configured repos. Repos that cannot be set up are logged, and
+// fail whenever they are used.
+func initSinks() *repoSinks {
+	sinks := newRepoSinks(settings)
+	for _, repo := range sortedErrors(sinks.failed) {
+		log.Printf("Problem setting up %s: %v", repo, sinks.failed[repo])
+	}
+	return sinks
+}
+
+// skipped whether the cf with this ID is in the space's skip list
+func skipped(id string, skipIDs []string) bool {
+	for _, skipID := range skipIDs {
+		if id == skipID {
+			return true
+		}
+	}
+	return false
+}
+
+// staticEnvVars all the static environment variables a project needs to deploy to cf.
+// This is all the env vars except the password, and except the username for the dual strategy,
+// which changes with each rotation.
+func staticEnvVars(cfOrg string, cfSpace config.CfSpace) map[string]string {
+	envVars := map[string]string{
+		"CF_ORG":   cfOrg,
+		"CF_SPACE": cfSpace.Name,
 	}
-	desiredEnvVars := map[string]string{
-		"CF_ORG":      cfOrg,
-		"CF_SPACE":    cfSpace,
-		"CF_USERNAME": cfUserName(cfOrg, cfSpace),
+	if cfSpace.Strategy == config.StrategySingle {
+		envVars["CF_USERNAME"] = cfUserName(cfOrg, cfSpace.Name)
 	}
 
 	// Add the CF_API_* env vars for each CF this repo will deploy to
 	for id, cfInfo := range cfInfos {
-		skip := false
-		for _, skipID := range skipIDs {
-			if skipID == id {
-				skip = true
-				break
+		if !skipped(id, cfSpace.SkipIDs) {
+			envVars[fmt.Sprintf("CF_API_%s", id)] = cfInfo.APIHref
+		}
+	}
+
+	return envVars
+}
+
+// ensureStaticEnvVarsSet ensure the repo has all the static environment variables
+// a project needs to deploy to cf. This is all the env vars except the password.
+// Existing ones whose masked values show they have drifted from the config are corrected.
+func ensureStaticEnvVarsSet(sinks *repoSinks, cfOrg string, cfSpace config.CfSpace, repo string) error {
+	if *verbose {
+		log.Printf("Ensuring static env vars exist for %s", repo)
+	}
+	desiredEnvVars := staticEnvVars(cfOrg, cfSpace)
+
+	err := sinks.SetStaticVars(repo, desiredEnvVars)
+	if err != nil {
+		return err
+	}
+
+	return correctDriftedStaticVars(sinks, cfSpace, repo, desiredEnvVars)
+}
+
+// rotationTarget the credentials a rotation changes: the ci user of a space in one or more cfs
+type rotationTarget struct {
+	cfIDs    []string
+	org      string
+	space    string
+	username string
+}
+
+func (t rotationTarget) String() string {
+	return fmt.Sprintf("%s %s", strings.Join(t.cfIDs, ","), t.username)
+}
+
+// stalledRotation a rotation committed to UAA that could not be pushed to every repo
+type stalledRotation struct {
+	target   rotationTarget
+	rotation *rotation
+}
+
+// rotateSpace bring each repo in the space up to date, then rotate the space's ci user in
+// each cf. Failures are recorded in the report and do not stop the rest of the space.
+func rotateSpace(sinks *repoSinks, cfOrg config.CfOrg, cfSpace config.CfSpace, report *Report) (stalled []stalledRotation) {
+	// The repos that were set up successfully. Failed repos are already in the report, so
+	// there is no point pushing passwords to them as well.
+	repos := []string{}
+	for _, repo := range repoNames(cfSpace.Repos) {
+		if err := sinks.EnsureTarget(repo); err != nil {
+			report.Fail(repo, "Problem ensuring %s was set up: %v", repo, err)
+			continue
+		}
+
+		if err := ensureStaticEnvVarsSet(sinks, cfOrg.Name, cfSpace, repo); err != nil {
+			report.Fail(repo, "Problem ensuring static env vars were set in %s: %v", repo, err)
+			continue
+		}
+
+		repos = append(repos, repo)
+		report.Repos++
+	}
+
+	if cfSpace.Strategy == config.StrategyDual {
+		return rotateDualSpace(sinks, cfOrg, cfSpace, repos, report)
+	}
+
+	// Work out which cfs are due a rotation first, so a space with nothing due does not wait for builds
+	type dueRotation struct {
+		cfInfo *CfInfo
+		user   *uaa.User
+		target rotationTarget
+	}
+	due := []dueRotation{}
+	maxAge := settings.MaxAgeFor(cfOrg, cfSpace)
+	for _, id := range sortedCfIDs() {
+		cfInfo := cfInfos[id]
+		if skipped(id, cfSpace.SkipIDs) {
+			if *verbose {
+				log.Printf("Skipping %s", id)
 			}
+			continue
 		}
-		if !skip {
-			desiredEnvVars[fmt.Sprintf("CF_API_%s", id)] = cfInfo.APIHref
+		target := rotationTarget{
+			cfIDs:    []string{id},
+			org:      cfOrg.Name,
+			space:    cfSpace.Name,
+			username: cfUserName(cfOrg.Name, cfSpace.Name),
 		}
+
+		user, err := cfInfo.ciUser(target.username, cfOrg.Name, cfSpace.Name)
+		if err != nil {
+			stalled = append(stalled, recordRotation(target, nil, err, report)...)
+			continue
+		}
+		lastModified, err := passwordLastModified(user)
+		if err != nil {
+			stalled = append(stalled, recordRotation(target, nil, err, report)...)
+			continue
+		}
+		observePasswordChanged(target, lastModified)
+		if rotationDue(target, lastModified, maxAge, report) {
+			due = append(due, dueRotation{cfInfo: cfInfo, user: user, target: target})
+		}
+	}
+	if len(due) == 0 || !waitForSpace(sinks, cfOrg, cfSpace, repos, report) {
+		return stalled
 	}
 
-	err := circle.AddEnvVarIfNotAlreadySet(repo, desiredEnvVars)
+	revocations := []revocation{}
+	for _, d := range due {
+		envVarName := fmt.Sprintf("CF_PASSWORD_%s", d.target.cfIDs[0])
+		r, err := d.cfInfo.RotateCIUserPassword(d.user, sinks, envVarName, repos)
+		stalled = append(stalled, recordRotation(d.target, r, err, report)...)
+		if r.committed && settings.RevokeTokensFor(cfSpace) {
+			revocations = append(revocations, d.cfInfo.tokenRevocation(d.user))
+		}
+	}
+	// The old password's tokens may still be in use by builds that started before the rotation
+	revokeWhenIdle(sinks, cfOrg, cfSpace, repos, revocations, report)
+	return stalled
+}
+
+// forced whether the -force flag names this space
+func forced(cfOrg string, cfSpace string) bool {
+	return *force == fmt.Sprintf("%s/%s", cfOrg, cfSpace)
+}
+
+// checkForce check the -force flag names a configured space, so a typo is not a run that rotates
+// nothing
+func checkForce(s *config.Settings) error {
+	if *force == "" {
+		return nil
+	}
+	for _, cfOrg := range s.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			if forced(cfOrg.Name, cfSpace.Name) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not a configured org/space", *force)
+}
+
+// due whether a space's password last changed at lastModified is old enough to rotate
+func due(cfOrg string, cfSpace string, lastModified time.Time, maxAge time.Duration) bool {
+	if maxAge == 0 || lastModified.IsZero() || forced(cfOrg, cfSpace) {
+		return true
+	}
+	return time.Since(lastModified) >= maxAge
+}
+
+// rotationDue whether the target's password is old enough to rotate. Passwords that are not
+// due are noted in the report.
+func rotationDue(target rotationTarget, lastModified time.Time, maxAge time.Duration, report *Report) bool {
+	if due(target.org, target.space, lastModified, maxAge) {
+		return true
+	}
+	age := time.Since(lastModified).Round(time.Minute)
+	report.Fresh = append(report.Fresh, fmt.Sprintf("%s: password is %v old, max_age is %v", target, age, maxAge))
+	return false
+}
+
+// buildRepos the repos whose builds a space waits for: those of its repos that were set up, and
+// the projects using its CircleCI context
+func buildRepos(cfSpace config.CfSpace, repos []string) []string {
+	return append(append([]string{}, repos...), repoNames(cfSpace.WaitForRepos())...)
+}
+
+// waitForSpace wait for builds in progress in the space's repos. Returns false if the space
+// should be left alone.
+func waitForSpace(sinks *repoSinks, cfOrg config.CfOrg, cfSpace config.CfSpace, repos []string, report *Report) bool {
+	space := fmt.Sprintf("%s %s", cfOrg.Name, cfSpace.Name)
+	idle, err := waitForBuilds(sinks, buildRepos(cfSpace, repos), settings.BuildWait)
 	if err != nil {
-		return err
+		report.Fail(space, "Problem checking for builds in progress: %v", err)
+		return false
+	}
+	if !idle {
+		if settings.BuildWait.OnTimeout == config.OnTimeoutSkip {
+			log.Printf("WARNING: Not rotating %s, builds still in progress after %v", space, settings.BuildWait.MaxWait)
+			report.Skipped = append(report.Skipped, fmt.Sprintf("%s: builds still in progress after %v", space, settings.BuildWait.MaxWait))
+			return false
+		}
+		log.Printf("WARNING: Rotating %s with builds still in progress after %v", space, settings.BuildWait.MaxWait)
+	}
+	return true
+}
+
+// recordRotation add the outcome of a rotation to the report. A rotation that UAA has but some
+// repos do not is returned, to be tried again at the end of the run.
+func recordRotation(target rotationTarget, r *rotation, err error, report *Report) []stalledRotation {
+	if err != nil {
+		if r != nil && r.committed {
+			if *verbose {
+				log.Printf("%s: %v", target, err)
+			}
+			return []stalledRotation{{target: target, rotation: r}}
+		}
+		report.Fail(target.String(), "Problem rotating ci user password: %v", err)
+		recordState(target, r, err, report)
+		return nil
 	}
 
+	report.Rotated = append(report.Rotated, target.String())
+	recordState(target, r, nil, report)
+	if *verbose {
+		log.Printf("Successfully rotated ci user %s", target)
+	}
 	return nil
 }
 
-func main() {
+// recoverStalledRotations give the repos left with a stale password one more go, now that the
+// rest of the run has given any transient problem time to clear.
+func recoverStalledRotations(stalled []stalledRotation, report *Report) {
+	for _, s := range stalled {
+		if *verbose {
+			log.Printf("Recovering %s, pushing its password to %s", s.target, strings.Join(s.rotation.pending, ", "))
+		}
+		err := s.rotation.publish()
+		recordState(s.target, s.rotation, err, report)
+		if err != nil {
+			report.Fail(s.target.String(), "%v", err)
+			continue
+		}
+		report.Rotated = append(report.Rotated, s.target.String())
+	}
+}
 
-	flag.Parse()
+// repoConfigs the config of each of the space's repos named, by name, for the state store
+func repoConfigs(cfOrg string, cfSpace string, names []string) map[string]config.Repo {
+	named := map[string]bool{}
+	for _, name := range names {
+		named[name] = true
+	}
+	configs := map[string]config.Repo{}
+	for _, org := range settings.Orgs {
+		for _, space := range org.Spaces {
+			if org.Name != cfOrg || space.Name != cfSpace {
+				continue
+			}
+			for _, repo := range space.Repos {
+				if named[repo.String()] {
+					configs[repo.String()] = repo
+				}
+			}
+		}
+	}
+	return configs
+}
 
-	if *verbose {
-		log.Println("started")
+// recordState save the final outcome of a rotation in the state store and the metrics
+func recordState(target rotationTarget, r *rotation, err error, report *Report) {
+	for _, id := range target.cfIDs {
+		key := state.Key{CfID: id, Org: target.org, Space: target.space}
+		entry, getErr := stateStore.Get(key)
+		if getErr != nil {
+			report.Fail(key.String(), "Problem reading state: %v", getErr)
+			continue
+		}
+		if entry == nil {
+			entry = &state.Rotation{Key: key, Repos: []string{}}
+		}
+
+		entry.Username = target.username
+		entry.LastAttempt = time.Now()
+		entry.Error = ""
+		entry.StaleRepos = nil
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		switch {
+		case r == nil || !r.committed:
+			// UAA and the repos still have whatever they had before
+			entry.Outcome = state.OutcomeFailed
+		case len(r.pending) > 0:
+			entry.Outcome = state.OutcomeStale
+			entry.LastRotated = r.committedAt
+			entry.Repos = r.published()
+			entry.StaleRepos = r.pending
+		default:
+			entry.Outcome = state.OutcomeRotated
+			entry.LastRotated = r.committedAt
+			entry.Repos = r.published()
+		}
+		if entry.Outcome != state.OutcomeFailed {
+			entry.RepoConfigs = repoConfigs(target.org, target.space, append(append([]string{}, entry.Repos...), entry.StaleRepos...))
+		}
+
+		rotationsTotal.Inc(id, target.org, target.space, entry.Outcome)
+		if entry.Outcome != state.OutcomeFailed {
+			observePasswordChanged(rotationTarget{cfIDs: []string{id}, org: target.org, space: target.space}, entry.LastRotated)
+		}
+
+		if putErr := stateStore.Put(*entry); putErr != nil {
+			report.Fail(key.String(), "Problem saving state: %v", putErr)
+		}
 	}
+}
 
-	if err := config.LoadFile(*configFile, settings); err != nil {
-		log.Fatalf("Problem loading config: %s\n", err)
+// printState print the latest rotation of every credential in the state store
+func printState() {
+	rotations, err := stateStore.List()
+	if err != nil {
+		log.Fatalf("Problem reading state: %v", err)
 	}
 
-	if *verbose {
-		log.Printf("Using config: %+v", settings)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CF\tORG\tSPACE\tUSERNAME\tLAST ROTATED\tLAST ATTEMPT\tOUTCOME\tREPOS")
+	for _, r := range rotations {
+		lastRotated := "never"
+		if !r.LastRotated.IsZero() {
+			lastRotated = r.LastRotated.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.CfID, r.Org, r.Space, r.Username,
+			lastRotated, r.LastAttempt.Format(time.RFC3339), r.Outcome, strings.Join(r.Repos, ","))
 	}
+	w.Flush()
+}
 
+// rotate the password of every configured space. Returns false if anything failed.
+func rotate() bool {
 	initCfInfos()
+	sinks := initSinks()
 
-	circleToken := getEnvVar("CIRCLE_TOKEN")
-	circle, err := NewCircle(circleToken)
-	if err != nil {
-		log.Fatalln(err)
+	if *plan {
+		p := NewPlan(sinks)
+		if err := p.Write(os.Stdout, *planFormat); err != nil {
+			log.Fatalln(err)
+		}
+		return true
 	}
-	passwordsRotated := 0
-	numberOfCircleCIRepos := 0
 
+	updateConfigMetrics()
+	report := &Report{}
+	for _, repo := range sortedErrors(sinks.failed) {
+		report.Fail(repo, "Problem setting up %s: %v", repo, sinks.failed[repo])
+	}
+	// Before rotating, while the state store still lists the repos removed from each space
+	cleanUpRepos := reposToCleanUp(report)
+	if settings.Offboard.Orphans {
+		offboardOrphans(sinks, settings.Offboard.DeleteUsers, report)
+	}
+	stalled := []stalledRotation{}
 	for _, cfOrg := range settings.Orgs {
 		for _, cfSpace := range cfOrg.Spaces {
-			for _, repo := range cfSpace.Repos {
-				if err := circle.EnsureProjectEnabled(repo); err != nil {
-					log.Fatalf("Problem ensuring %s was being built in Circle: %v", repo, err)
-				}
+			stalled = append(stalled, rotateSpace(sinks, cfOrg, cfSpace, report)...)
+		}
+	}
+	recoverStalledRotations(stalled, report)
+	// After rotating, so a password the config now names differently is published before the old
+	// one is removed
+	cleanUp(sinks, cleanUpRepos, report)
 
-				if err := ensureStaticCircleEnvVarsSet(circle, cfOrg.Name, cfSpace.Name, cfSpace.SkipIDs, repo); err != nil {
-					log.Fatalf("Problem ensuring static circle env vars were set in %s: %v", repo, err)
-				}
+	report.Write(os.Stdout)
+	if *textfile != "" {
+		if err := registry.WriteFile(*textfile); err != nil {
+			log.Printf("Problem writing metrics: %v", err)
+			return false
+		}
+	}
+	return !report.Failed()
+}
 
-				numberOfCircleCIRepos++
-			}
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "With no command, rotates the password of every configured space.\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  serve  stay running, rotating each space on its schedule\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  state  print when each credential was last rotated\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  offboard -org X -space Y | -orphans [-delete]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "         deactivate a removed space's ci users and remove its env vars from its repos\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  audit [-format table|json]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "         list ci users in UAA that no space manages, and spaces whose ci users are missing\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-			for id, cfInfo := range cfInfos {
-				skip := false
-				for _, skipID := range cfSpace.SkipIDs {
-					if id == skipID {
-						skip = true
-						break
-					}
-				}
-				if skip {
-					if *verbose {
-						log.Printf("Skipping %s", id)
-					}
-					continue
-				}
+	if *verbose {
+		log.Println("started")
+	}
 
-				newPassword, err := cfInfo.RotateCIUserPassword(cfOrg.Name, cfSpace.Name)
-				if err != nil {
-					log.Fatalf("Problem rotating ci user password %s %s: %v", cfOrg.Name, cfSpace.Name, err)
-				}
-				envVarName := fmt.Sprintf("CF_PASSWORD_%s", id)
-
-				// Set the new password for each of the repos in circleci
-				for _, repo := range cfSpace.Repos {
-					err := circle.SetEnvVar(repo, envVarName, newPassword)
-					if err != nil {
-						log.Fatalf("Error setting new password in circle for %s\n", repo)
-					}
-				}
+	if err := config.LoadFile(*configFile, settings); err != nil {
+		log.Fatalf("Problem loading config: %s\n", err)
+	}
 
-				passwordsRotated++
-				if *verbose {
-					log.Printf("Successfully rotated ci user %s %s %s", cfInfo.UaaAPI.TargetURL, cfOrg.Name, cfSpace.Name)
-				}
-			}
+	if *verbose {
+		log.Printf("Using config: %+v", settings)
+	}
+
+	var err error
+	stateStore, err = state.New(settings.State.Type, settings.State.Path)
+	if err != nil {
+		log.Fatalf("Problem loading config: %s\n", err)
+	}
+
+	if err := checkForce(settings); err != nil {
+		log.Fatalf("Problem with -force: %v", err)
+	}
+
+	ok := true
+	switch command := flag.Arg(0); command {
+	case "":
+		ok = rotate()
+	case "serve":
+		// Every scheduled run would rotate the space, whatever its max_age
+		if *force != "" {
+			log.Fatalf("-force cannot be used with serve, run torque -force once instead")
 		}
+		ok = serve()
+	case "state":
+		printState()
+	case "offboard":
+		ok = offboard(flag.Args()[1:])
+	case "audit":
+		ok = audit(flag.Args()[1:])
+	default:
+		log.Fatalf("Unknown command: %s", command)
 	}
 
-	fmt.Printf("Rotated %d ci user passwords in %d circleci repos\n", passwordsRotated, numberOfCircleCIRepos)
 	if *verbose {
 		log.Println("finished")
 	}
+	if !ok {
+		os.Exit(1)
+	}
 }
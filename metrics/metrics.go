@@ -0,0 +1,249 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the Prometheus text
+// exposition format, for scraping or for the node exporter's textfile collector
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets histogram buckets in seconds suited to API latency
+var DefaultBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry a set of metrics, written out together
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+	// beforeWrite called before the metrics are written, to update metrics that depend on the time
+	beforeWrite []func()
+}
+
+// NewRegistry an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// metric a family of series with the same name, one per set of label values
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts and sum for histograms. counts[i] is the number of observations <= buckets[i].
+	counts []uint64
+	count  uint64
+}
+
+func (r *Registry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.series = map[string]*series{}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// BeforeWrite call f each time the metrics are about to be written
+func (r *Registry) BeforeWrite(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.beforeWrite = append(r.beforeWrite, f)
+}
+
+// get the series for these label values, creating it if needed. Must hold m.mu.
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s has labels %v but was given %v", m.name, m.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter a value that only goes up
+type Counter struct{ m *metric }
+
+// NewCounter register a counter with the given label names
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{r.register(&metric{name: name, help: help, kind: "counter", labelNames: labelNames})}
+}
+
+// Inc add one to the series with these label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labelValues).value++
+}
+
+// Gauge a value that can go up and down
+type Gauge struct{ m *metric }
+
+// NewGauge register a gauge with the given label names
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{r.register(&metric{name: name, help: help, kind: "gauge", labelNames: labelNames})}
+}
+
+// Set the series with these label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).value = value
+}
+
+// Reset remove every series, e.g. before setting them all again from a new config
+func (g *Gauge) Reset() {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.series = map[string]*series{}
+}
+
+// Histogram counts observations in buckets
+type Histogram struct{ m *metric }
+
+// NewHistogram register a histogram with the given upper bounds and label names
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{r.register(&metric{name: name, help: help, kind: "histogram", buckets: buckets, labelNames: labelNames})}
+}
+
+// Observe add an observation to the series with these label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labelValues)
+	for i, bound := range h.m.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Write every metric in the text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	beforeWrite := append([]func(){}, r.beforeWrite...)
+	metrics := append([]*metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, f := range beforeWrite {
+		f()
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, strings.Replace(m.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := []string{}
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels(m.labelNames, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labels(m.labelNames, s.labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labels(m.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels(m.labelNames, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels(m.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// labels format label pairs, with an optional extra pair such as a histogram's le
+func labels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extraName, strconv.Quote(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the metrics, for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := r.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WriteFile write the metrics to path for the textfile collector. The file is replaced in one
+// go, so the collector never reads half of it.
+func (r *Registry) WriteFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := r.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,76 @@
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/govau/torque/metrics"
+)
+
+func Test_Registry_Write_TextFormat(t *testing.T) {
+	r := metrics.NewRegistry()
+	rotations := r.NewCounter("test_rotations_total", "Rotations.", "space", "outcome")
+	age := r.NewGauge("test_age_seconds", "Age.")
+	latency := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "api")
+
+	rotations.Inc("dev", "rotated")
+	rotations.Inc("dev", "rotated")
+	rotations.Inc("prod", "failed")
+	r.BeforeWrite(func() { age.Set(42) })
+	latency.Observe(0.05, "uaa")
+	latency.Observe(0.5, "uaa")
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	want := `# HELP test_age_seconds Age.
+# TYPE test_age_seconds gauge
+test_age_seconds 42
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{api="uaa",le="0.1"} 1
+test_latency_seconds_bucket{api="uaa",le="1"} 2
+test_latency_seconds_bucket{api="uaa",le="+Inf"} 2
+test_latency_seconds_sum{api="uaa"} 0.55
+test_latency_seconds_count{api="uaa"} 2
+# HELP test_rotations_total Rotations.
+# TYPE test_rotations_total counter
+test_rotations_total{space="dev",outcome="rotated"} 2
+test_rotations_total{space="prod",outcome="failed"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Write() expected:\n%s\nbut was:\n%s", want, got)
+	}
+}
+
+func Test_Registry_WriteFile_ReplacesFile(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewGauge("test_gauge", "Gauge.").Set(1)
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "torque.prom")
+
+	for i := 0; i < 2; i++ {
+		if err := r.WriteFile(path); err != nil {
+			t.Fatalf("WriteFile() error: %v", err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if !bytes.Contains(b, []byte("test_gauge 1\n")) {
+		t.Errorf("WriteFile() expected the gauge in the file, got:\n%s", b)
+	}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	if len(files) != 1 {
+		t.Errorf("WriteFile() expected no temporary files left behind, got %v", files)
+	}
+}
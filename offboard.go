@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/govau/torque/config"
+	"github.com/govau/torque/state"
+)
+
+// spaceKey identifies a space by its org's name and its name
+type spaceKey struct {
+	org   string
+	space string
+}
+
+func (k spaceKey) String() string {
+	return fmt.Sprintf("%s/%s", k.org, k.space)
+}
+
+// configured whether the space is in the config
+func (k spaceKey) configured() bool {
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			if cfOrg.Name == k.org && cfSpace.Name == k.space {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// offboardUsernames every ci user the space can have, whichever strategy it used
+func offboardUsernames(key spaceKey) []string {
+	usernames := []string{cfUserName(key.org, key.space)}
+	for _, side := range dualSides {
+		usernames = append(usernames, dualUserName(key.org, key.space, side))
+	}
+	return usernames
+}
+
+// orphanedSpaces the spaces the state store has rotated that are no longer in the config, and
+// have not been offboarded
+func orphanedSpaces() ([]spaceKey, error) {
+	rotations, err := stateStore.List()
+	if err != nil {
+		return nil, err
+	}
+	orphaned := map[spaceKey]bool{}
+	for _, rotation := range rotations {
+		key := spaceKey{rotation.Org, rotation.Space}
+		if rotation.Outcome != state.OutcomeOffboarded && !key.configured() {
+			orphaned[key] = true
+		}
+	}
+	keys := []spaceKey{}
+	for key := range orphaned {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys, nil
+}
+
+// offboardOrphans offboard every orphaned space
+func offboardOrphans(sinks *repoSinks, deleteUsers bool, report *Report) {
+	keys, err := orphanedSpaces()
+	if err != nil {
+		report.Fail("state", "Problem finding orphaned spaces: %v", err)
+		return
+	}
+	for _, key := range keys {
+		log.Printf("Offboarding %s, which is no longer in the config", key)
+		offboardSpace(sinks, key, deleteUsers, report)
+	}
+}
+
+// offboardSpace retire a space: its ci users in every cf lose the SpaceDeveloper role and are
+// deactivated, or deleted, and its env vars are removed from its repos. Once nothing has failed,
+// the state store records the space as offboarded.
+func offboardSpace(sinks *repoSinks, key spaceKey, deleteUsers bool, report *Report) {
+	failures := len(report.Failures)
+	for _, id := range sortedCfIDs() {
+		offboardUsers(cfInfos[id], key, deleteUsers, report)
+	}
+	offboardRepos(sinks, key, report)
+	if len(report.Failures) > failures {
+		return
+	}
+
+	for _, id := range sortedCfIDs() {
+		stateKey := state.Key{CfID: id, Org: key.org, Space: key.space}
+		entry, err := stateStore.Get(stateKey)
+		if err != nil {
+			report.Fail(stateKey.String(), "Problem reading state: %v", err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		entry.LastAttempt = time.Now()
+		entry.Outcome = state.OutcomeOffboarded
+		entry.Error = ""
+		entry.Repos = []string{}
+		entry.StaleRepos = nil
+		if err := stateStore.Put(*entry); err != nil {
+			report.Fail(stateKey.String(), "Problem saving state: %v", err)
+		}
+	}
+}
+
+// offboardUsers take the SpaceDeveloper role away from each of the space's ci users in the cf,
+// then deactivate or delete them
+func offboardUsers(cfInfo *CfInfo, key spaceKey, deleteUsers bool, report *Report) {
+	target := fmt.Sprintf("%s %s", cfInfo.ID, key)
+	if cfInfo.Err != nil {
+		report.Fail(target, "%v", cfInfo.Err)
+		return
+	}
+
+	// A space that is already gone has no roles left to take away
+	spaceGUID := ""
+	orgGUID, err := cfInfo.CC.OrgGUID(key.org)
+	if err == nil {
+		spaceGUID, err = cfInfo.CC.SpaceGUID(orgGUID, key.space)
+	}
+	if _, ok := err.(*ccNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		report.Fail(target, "Problem finding space: %v", err)
+		return
+	}
+
+	for _, username := range offboardUsernames(key) {
+		user, err := cfInfo.FindCIUser(username)
+		if err != nil {
+			report.Fail(target, "%v", err)
+			continue
+		}
+		if user == nil {
+			continue
+		}
+		if spaceGUID != "" {
+			if err := cfInfo.CC.RemoveSpaceRole(roleSpaceDeveloper, user.ID, spaceGUID); err != nil {
+				report.Fail(target, "Problem removing %s from %s: %v", username, key, err)
+				continue
+			}
+		}
+		if deleteUsers {
+			_, err = cfInfo.UaaAPI.DeleteUser(user.ID)
+		} else {
+			version := 0
+			if user.Meta != nil {
+				version = user.Meta.Version
+			}
+			err = cfInfo.UaaAPI.DeactivateUser(user.ID, version)
+		}
+		if err != nil {
+			report.Fail(target, "Problem offboarding %s: %v", username, err)
+			continue
+		}
+		outcome := "deactivated"
+		if deleteUsers {
+			outcome = "deleted"
+		}
+		report.Offboarded = append(report.Offboarded, fmt.Sprintf("%s %s %s", cfInfo.ID, username, outcome))
+	}
+}
+
+// offboardRepos remove the space's env vars from every repo that had them: those in the config,
+// and those the state store says were given its password. Env vars another space still sets in
+// the same repo are left.
+func offboardRepos(sinks *repoSinks, key spaceKey, report *Report) {
+	repos := map[string]config.Repo{}
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			if cfOrg.Name == key.org && cfSpace.Name == key.space {
+				for _, repo := range cfSpace.Repos {
+					repos[repo.String()] = repo
+				}
+			}
+		}
+	}
+	rotations, err := stateStore.List()
+	if err != nil {
+		report.Fail(key.String(), "Problem reading state: %v", err)
+		return
+	}
+	for _, rotation := range rotations {
+		if rotation.Org != key.org || rotation.Space != key.space {
+			continue
+		}
+		for _, list := range [][]string{rotation.Repos, rotation.StaleRepos} {
+			for _, repo := range list {
+				if _, ok := repos[repo]; !ok {
+					repos[repo] = stateRepo(rotation, repo)
+				}
+			}
+		}
+	}
+
+	wanted := wantedEnvVars(key)
+	for _, repo := range sortedReposOf(repos) {
+		if err := sinks.adopt(repos[repo]); err != nil {
+			report.Fail(repo, "Problem offboarding %s from %s: %v", key, repo, err)
+			continue
+		}
+		names, err := unwantedIn(sinks, repo, wanted[repo], false)
+		if err != nil {
+			report.Fail(repo, "Problem offboarding %s from %s: %v", key, repo, err)
+			continue
+		}
+		for _, name := range names {
+			if err := sinks.Delete(repo, name); err != nil {
+				report.Fail(repo, "Problem removing %s from %s: %v", name, repo, err)
+				continue
+			}
+			report.Removed = append(report.Removed, fmt.Sprintf("%s %s", repo, name))
+		}
+	}
+}
+
+// offboard the offboard command, which retires the space named by its flags, or every orphaned
+// space. Returns false if anything failed.
+func offboard(args []string) bool {
+	flags := flag.NewFlagSet("offboard", flag.ExitOnError)
+	org := flags.String("org", "", "Org of the space to offboard")
+	space := flags.String("space", "", "Space to offboard")
+	orphans := flags.Bool("orphans", false, "Offboard every space the state store has that is no longer in the config")
+	deleteUsers := flags.Bool("delete", settings.Offboard.DeleteUsers, "Delete the ci users rather than deactivating them")
+	flags.Parse(args)
+
+	keys := []spaceKey{}
+	switch {
+	case *orphans && *org == "" && *space == "":
+	case !*orphans && *org != "" && *space != "":
+		keys = append(keys, spaceKey{*org, *space})
+	default:
+		fmt.Fprintf(os.Stderr, "offboard needs either -org and -space, or -orphans\n")
+		flags.Usage()
+		return false
+	}
+
+	initCfInfos()
+	sinks := initSinks()
+	report := &Report{}
+	if *orphans {
+		offboardOrphans(sinks, *deleteUsers, report)
+	}
+	for _, key := range keys {
+		if key.configured() {
+			log.Printf("WARNING: %s is still in the config, remove it or the next run will rotate it again", key)
+		}
+		offboardSpace(sinks, key, *deleteUsers, report)
+	}
+
+	report.Write(os.Stdout)
+	return !report.Failed()
+}
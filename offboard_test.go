@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/govau/torque/config"
+	"github.com/govau/torque/state"
+)
+
+func Test_OffboardRepos_LeavesEnvVarsOtherSpacesSet(t *testing.T) {
+	defer func(s *config.Settings, c map[string]*CfInfo, st state.Store) {
+		settings, cfInfos, stateStore = s, c, st
+	}(settings, cfInfos, stateStore)
+	settings = &config.Settings{
+		Orgs: []config.CfOrg{{
+			Name: "org",
+			Spaces: []config.CfSpace{{
+				Name:     "kept",
+				Strategy: config.StrategySingle,
+				Repos:    []config.Repo{{Name: "govau/shared", Sink: config.SinkCircleCI}},
+			}},
+		}},
+	}
+	cfInfos = map[string]*CfInfo{"A": {ID: "A", APIHref: "https://api.a.example.com"}}
+	stateStore = listStore{
+		{Key: state.Key{CfID: "A", Org: "org", Space: "gone"}, Repos: []string{"govau/shared", "govau/only"}},
+		{Key: state.Key{CfID: "A", Org: "org", Space: "kept"}, Repos: []string{"govau/shared"}},
+		{Key: state.Key{CfID: "A", Org: "org", Space: "done"}, Outcome: state.OutcomeOffboarded},
+	}
+
+	orphaned, err := orphanedSpaces()
+	if err != nil {
+		t.Fatalf("orphanedSpaces() error: %v", err)
+	}
+	if len(orphaned) != 1 || orphaned[0] != (spaceKey{"org", "gone"}) {
+		t.Fatalf("orphanedSpaces() expected only org/gone, got %v", orphaned)
+	}
+
+	sink := newFakeSink()
+	sink.envVars["govau/shared"] = map[string]string{"CF_ORG": "org", "CF_SPACE": "kept", "CF_PASSWORD_A": "kept"}
+	sink.envVars["govau/only"] = map[string]string{"CF_ORG": "org", "CF_SPACE": "gone", "CF_PASSWORD_A": "gone", "NPM_TOKEN": "theirs"}
+	sinks := &repoSinks{
+		settings: settings,
+		repos:    map[string]config.Repo{"govau/shared": settings.Orgs[0].Spaces[0].Repos[0]},
+		sinks:    map[string]SecretSink{config.SinkCircleCI: sink},
+	}
+
+	report := &Report{}
+	offboardRepos(sinks, orphaned[0], report)
+	if report.Failed() {
+		t.Fatalf("offboardRepos() failed: %v", report.Failures)
+	}
+	if len(sink.envVars["govau/shared"]) != 3 {
+		t.Errorf("offboardRepos() expected the env vars org/kept sets to be left, got %v", sink.envVars["govau/shared"])
+	}
+	if got := sink.envVars["govau/only"]; len(got) != 1 || got["NPM_TOKEN"] != "theirs" {
+		t.Errorf("offboardRepos() expected only env vars torque does not set to be left, got %v", got)
+	}
+}
+
+// configuredSink a fakeSink noting the config of each repo it is given
+type configuredSink struct {
+	*fakeSink
+	configs map[string]config.Repo
+}
+
+func (c configuredSink) ConfigureRepo(repo config.Repo) error {
+	c.configs[repo.Name] = repo
+	return nil
+}
+
+func Test_OffboardRepos_RemovedGitLabGroup_KeepsGroup(t *testing.T) {
+	defer func(s *config.Settings, c map[string]*CfInfo, st state.Store) {
+		settings, cfInfos, stateStore = s, c, st
+	}(settings, cfInfos, stateStore)
+	settings = &config.Settings{}
+	cfInfos = map[string]*CfInfo{"A": {ID: "A", APIHref: "https://api.a.example.com"}}
+	group := config.Repo{Name: "team", Sink: config.SinkGitLab, Group: true}
+	stateStore = listStore{{
+		Key:         state.Key{CfID: "A", Org: "org", Space: "gone"},
+		Repos:       []string{group.String()},
+		RepoConfigs: map[string]config.Repo{group.String(): group},
+	}}
+
+	sink := configuredSink{fakeSink: newFakeSink(), configs: map[string]config.Repo{}}
+	sink.envVars["team"] = map[string]string{"CF_PASSWORD_A": "gone"}
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkGitLab: sink}}
+
+	report := &Report{}
+	offboardRepos(sinks, spaceKey{"org", "gone"}, report)
+	if report.Failed() {
+		t.Fatalf("offboardRepos() failed: %v", report.Failures)
+	}
+	if !sink.configs["team"].Group {
+		t.Errorf("offboardRepos() expected team to be configured as a group, got %+v", sink.configs["team"])
+	}
+	if len(sink.envVars["team"]) != 0 {
+		t.Errorf("offboardRepos() expected CF_PASSWORD_A to be removed from the group, got %v", sink.envVars["team"])
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// PlannedEnvVar an environment variable a run would write to a repo
+type PlannedEnvVar struct {
+	Repo  string `json:"repo"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// PlannedDrift a static env var whose value in a repo no longer matches the config
+type PlannedDrift struct {
+	Repo  string `json:"repo"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Masked the value the sink has, masked by it
+	Masked string `json:"masked"`
+	// Correct whether a run would rewrite it, which it does unless static_vars is add-only
+	Correct bool `json:"correct"`
+}
+
+// PlannedRemoval an env var torque set in a repo that the config no longer implies
+type PlannedRemoval struct {
+	Repo string `json:"repo"`
+	Name string `json:"name"`
+	// Remove whether a run would remove it, which it does if cleanup is enabled
+	Remove bool `json:"remove"`
+}
+
+// PlannedUser a ci user a run would create in UAA
+type PlannedUser struct {
+	CfID     string `json:"cf_id"`
+	Username string `json:"username"`
+	UaaHref  string `json:"uaa_href"`
+}
+
+// PlannedRotation a UAA user whose password a run would rotate
+type PlannedRotation struct {
+	CfID     string   `json:"cf_id"`
+	Username string   `json:"username"`
+	UaaHref  string   `json:"uaa_href"`
+	Repos    []string `json:"repos"`
+	// LastRotated when UAA says the password last changed
+	LastRotated time.Time `json:"last_rotated"`
+}
+
+// Plan the changes a run would make. It is built by reading from UAA and the sinks, and never
+// writes to any of them.
+type Plan struct {
+	ProjectsToEnable  []string          `json:"projects_to_enable"`
+	EnvVarsToAdd      []PlannedEnvVar   `json:"env_vars_to_add"`
+	UsersToCreate     []PlannedUser     `json:"users_to_create"`
+	PasswordsToRotate []PlannedRotation `json:"passwords_to_rotate"`
+	EnvVarsToReplace  []PlannedEnvVar   `json:"env_vars_to_replace"`
+	// EnvVarsDrifted static env vars that no longer match the config
+	EnvVarsDrifted []PlannedDrift `json:"env_vars_drifted"`
+	// EnvVarsToRemove env vars the config no longer implies
+	EnvVarsToRemove []PlannedRemoval `json:"env_vars_to_remove"`
+	// PasswordsNotDue passwords younger than their max_age, which are left alone
+	PasswordsNotDue []PlannedRotation `json:"passwords_not_due"`
+	// Problems that would make the real run fail
+	Problems []string `json:"problems"`
+}
+
+// NewPlan walks the configured orgs, spaces and repos and works out what a run would change
+func NewPlan(sinks *repoSinks) *Plan {
+	p := &Plan{
+		ProjectsToEnable:  []string{},
+		EnvVarsToAdd:      []PlannedEnvVar{},
+		UsersToCreate:     []PlannedUser{},
+		PasswordsToRotate: []PlannedRotation{},
+		EnvVarsToReplace:  []PlannedEnvVar{},
+		EnvVarsDrifted:    []PlannedDrift{},
+		EnvVarsToRemove:   []PlannedRemoval{},
+		PasswordsNotDue:   []PlannedRotation{},
+		Problems:          []string{},
+	}
+
+	p.planCleanup(sinks)
+
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			// The names of the env vars already set in each repo
+			existing := map[string]map[string]bool{}
+
+			repos := repoNames(cfSpace.Repos)
+			for _, repo := range repos {
+				if *verbose {
+					log.Printf("Planning changes for %s", repo)
+				}
+				names, ok := p.planRepo(sinks, repo)
+				if !ok {
+					continue
+				}
+				existing[repo] = names
+
+				desiredEnvVars := staticEnvVars(cfOrg.Name, cfSpace)
+				for _, name := range sortedKeys(desiredEnvVars) {
+					if !names[name] {
+						p.EnvVarsToAdd = append(p.EnvVarsToAdd, PlannedEnvVar{Repo: repo, Name: name, Value: desiredEnvVars[name]})
+					}
+				}
+				if len(names) > 0 {
+					p.planDrift(sinks, cfSpace, repo, desiredEnvVars)
+				}
+			}
+
+			maxAge := settings.MaxAgeFor(cfOrg, cfSpace)
+			username := cfUserName(cfOrg.Name, cfSpace.Name)
+			side := ""
+			if cfSpace.Strategy == config.StrategyDual {
+				var activeModified time.Time
+				var err error
+				side, activeModified, err = inactiveSide(cfOrg.Name, cfSpace.Name, rotatedCfIDs(cfSpace))
+				if err != nil {
+					p.problem("Problem finding the inactive ci user %s %s: %v", cfOrg.Name, cfSpace.Name, err)
+					continue
+				}
+				if !due(cfOrg.Name, cfSpace.Name, activeModified, maxAge) {
+					p.PasswordsNotDue = append(p.PasswordsNotDue, PlannedRotation{
+						CfID:        strings.Join(rotatedCfIDs(cfSpace), ","),
+						Username:    cfUserName(cfOrg.Name, cfSpace.Name) + "-*",
+						Repos:       repos,
+						LastRotated: activeModified,
+					})
+					continue
+				}
+				username = dualUserName(cfOrg.Name, cfSpace.Name, side)
+				for _, repo := range repos {
+					names, ok := existing[repo]
+					if !ok {
+						continue
+					}
+					envVar := PlannedEnvVar{Repo: repo, Name: "CF_USERNAME", Value: username}
+					if names[envVar.Name] {
+						p.EnvVarsToReplace = append(p.EnvVarsToReplace, envVar)
+					} else {
+						p.EnvVarsToAdd = append(p.EnvVarsToAdd, envVar)
+					}
+				}
+			}
+
+			for _, id := range rotatedCfIDs(cfSpace) {
+				cfInfo := cfInfos[id]
+
+				user, err := cfInfo.FindCIUser(username)
+				if err != nil {
+					p.problem("Problem rotating ci user password %s %s %s: %v", id, cfOrg.Name, cfSpace.Name, err)
+					continue
+				}
+				lastModified, err := passwordLastModified(user)
+				if err != nil {
+					p.problem("%v", err)
+					continue
+				}
+				planned := PlannedRotation{
+					CfID:        id,
+					Username:    username,
+					UaaHref:     cfInfo.UaaAPI.TargetURL.String(),
+					Repos:       repos,
+					LastRotated: lastModified,
+				}
+				// A dual strategy space was already found to be due
+				if cfSpace.Strategy == config.StrategySingle && !due(cfOrg.Name, cfSpace.Name, lastModified, maxAge) {
+					p.PasswordsNotDue = append(p.PasswordsNotDue, planned)
+					continue
+				}
+				if user == nil {
+					if !settings.CreateUsers {
+						p.problem("User %s does not exist in UAA %s, and create_users is not set", username, id)
+						continue
+					}
+					p.UsersToCreate = append(p.UsersToCreate, PlannedUser{
+						CfID:     id,
+						Username: username,
+						UaaHref:  cfInfo.UaaAPI.TargetURL.String(),
+					})
+				}
+				p.PasswordsToRotate = append(p.PasswordsToRotate, planned)
+
+				envVarName := fmt.Sprintf("CF_PASSWORD_%s", id)
+				if cfSpace.Strategy == config.StrategyDual {
+					envVarName = dualPasswordEnvVar(side, id)
+				}
+				for _, repo := range repos {
+					names, ok := existing[repo]
+					if !ok {
+						// Already reported as a problem
+						continue
+					}
+					envVar := PlannedEnvVar{Repo: repo, Name: envVarName}
+					if names[envVarName] {
+						p.EnvVarsToReplace = append(p.EnvVarsToReplace, envVar)
+					} else {
+						p.EnvVarsToAdd = append(p.EnvVarsToAdd, envVar)
+					}
+				}
+			}
+		}
+	}
+
+	return p
+}
+
+// planRepo records whether the repo needs enabling, and returns the names of the env vars it has.
+// Returns false if a run would fail for the repo, which is recorded as a problem.
+func (p *Plan) planRepo(sinks *repoSinks, repo string) (map[string]bool, bool) {
+	enabled, err := sinks.TargetReady(repo)
+	if err != nil {
+		p.problem("Problem reading %s: %v", repo, err)
+		return nil, false
+	}
+	if !enabled {
+		if !sinks.CreatesTarget(repo) {
+			problem := fmt.Sprintf("%s is not set up, and a run cannot set it up, so it would fail until it is set up by hand", repo)
+			if manual := sinks.ManualSetup(repo); manual != "" {
+				problem += ": " + manual
+			}
+			p.problem("%s", problem)
+			return nil, false
+		}
+		// There is nothing to read from a target that does not exist yet
+		p.ProjectsToEnable = append(p.ProjectsToEnable, repo)
+		return map[string]bool{}, true
+	}
+	names, err := sinks.SecretNames(repo)
+	if err != nil {
+		p.problem("Problem reading %s: %v", repo, err)
+		return nil, false
+	}
+	return names, true
+}
+
+// planDrift records the repo's static env vars that have drifted from the config
+func (p *Plan) planDrift(sinks *repoSinks, cfSpace config.CfSpace, repo string, desiredEnvVars map[string]string) {
+	drifted, err := driftedStaticVars(sinks, repo, desiredEnvVars)
+	if err != nil {
+		p.problem("Problem reading the values of %s: %v", repo, err)
+		return
+	}
+	for _, name := range sortedKeys(drifted) {
+		p.EnvVarsDrifted = append(p.EnvVarsDrifted, PlannedDrift{
+			Repo:    repo,
+			Name:    name,
+			Value:   desiredEnvVars[name],
+			Masked:  drifted[name],
+			Correct: settings.StaticVarsFor(cfSpace) == config.StaticVarsEnforce,
+		})
+	}
+}
+
+// planCleanup records the env vars the config no longer implies
+func (p *Plan) planCleanup(sinks *repoSinks) {
+	repos := configuredRepos()
+	removed, err := removedRepos()
+	if err != nil {
+		p.problem("Problem reading state: %v", err)
+	}
+	// A run publishes the passwords before cleaning up, so those they replace are listed too
+	unwanted, failed := unwantedEnvVars(sinks, append(repos, removed...), false)
+	for _, repo := range sortedErrors(failed) {
+		p.problem("Problem finding env vars to clean up in %s: %v", repo, failed[repo])
+	}
+	for _, repo := range sortedRepos(unwanted) {
+		for _, name := range unwanted[repo] {
+			p.EnvVarsToRemove = append(p.EnvVarsToRemove, PlannedRemoval{Repo: repo, Name: name, Remove: settings.Cleanup.Enabled})
+		}
+	}
+}
+
+func (p *Plan) problem(format string, args ...interface{}) {
+	p.Problems = append(p.Problems, fmt.Sprintf(format, args...))
+}
+
+// Write the plan in the given format, either "text" or "json"
+func (p *Plan) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	case "text":
+		return p.writeText(w)
+	default:
+		return fmt.Errorf("Unknown plan format: %s", format)
+	}
+}
+
+func (p *Plan) writeText(w io.Writer) error {
+	lines := []string{}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	add("Plan: %d projects to enable, %d env vars to add, %d users to create, %d passwords to rotate, %d env vars to replace, %d env vars drifted, %d env vars no longer in the config",
+		len(p.ProjectsToEnable), len(p.EnvVarsToAdd), len(p.UsersToCreate), len(p.PasswordsToRotate), len(p.EnvVarsToReplace), len(p.EnvVarsDrifted), len(p.EnvVarsToRemove))
+
+	if len(p.ProjectsToEnable) > 0 {
+		add("\nProjects to enable:")
+		for _, repo := range p.ProjectsToEnable {
+			add("  + %s", repo)
+		}
+	}
+	if len(p.EnvVarsToAdd) > 0 {
+		add("\nEnv vars to add:")
+		for _, envVar := range p.EnvVarsToAdd {
+			if envVar.Value == "" {
+				add("  + %s %s=(new password)", envVar.Repo, envVar.Name)
+			} else {
+				add("  + %s %s=%s", envVar.Repo, envVar.Name, envVar.Value)
+			}
+		}
+	}
+	if len(p.UsersToCreate) > 0 {
+		add("\nUsers to create in UAA, with the SpaceDeveloper role:")
+		for _, user := range p.UsersToCreate {
+			add("  + %s %s (%s)", user.CfID, user.Username, user.UaaHref)
+		}
+	}
+	if len(p.PasswordsToRotate) > 0 {
+		add("\nPasswords to rotate in UAA:")
+		for _, rotation := range p.PasswordsToRotate {
+			add("  ~ %s %s (%s)", rotation.CfID, rotation.Username, rotation.UaaHref)
+		}
+	}
+	if len(p.EnvVarsToReplace) > 0 {
+		add("\nEnv vars to replace:")
+		for _, envVar := range p.EnvVarsToReplace {
+			if envVar.Value == "" {
+				add("  ~ %s %s=(new password)", envVar.Repo, envVar.Name)
+			} else {
+				add("  ~ %s %s=%s", envVar.Repo, envVar.Name, envVar.Value)
+			}
+		}
+	}
+	if len(p.EnvVarsDrifted) > 0 {
+		add("\nEnv vars that have drifted from the config:")
+		for _, drift := range p.EnvVarsDrifted {
+			if drift.Correct {
+				add("  ~ %s %s=%s (was %s)", drift.Repo, drift.Name, drift.Value, drift.Masked)
+			} else {
+				add("  ! %s %s is %s, not %s, left alone as static_vars is %s", drift.Repo, drift.Name, drift.Masked, drift.Value, config.StaticVarsAddOnly)
+			}
+		}
+	}
+	if len(p.EnvVarsToRemove) > 0 {
+		add("\nEnv vars the config no longer sets:")
+		for _, removal := range p.EnvVarsToRemove {
+			if removal.Remove {
+				add("  - %s %s", removal.Repo, removal.Name)
+			} else {
+				add("    %s %s, left alone as cleanup is not enabled", removal.Repo, removal.Name)
+			}
+		}
+	}
+	if len(p.PasswordsNotDue) > 0 {
+		add("\nPasswords younger than their max_age, left alone:")
+		for _, rotation := range p.PasswordsNotDue {
+			add("    %s %s (last rotated %s)", rotation.CfID, rotation.Username, rotation.LastRotated.Format(time.RFC3339))
+		}
+	}
+	if len(p.Problems) > 0 {
+		add("\nProblems:")
+		for _, problem := range p.Problems {
+			add("  ! %s", problem)
+		}
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedCfIDs the IDs of the configured cfs in a stable order
+func sortedCfIDs() []string {
+	ids := []string{}
+	for id := range cfInfos {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// planFixture a cf and sink for NewPlan: org/space is due, org/fresh is not, org/nouser's ci user
+// does not exist and govau/missing is not set up in its sink
+func planFixture(t *testing.T) (*fakeCf, *fakeSink, *repoSinks) {
+	fake := newFakeCf()
+	fake.addUser("ci-org-space", time.Time{})
+	fake.addUser("ci-org-fresh", time.Now().Add(-time.Hour))
+	cfInfos["A"] = fake.connect(t, "A")
+
+	sink := newFakeSink("govau/a", "govau/b", "govau/c")
+	sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkCircleCI: sink}}
+	for _, cfSpace := range settings.Orgs[0].Spaces {
+		for _, repo := range cfSpace.Repos {
+			sinks.repos[repo.String()] = repo
+		}
+	}
+	return fake, sink, sinks
+}
+
+const planYaml = `
+  cfs:
+  - id: A
+    api_href: https://api.a.example.com
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      repos: [govau/a, govau/missing]
+    - name: fresh
+      max_age: 24h
+      repos: [govau/b]
+    - name: nouser
+      repos: [govau/c]
+  `
+
+func Test_NewPlan_ListsChangesWithoutMakingThem(t *testing.T) {
+	defer useSettings(t, planYaml)()
+	fake, sink, sinks := planFixture(t)
+	defer fake.server.Close()
+
+	p := NewPlan(sinks)
+
+	if len(p.PasswordsToRotate) != 1 || p.PasswordsToRotate[0].Username != "ci-org-space" || p.PasswordsToRotate[0].UaaHref != fake.server.URL {
+		t.Errorf("NewPlan() expected to rotate A ci-org-space, got %+v", p.PasswordsToRotate)
+	}
+	if len(p.PasswordsNotDue) != 1 || p.PasswordsNotDue[0].Username != "ci-org-fresh" {
+		t.Errorf("NewPlan() expected A ci-org-fresh not to be due, got %+v", p.PasswordsNotDue)
+	}
+	added := map[PlannedEnvVar]bool{}
+	for _, envVar := range p.EnvVarsToAdd {
+		added[envVar] = true
+	}
+	for _, want := range []PlannedEnvVar{
+		{Repo: "govau/a", Name: "CF_ORG", Value: "org"},
+		{Repo: "govau/a", Name: "CF_USERNAME", Value: "ci-org-space"},
+		{Repo: "govau/a", Name: "CF_API_A", Value: fake.server.URL},
+		{Repo: "govau/a", Name: "CF_PASSWORD_A"},
+	} {
+		if !added[want] {
+			t.Errorf("NewPlan() expected to add %+v, got %+v", want, p.EnvVarsToAdd)
+		}
+	}
+	for _, envVar := range p.EnvVarsToAdd {
+		if envVar.Repo == "govau/missing" {
+			t.Errorf("NewPlan() expected nothing to be added to govau/missing, got %+v", envVar)
+		}
+	}
+	if len(p.EnvVarsToRemove) != 3 || p.EnvVarsToRemove[0].Name != "CF_PASSWORD_TEST" || p.EnvVarsToRemove[0].Remove {
+		t.Errorf("NewPlan() expected CF_PASSWORD_TEST to be left in each repo as cleanup is off, got %+v", p.EnvVarsToRemove)
+	}
+	if len(p.ProjectsToEnable) != 0 {
+		t.Errorf("NewPlan() expected no projects to enable, as circleci cannot enable them, got %v", p.ProjectsToEnable)
+	}
+
+	if len(p.Problems) != 2 {
+		t.Fatalf("NewPlan() expected 2 problems, got %v", p.Problems)
+	}
+	if !strings.HasPrefix(p.Problems[0], "govau/missing is not set up") {
+		t.Errorf("NewPlan() expected govau/missing to be a problem, got %q", p.Problems[0])
+	}
+	if !strings.Contains(p.Problems[1], "User ci-org-nouser does not exist") {
+		t.Errorf("NewPlan() expected ci-org-nouser to be a problem, got %q", p.Problems[1])
+	}
+
+	if len(sink.written) != 0 {
+		t.Errorf("NewPlan() expected nothing to be written to the sink, got %v", sink.written)
+	}
+	if len(fake.passwords) != 0 || len(fake.users) != 2 {
+		t.Errorf("NewPlan() expected nothing to change in UAA, got passwords for %v", fake.passwords)
+	}
+}
+
+func Test_Plan_Write(t *testing.T) {
+	defer useSettings(t, planYaml)()
+	fake, _, sinks := planFixture(t)
+	defer fake.server.Close()
+	p := NewPlan(sinks)
+
+	text := &bytes.Buffer{}
+	if err := p.Write(text, "text"); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	for _, want := range []string{
+		"Plan: 0 projects to enable, 13 env vars to add, 0 users to create, 1 passwords to rotate",
+		"  + govau/a CF_PASSWORD_A=(new password)\n",
+		"  ~ A ci-org-space (" + fake.server.URL + ")\n",
+		"    A ci-org-fresh (last rotated ",
+		"    govau/a CF_PASSWORD_TEST, left alone as cleanup is not enabled\n",
+		"Problems:\n  ! govau/missing is not set up",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("Write() expected the text plan to contain %q, got:\n%s", want, text)
+		}
+	}
+
+	encoded := &bytes.Buffer{}
+	if err := p.Write(encoded, "json"); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	decoded := &Plan{}
+	if err := json.Unmarshal(encoded.Bytes(), decoded); err != nil {
+		t.Fatalf("Write() wrote invalid json: %v", err)
+	}
+	if len(decoded.PasswordsToRotate) != 1 || len(decoded.Problems) != 2 || len(decoded.EnvVarsToAdd) != len(p.EnvVarsToAdd) {
+		t.Errorf("Write() expected the json plan to match, got %+v", decoded)
+	}
+
+	if err := p.Write(&bytes.Buffer{}, "yaml"); err == nil {
+		t.Error("Write() expected an error for an unknown format")
+	}
+}
+
+// creatingSink a fakeSink whose EnsureTarget creates targets, as a CircleCI context's does
+type creatingSink struct {
+	*fakeSink
+}
+
+func (c creatingSink) CreatesTargets() {}
+
+func Test_NewPlan_TargetASinkCreates_IsToEnable(t *testing.T) {
+	defer useSettings(t, planYaml)()
+	fake, sink, sinks := planFixture(t)
+	defer fake.server.Close()
+	sinks.sinks[config.SinkCircleCI] = creatingSink{sink}
+
+	p := NewPlan(sinks)
+	if len(p.ProjectsToEnable) != 1 || p.ProjectsToEnable[0] != "govau/missing" {
+		t.Errorf("NewPlan() expected govau/missing to be enabled, got %v", p.ProjectsToEnable)
+	}
+	for _, problem := range p.Problems {
+		if strings.Contains(problem, "govau/missing") {
+			t.Errorf("NewPlan() expected govau/missing not to be a problem, got %q", problem)
+		}
+	}
+}
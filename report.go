@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Failure something that went wrong for a single repo or space. The run carries on after one.
+type Failure struct {
+	// Target the repo, or cf ID, org and space, that failed
+	Target string
+	Err    error
+}
+
+// Report the outcome of a run
+type Report struct {
+	// Rotated the ci users whose passwords were rotated and pushed to every repo
+	Rotated []string
+	// Skipped the spaces that were deliberately left alone, and why
+	Skipped []string
+	// Fresh the passwords left alone because they are younger than their max_age
+	Fresh []string
+	// Offboarded the ci users of offboarded spaces, as cf ID, username and what was done
+	Offboarded []string
+	// Revoked the ci users whose tokens were revoked after their password was rotated, as cf ID
+	// and username
+	Revoked []string
+	// Removed the env vars cleaned up from repos, as repo then name
+	Removed []string
+	// Repos the number of repos that were brought up to date
+	Repos    int
+	Failures []Failure
+}
+
+// Fail records a failure against the given target
+func (r *Report) Fail(target string, format string, args ...interface{}) {
+	r.Failures = append(r.Failures, Failure{Target: target, Err: fmt.Errorf(format, args...)})
+}
+
+// Failed whether anything in the run failed
+func (r *Report) Failed() bool {
+	return len(r.Failures) > 0
+}
+
+// Write a summary of the successes and failures
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Rotated %d ci user passwords in %d repos\n", len(r.Rotated), r.Repos)
+	for _, rotated := range r.Rotated {
+		fmt.Fprintf(w, "  ok     %s\n", rotated)
+	}
+	for _, skipped := range r.Skipped {
+		fmt.Fprintf(w, "  SKIP   %s\n", skipped)
+	}
+	if len(r.Revoked) > 0 {
+		fmt.Fprintf(w, "Revoked the tokens of %d ci users\n", len(r.Revoked))
+		for _, revoked := range r.Revoked {
+			fmt.Fprintf(w, "  revoke %s\n", revoked)
+		}
+	}
+	if len(r.Offboarded) > 0 {
+		fmt.Fprintf(w, "Offboarded %d ci users\n", len(r.Offboarded))
+		for _, offboarded := range r.Offboarded {
+			fmt.Fprintf(w, "  off    %s\n", offboarded)
+		}
+	}
+	if len(r.Removed) > 0 {
+		fmt.Fprintf(w, "Removed %d env vars the config no longer sets\n", len(r.Removed))
+		for _, removed := range r.Removed {
+			fmt.Fprintf(w, "  rm     %s\n", removed)
+		}
+	}
+	if len(r.Fresh) > 0 {
+		fmt.Fprintf(w, "%d passwords younger than their max_age were left alone\n", len(r.Fresh))
+		if *verbose {
+			for _, fresh := range r.Fresh {
+				fmt.Fprintf(w, "  fresh  %s\n", fresh)
+			}
+		}
+	}
+
+	if !r.Failed() {
+		return
+	}
+	fmt.Fprintf(w, "%d failures\n", len(r.Failures))
+	for _, failure := range r.Failures {
+		fmt.Fprintf(w, "  FAILED %s: %v\n", failure.Target, failure.Err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/govau/torque/config"
+)
+
+// tokenRevoker revokes every UAA token of a user. Satisfied by *CfInfo.
+type tokenRevoker interface {
+	RevokeTokens(userID string) error
+}
+
+// revocation the tokens of a rotated ci user
+type revocation struct {
+	revoker tokenRevoker
+	// target the cf ID and username, for the report
+	target string
+	userID string
+}
+
+// revokeTokens revoke the tokens of each user, adding the outcomes to the report. A revocation
+// that fails is not tried again, as the user's next rotation will revoke its tokens anyway.
+func revokeTokens(revocations []revocation, report *Report) {
+	for _, r := range revocations {
+		if err := r.revoker.RevokeTokens(r.userID); err != nil {
+			report.Fail(r.target, "Problem revoking tokens: %v", err)
+			continue
+		}
+		report.Revoked = append(report.Revoked, r.target)
+		if *verbose {
+			log.Printf("Revoked the tokens of %s", r.target)
+		}
+	}
+}
+
+// revokeWhenIdle revoke the tokens of the space's rotated ci users once none of its repos has a
+// build in progress, so that builds that logged in with the old password are not cut off. If
+// builds are still in progress after max_wait, the tokens are left until the next rotation.
+func revokeWhenIdle(sinks *repoSinks, cfOrg config.CfOrg, cfSpace config.CfSpace, repos []string, revocations []revocation, report *Report) {
+	if len(revocations) == 0 {
+		return
+	}
+	space := fmt.Sprintf("%s %s", cfOrg.Name, cfSpace.Name)
+	idle, err := waitForBuilds(sinks, buildRepos(cfSpace, repos), settings.BuildWait)
+	if err != nil {
+		report.Fail(space, "Problem checking for builds in progress, not revoking tokens: %v", err)
+		return
+	}
+	if !idle {
+		log.Printf("WARNING: Not revoking the tokens of %s, builds still in progress after %v", space, settings.BuildWait.MaxWait)
+		report.Skipped = append(report.Skipped, fmt.Sprintf("%s: tokens not revoked, builds still in progress after %v", space, settings.BuildWait.MaxWait))
+		return
+	}
+	revokeTokens(revocations, report)
+}
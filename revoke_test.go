@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	uaa "github.com/cloudfoundry-community/go-uaa"
+	"github.com/govau/torque/config"
+)
+
+// fakeRevoker records the users whose tokens it revoked, failing for the user in fail
+type fakeRevoker struct {
+	revoked []string
+	fail    string
+}
+
+func (f *fakeRevoker) RevokeTokens(userID string) error {
+	if userID == f.fail {
+		return errors.New("insufficient scope")
+	}
+	f.revoked = append(f.revoked, userID)
+	return nil
+}
+
+func Test_RevokeTokens_ReportsEachOutcome(t *testing.T) {
+	revoker := &fakeRevoker{fail: "broken"}
+	report := &Report{}
+	revokeTokens([]revocation{
+		{revoker: revoker, target: "A ci-org-space", userID: "space"},
+		{revoker: revoker, target: "A ci-org-broken", userID: "broken"},
+	}, report)
+
+	if len(revoker.revoked) != 1 || revoker.revoked[0] != "space" {
+		t.Errorf("revokeTokens() expected the tokens of space to be revoked, got %v", revoker.revoked)
+	}
+	if len(report.Revoked) != 1 || len(report.Failures) != 1 || report.Failures[0].Target != "A ci-org-broken" {
+		t.Errorf("revokeTokens() expected one revoked and one failure, got %v, %v", report.Revoked, report.Failures)
+	}
+}
+
+// buildingSink a fakeSink where each secret set starts builds in the repo, one of which finishes
+// each check
+type buildingSink struct {
+	*fakeSink
+	builds  fakeBuilds
+	started int
+}
+
+func (b buildingSink) SetSecret(orgAndRepo string, name string, value string) error {
+	b.builds[orgAndRepo] = b.started
+	return b.fakeSink.SetSecret(orgAndRepo, name, value)
+}
+
+func (b buildingSink) BuildsInProgress(orgAndRepo string) (int, error) {
+	return b.builds.BuildsInProgress(orgAndRepo)
+}
+
+func Test_RotateSpace_RevokesTokensOnceBuildsFinish(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		started     int
+		wantRevoked bool
+	}{
+		{name: "builds finish", started: 3, wantRevoked: true},
+		{name: "builds still in progress", started: 1000000, wantRevoked: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer useSettings(t, `
+  revoke_tokens:
+    enabled: true
+  build_wait:
+    poll_interval: 1ms
+    max_wait: 50ms
+  cfs:
+  - id: A
+    api_href: https://api.a.example.com
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      repos: [govau/a]
+  `)()
+			fake := newFakeCf()
+			defer fake.server.Close()
+			fake.addUser("ci-org-space", time.Time{})
+			cfInfos["A"] = fake.connect(t, "A")
+
+			sink := buildingSink{fakeSink: newFakeSink("govau/a"), builds: fakeBuilds{}, started: test.started}
+			sinks := &repoSinks{settings: settings, repos: map[string]config.Repo{}, sinks: map[string]SecretSink{config.SinkCircleCI: sink}}
+			sinks.repos["govau/a"] = settings.Orgs[0].Spaces[0].Repos[0]
+
+			report := &Report{}
+			rotateSpace(sinks, settings.Orgs[0], settings.Orgs[0].Spaces[0], report)
+			if len(report.Rotated) != 1 || report.Failed() {
+				t.Fatalf("rotateSpace() expected the space to be rotated, got %v %v", report.Rotated, report.Failures)
+			}
+
+			if !test.wantRevoked {
+				if len(fake.revoked) != 0 || len(report.Revoked) != 0 {
+					t.Errorf("rotateSpace() expected no tokens to be revoked with builds in progress, got %v", fake.revoked)
+				}
+				if len(report.Skipped) != 1 {
+					t.Errorf("rotateSpace() expected the revocation to be reported as skipped, got %v", report.Skipped)
+				}
+				return
+			}
+			if len(fake.revoked) != 1 || fake.revoked[0] != "id-ci-org-space" {
+				t.Errorf("rotateSpace() expected the tokens of ci-org-space to be revoked, got %v", fake.revoked)
+			}
+			if sink.builds["govau/a"] != 0 {
+				t.Errorf("rotateSpace() expected the tokens to be revoked after the builds finished, %d still running", sink.builds["govau/a"])
+			}
+			if want := []string{"A ci-org-space"}; !reflect.DeepEqual(report.Revoked, want) {
+				t.Errorf("rotateSpace() expected %v in the report, got %v", want, report.Revoked)
+			}
+		})
+	}
+}
+
+func Test_CfInfo_RevokeTokens(t *testing.T) {
+	revoked := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		revoked = r.URL.Path
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL + "/uaa")
+	cf := &CfInfo{ID: "A", UaaAPI: &uaa.API{TargetURL: target, AuthenticatedClient: http.DefaultClient}}
+	if err := cf.RevokeTokens("user-id"); err != nil {
+		t.Fatalf("RevokeTokens() error: %v", err)
+	}
+	if revoked != "/uaa/oauth/token/revoke/user/user-id" {
+		t.Errorf("RevokeTokens() expected the user's tokens to be revoked, got %s", revoked)
+	}
+}
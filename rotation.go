@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// passwordSetter changes the password of a UAA user. Satisfied by *uaa.API.
+type passwordSetter interface {
+	SetPassword(password string, oldPassword string, userID string) error
+}
+
+// envVarSink somewhere the new password is pushed to. Satisfied by any SecretSink.
+type envVarSink interface {
+	SecretNames(target string) (map[string]bool, error)
+	SetSecret(target string, name string, value string) error
+}
+
+// credential a new password for one UAA user, and the env var it is pushed to
+type credential struct {
+	uaa        passwordSetter
+	userID     string
+	envVarName string
+	password   string
+}
+
+// rotation a staged change of ci user passwords.
+//
+// We can never read the current password back out of CircleCI and most other sinks, so once UAA has the new
+// password there is no previous state to restore. Instead the rotation is staged so that
+// anything likely to fail does so before UAA is touched:
+//
+//  1. prepare: generate the passwords and check every repo can be read
+//  2. commit: set the passwords in UAA
+//  3. publish: push the passwords, then any envVars, to every repo, retrying each repo that fails
+//
+// Repos still failing after the retries are left in pending, and publish can be called again
+// later in the run to bring them back in line with UAA.
+type rotation struct {
+	credentials []*credential
+	// envVars published to each repo after the passwords, e.g. CF_USERNAME when switching users
+	envVars    map[string]string
+	repos      []string
+	sink       envVarSink
+	retries    int
+	retryDelay time.Duration
+
+	committed   bool
+	committedAt time.Time
+	// pending the repos that do not have the committed passwords yet
+	pending []string
+}
+
+// newRotation stage a rotation out to the given repos. Add the users to rotate with addCredential.
+func newRotation(sink envVarSink, repos []string) *rotation {
+	return &rotation{
+		repos:      repos,
+		sink:       sink,
+		retries:    *settings.Retries,
+		retryDelay: settings.RetryDelay,
+	}
+}
+
+// addCredential rotate this user's password, and push it to envVarName
+func (r *rotation) addCredential(uaa passwordSetter, userID string, envVarName string) {
+	r.credentials = append(r.credentials, &credential{uaa: uaa, userID: userID, envVarName: envVarName})
+}
+
+// name the env vars this rotation sets, to identify it in errors
+func (r *rotation) name() string {
+	names := []string{}
+	for _, c := range r.credentials {
+		names = append(names, c.envVarName)
+	}
+	return strings.Join(names, ", ")
+}
+
+// run the whole rotation. If an error is returned and committed is false, no repo has changed.
+func (r *rotation) run() error {
+	if err := r.prepare(); err != nil {
+		return err
+	}
+	if err := r.commit(); err != nil {
+		return err
+	}
+	return r.publish()
+}
+
+func (r *rotation) prepare() error {
+	for _, c := range r.credentials {
+		c.password = generateNewPassword()
+	}
+
+	for _, repo := range r.repos {
+		if _, err := r.sink.SecretNames(repo); err != nil {
+			return fmt.Errorf("Not rotating, unable to read env vars from %s: %v", repo, err)
+		}
+	}
+	return nil
+}
+
+// commit set every password in UAA. If one fails, those already set are left changed but
+// have not been published anywhere.
+func (r *rotation) commit() error {
+	for _, c := range r.credentials {
+		if err := c.uaa.SetPassword(c.password, "", c.userID); err != nil {
+			return fmt.Errorf("Error changing password: %v", err)
+		}
+	}
+	r.committed = true
+	r.committedAt = time.Now()
+	r.pending = append([]string{}, r.repos...)
+
+	if *verbose {
+		log.Printf("Set password succeeded")
+	}
+	return nil
+}
+
+// published the repos that have the committed passwords
+func (r *rotation) published() []string {
+	repos := []string{}
+	for _, repo := range r.repos {
+		pending := false
+		for _, p := range r.pending {
+			if p == repo {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
+
+// publish push the committed passwords to every pending repo
+func (r *rotation) publish() error {
+	if !r.committed {
+		return fmt.Errorf("Password for %s has not been committed to UAA", r.name())
+	}
+
+	stillPending := []string{}
+	errs := []string{}
+	for _, repo := range r.pending {
+		if err := r.publishTo(repo); err != nil {
+			stillPending = append(stillPending, repo)
+			errs = append(errs, fmt.Sprintf("%s: %v", repo, err))
+		}
+	}
+	r.pending = stillPending
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error setting new password %s, these repos have a stale password: %s", r.name(), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *rotation) publishTo(repo string) error {
+	for _, c := range r.credentials {
+		if err := r.setEnvVar(repo, c.envVarName, c.password); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(r.envVars) {
+		if err := r.setEnvVar(repo, name, r.envVars[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rotation) setEnvVar(repo string, name string, value string) error {
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			if *verbose {
+				log.Printf("Retrying setting %s in %s after: %v", name, repo, err)
+			}
+			time.Sleep(r.retryDelay)
+		}
+		if err = r.sink.SetSecret(repo, name, value); err == nil {
+			return nil
+		}
+	}
+	return err
+}
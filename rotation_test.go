@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeUAA records the passwords set on it, and fails if told to
+type fakeUAA struct {
+	password string
+	fail     bool
+}
+
+func (f *fakeUAA) SetPassword(password string, oldPassword string, userID string) error {
+	if f.fail {
+		return errors.New("uaa is down")
+	}
+	f.password = password
+	return nil
+}
+
+// fakeSink holds the env vars of each repo. Repos in unreadable cannot be listed, and a repo in
+// failures fails that many writes before succeeding.
+type fakeSink struct {
+	envVars    map[string]map[string]string
+	unreadable map[string]bool
+	failures   map[string]int
+	// written the names of the secrets set in each repo, in order
+	written map[string][]string
+}
+
+func newFakeSink(repos ...string) *fakeSink {
+	f := &fakeSink{
+		envVars:    map[string]map[string]string{},
+		unreadable: map[string]bool{},
+		failures:   map[string]int{},
+		written:    map[string][]string{},
+	}
+	for _, repo := range repos {
+		f.envVars[repo] = map[string]string{"CF_PASSWORD_TEST": "old"}
+	}
+	return f
+}
+
+func (f *fakeSink) SecretNames(orgAndRepo string) (map[string]bool, error) {
+	if f.unreadable[orgAndRepo] {
+		return nil, errors.New("project not found")
+	}
+	names := map[string]bool{}
+	for name := range f.envVars[orgAndRepo] {
+		names[name] = true
+	}
+	return names, nil
+}
+
+func (f *fakeSink) SetSecret(orgAndRepo string, name string, value string) error {
+	if f.failures[orgAndRepo] > 0 {
+		f.failures[orgAndRepo]--
+		return errors.New("circle is down")
+	}
+	f.envVars[orgAndRepo][name] = value
+	f.written[orgAndRepo] = append(f.written[orgAndRepo], name)
+	return nil
+}
+
+func (f *fakeSink) EnsureTarget(orgAndRepo string) error {
+	if _, ok := f.envVars[orgAndRepo]; !ok {
+		f.envVars[orgAndRepo] = map[string]string{}
+	}
+	return nil
+}
+
+func (f *fakeSink) TargetReady(orgAndRepo string) (bool, error) {
+	_, ok := f.envVars[orgAndRepo]
+	return ok, nil
+}
+
+func (f *fakeSink) SetStaticVars(orgAndRepo string, vars map[string]string) error {
+	for name, value := range vars {
+		if _, ok := f.envVars[orgAndRepo][name]; !ok {
+			f.envVars[orgAndRepo][name] = value
+		}
+	}
+	return nil
+}
+
+func (f *fakeSink) Delete(orgAndRepo string, name string) error {
+	delete(f.envVars[orgAndRepo], name)
+	return nil
+}
+
+func testRotation(uaa *fakeUAA, sink *fakeSink, retries int, repos ...string) *rotation {
+	r := &rotation{
+		repos:   repos,
+		sink:    sink,
+		retries: retries,
+	}
+	r.addCredential(uaa, "user-id", "CF_PASSWORD_TEST")
+	return r
+}
+
+func assertConsistent(t *testing.T, uaa *fakeUAA, sink *fakeSink, repos ...string) {
+	t.Helper()
+	for _, repo := range repos {
+		if got := sink.envVars[repo]["CF_PASSWORD_TEST"]; got != uaa.password {
+			t.Errorf("%s has password %q but uaa has %q", repo, got, uaa.password)
+		}
+	}
+}
+
+func Test_Rotation_AllReposSucceed_IsConsistent(t *testing.T) {
+	uaa := &fakeUAA{password: "old"}
+	sink := newFakeSink("govau/a", "govau/b", "govau/c")
+	r := testRotation(uaa, sink, 0, "govau/a", "govau/b", "govau/c")
+
+	if err := r.run(); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if uaa.password == "old" {
+		t.Error("run() expected uaa password to change")
+	}
+	assertConsistent(t, uaa, sink, "govau/a", "govau/b", "govau/c")
+}
+
+func Test_Rotation_UnreadableRepo_LeavesUAAUntouched(t *testing.T) {
+	uaa := &fakeUAA{password: "old"}
+	sink := newFakeSink("govau/a", "govau/b", "govau/c")
+	sink.unreadable["govau/b"] = true
+	r := testRotation(uaa, sink, 0, "govau/a", "govau/b", "govau/c")
+
+	if err := r.run(); err == nil {
+		t.Fatal("run() expected an error for an unreadable repo")
+	}
+	if r.committed {
+		t.Error("run() expected rotation not to be committed")
+	}
+	assertConsistent(t, uaa, sink, "govau/a", "govau/b", "govau/c")
+}
+
+func Test_Rotation_UAAFails_LeavesReposUntouched(t *testing.T) {
+	uaa := &fakeUAA{password: "old", fail: true}
+	sink := newFakeSink("govau/a", "govau/b")
+	r := testRotation(uaa, sink, 0, "govau/a", "govau/b")
+
+	if err := r.run(); err == nil {
+		t.Fatal("run() expected an error when uaa fails")
+	}
+	assertConsistent(t, uaa, sink, "govau/a", "govau/b")
+}
+
+func Test_Rotation_TransientRepoFailure_IsRetried(t *testing.T) {
+	uaa := &fakeUAA{password: "old"}
+	sink := newFakeSink("govau/a", "govau/b", "govau/c")
+	sink.failures["govau/b"] = 2
+	r := testRotation(uaa, sink, 2, "govau/a", "govau/b", "govau/c")
+
+	if err := r.run(); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	assertConsistent(t, uaa, sink, "govau/a", "govau/b", "govau/c")
+}
+
+func Test_Rotation_PersistentRepoFailure_IsRecoveredLater(t *testing.T) {
+	uaa := &fakeUAA{password: "old"}
+	sink := newFakeSink("govau/a", "govau/b", "govau/c")
+	sink.failures["govau/b"] = 2
+	r := testRotation(uaa, sink, 1, "govau/a", "govau/b", "govau/c")
+
+	if err := r.run(); err == nil {
+		t.Fatal("run() expected an error when a repo keeps failing")
+	}
+	if !r.committed {
+		t.Fatal("run() expected rotation to be committed")
+	}
+	if len(r.pending) != 1 || r.pending[0] != "govau/b" {
+		t.Fatalf("run() expected only govau/b to be pending, got %v", r.pending)
+	}
+	assertConsistent(t, uaa, sink, "govau/a", "govau/c")
+
+	// The rest of the run happens, then the stalled rotation is tried again
+	report := &Report{}
+	target := rotationTarget{cfIDs: []string{"TEST"}, org: "org", space: "space", username: "ci-org-space"}
+	recoverStalledRotations([]stalledRotation{{target: target, rotation: r}}, report)
+	if report.Failed() {
+		t.Fatalf("recoverStalledRotations() failed: %v", report.Failures)
+	}
+	if len(report.Rotated) != 1 {
+		t.Errorf("recoverStalledRotations() expected 1 rotation in report, got %d", len(report.Rotated))
+	}
+	assertConsistent(t, uaa, sink, "govau/a", "govau/b", "govau/c")
+}
+
+func Test_Rotation_DualUAAFails_LeavesReposUntouched(t *testing.T) {
+	staging := &fakeUAA{password: "old"}
+	prod := &fakeUAA{password: "old", fail: true}
+	sink := newFakeSink("govau/a")
+	sink.envVars["govau/a"]["CF_USERNAME"] = "ci-org-space-a"
+	r := &rotation{repos: []string{"govau/a"}, sink: sink, envVars: map[string]string{"CF_USERNAME": "ci-org-space-b"}}
+	r.addCredential(staging, "b-staging", "CF_PASSWORD_TEST")
+	r.addCredential(prod, "b-prod", "CF_PASSWORD_PROD")
+
+	if err := r.run(); err == nil {
+		t.Fatal("run() expected an error when one uaa fails")
+	}
+	if got := sink.envVars["govau/a"]["CF_USERNAME"]; got != "ci-org-space-a" {
+		t.Errorf("run() expected CF_USERNAME to be left alone, got %s", got)
+	}
+	if got := sink.envVars["govau/a"]["CF_PASSWORD_TEST"]; got != "old" {
+		t.Errorf("run() expected CF_PASSWORD_TEST to be left alone, got %s", got)
+	}
+}
+
+func Test_Rotation_Dual_SwitchesUsername(t *testing.T) {
+	staging := &fakeUAA{password: "old"}
+	prod := &fakeUAA{password: "old"}
+	sink := newFakeSink("govau/a", "govau/b")
+	r := &rotation{repos: []string{"govau/a", "govau/b"}, sink: sink, envVars: map[string]string{"CF_USERNAME": "ci-org-space-b"}}
+	r.addCredential(staging, "b-staging", "CF_PASSWORD_TEST")
+	r.addCredential(prod, "b-prod", "CF_PASSWORD_PROD")
+
+	if err := r.run(); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	for _, repo := range []string{"govau/a", "govau/b"} {
+		envVars := sink.envVars[repo]
+		if envVars["CF_USERNAME"] != "ci-org-space-b" || envVars["CF_PASSWORD_TEST"] != staging.password || envVars["CF_PASSWORD_PROD"] != prod.password {
+			t.Errorf("%s was not switched to the new user: %v", repo, envVars)
+		}
+	}
+}
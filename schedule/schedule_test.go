@@ -0,0 +1,52 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/govau/torque/schedule"
+)
+
+func Test_Parse_Next(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2019, time.March, 13, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@every 90m", from.Add(90 * time.Minute)},
+		{"@daily", time.Date(2019, time.March, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 6 * * *", time.Date(2019, time.March, 14, 6, 0, 0, 0, time.UTC)},
+		{"45 10 * * *", time.Date(2019, time.March, 13, 10, 45, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2019, time.March, 13, 10, 40, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2019, time.March, 13, 13, 0, 0, 0, time.UTC)},
+		{"0 6 * * 1,5", time.Date(2019, time.March, 15, 6, 0, 0, 0, time.UTC)},
+		{"0 6 * * 7", time.Date(2019, time.March, 17, 6, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2019, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are given
+		{"0 0 20 * 5", time.Date(2019, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			s, err := schedule.Parse(test.spec)
+			if err != nil {
+				t.Fatalf("Parse() error: %v", err)
+			}
+			if got := s.Next(from); !got.Equal(test.want) {
+				t.Errorf("Next() expected %v but was %v", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_Parse_BadSpec_ReturnsError(t *testing.T) {
+	for _, spec := range []string{"", "@yearly", "@every soon", "@every 1s", "0 6 * *", "60 * * * *", "0 0 0 * *", "5-1 * * * *", "*/0 * * * *"} {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := schedule.Parse(spec); err == nil {
+				t.Errorf("Parse() expected an error for %q", spec)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/govau/torque/config"
+	"github.com/govau/torque/schedule"
+	"github.com/govau/torque/state"
+)
+
+// jitter source of the random delay added to scheduled runs
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// scheduledSpace a space torque serve rotates, and when it next does
+type scheduledSpace struct {
+	org   config.CfOrg
+	space config.CfSpace
+	spec  string
+	// next the next time to rotate the space. Zero if its schedule never comes round.
+	next time.Time
+}
+
+func (s *scheduledSpace) key() string {
+	return s.org.Name + "/" + s.space.Name
+}
+
+// nextRun the next time after now that the schedule comes round, plus a random jitter
+func nextRun(spec string, now time.Time) time.Time {
+	sched, err := schedule.Parse(spec)
+	if err != nil {
+		// Already checked when the config was loaded
+		log.Printf("Problem parsing schedule: %v", err)
+		return time.Time{}
+	}
+	next := sched.Next(now)
+	if next.IsZero() || settings.Serve.Jitter == 0 {
+		return next
+	}
+	return next.Add(time.Duration(jitter.Int63n(int64(settings.Serve.Jitter))))
+}
+
+// scheduleSpaces work out when to next rotate each configured space. Spaces whose schedule is
+// the same as in previous keep their time, so that reloading the config does not keep putting
+// off an @every schedule.
+func scheduleSpaces(previous map[string]*scheduledSpace, now time.Time) map[string]*scheduledSpace {
+	spaces := map[string]*scheduledSpace{}
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			s := &scheduledSpace{org: cfOrg, space: cfSpace, spec: settings.ScheduleFor(cfOrg, cfSpace)}
+			if p, ok := previous[s.key()]; ok && p.spec == s.spec {
+				s.next = p.next
+			} else {
+				s.next = nextRun(s.spec, now)
+			}
+			if *verbose {
+				log.Printf("Scheduled %s (%s) for %s", s.key(), s.spec, s.next.Format(time.RFC3339))
+			}
+			spaces[s.key()] = s
+		}
+	}
+	return spaces
+}
+
+// untilNext how long until the next space is due
+func untilNext(spaces map[string]*scheduledSpace, now time.Time) time.Duration {
+	// Wake up once a day regardless, it costs nothing
+	wait := 24 * time.Hour
+	for _, s := range spaces {
+		if !s.next.IsZero() && s.next.Sub(now) < wait {
+			wait = s.next.Sub(now)
+		}
+	}
+	return wait
+}
+
+// runDueSpaces rotate every space whose time has come, as one run with one report
+func runDueSpaces(sinks *repoSinks, spaces map[string]*scheduledSpace, now time.Time) {
+	keys := []string{}
+	for key, s := range spaces {
+		if !s.next.IsZero() && !s.next.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	reconnectCfs()
+
+	report := &Report{}
+	stalled := []stalledRotation{}
+	rotated := []config.Repo{}
+	for _, key := range keys {
+		s := spaces[key]
+		stalled = append(stalled, rotateSpace(sinks, s.org, s.space, report)...)
+		rotated = append(rotated, s.space.Repos...)
+		s.next = nextRun(s.spec, now)
+	}
+	recoverStalledRotations(stalled, report)
+	// The passwords cleanUpNow left until their replacements were published
+	cleanUp(sinks, rotated, report)
+	report.Write(os.Stdout)
+}
+
+// cleanUpNow clean up the env vars the config no longer implies, and offboard orphaned spaces if
+// set to, which only change when the config does. Anything removed or failed is reported.
+func cleanUpNow(sinks *repoSinks) {
+	report := &Report{}
+	cleanUp(sinks, reposToCleanUp(report), report)
+	if settings.Offboard.Orphans {
+		offboardOrphans(sinks, settings.Offboard.DeleteUsers, report)
+	}
+	if len(report.Removed) > 0 || len(report.Offboarded) > 0 || report.Failed() {
+		report.Write(os.Stdout)
+	}
+}
+
+// configModTime when the config file last changed, zero if it cannot be read
+func configModTime() time.Time {
+	info, err := os.Stat(*configFile)
+	if err != nil {
+		log.Printf("Problem checking config file: %v", err)
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig load the config file again, returning the sinks for its repos. If it is invalid,
+// the current config is kept and nil is returned.
+func reloadConfig() *repoSinks {
+	newSettings := &config.Settings{}
+	if err := config.LoadFile(*configFile, newSettings); err != nil {
+		log.Printf("Problem reloading config, keeping the previous config: %v", err)
+		return nil
+	}
+	newCfInfos := newCfInfos(newSettings)
+	newStateStore, err := state.New(newSettings.State.Type, newSettings.State.Path)
+	if err != nil {
+		log.Printf("Problem reloading config, keeping the previous config: %v", err)
+		return nil
+	}
+	newSinks := newRepoSinks(newSettings)
+	if failed := sortedErrors(newSinks.failed); len(failed) > 0 {
+		log.Printf("Problem reloading config, keeping the previous config: %v", newSinks.failed[failed[0]])
+		return nil
+	}
+
+	settings, cfInfos, stateStore = newSettings, newCfInfos, newStateStore
+	log.Printf("Reloaded config from %s", *configFile)
+	return newSinks
+}
+
+// serve stay running, rotating each space on its schedule and reloading the config file when it
+// changes, until interrupted. A run in progress when interrupted is finished first.
+func serve() bool {
+	initCfInfos()
+	sinks := initSinks()
+
+	modified := configModTime()
+	cleanUpNow(sinks)
+	spaces := scheduleSpaces(nil, time.Now())
+	updateConfigMetrics()
+	metricsErrs, err := serveMetrics(*listenAddr)
+	if err != nil {
+		log.Printf("Problem serving metrics on %s: %v", *listenAddr, err)
+		return false
+	}
+
+	poll := time.NewTicker(settings.Serve.ConfigPollInterval)
+	defer func() { poll.Stop() }()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	log.Printf("Serving %d spaces", len(spaces))
+	for {
+		timer := time.NewTimer(untilNext(spaces, time.Now()))
+		select {
+		case <-timer.C:
+			runDueSpaces(sinks, spaces, time.Now())
+		case <-poll.C:
+			timer.Stop()
+			if m := configModTime(); !m.Equal(modified) {
+				modified = m
+				if newSinks := reloadConfig(); newSinks != nil {
+					sinks = newSinks
+					cleanUpNow(sinks)
+					spaces = scheduleSpaces(spaces, time.Now())
+					updateConfigMetrics()
+					poll.Stop()
+					poll = time.NewTicker(settings.Serve.ConfigPollInterval)
+				}
+			}
+		case err := <-metricsErrs:
+			timer.Stop()
+			log.Printf("Problem serving metrics on %s: %v", *listenAddr, err)
+			return false
+		case sig := <-stop:
+			timer.Stop()
+			log.Printf("Received %v, stopping", sig)
+			return true
+		}
+	}
+}
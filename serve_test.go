@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+func Test_ScheduleSpaces_Reload_KeepsUnchangedSchedules(t *testing.T) {
+	defer func(s *config.Settings) { settings = s }(settings)
+	settings = &config.Settings{
+		Serve: config.Serve{Schedule: "@every 1h"},
+		Orgs: []config.CfOrg{{
+			Name:   "org",
+			Spaces: []config.CfSpace{{Name: "same"}, {Name: "changed"}},
+		}},
+	}
+	start := time.Date(2019, time.March, 13, 10, 0, 0, 0, time.UTC)
+	spaces := scheduleSpaces(nil, start)
+	if got := spaces["org/same"].next; !got.Equal(start.Add(time.Hour)) {
+		t.Fatalf("scheduleSpaces() expected org/same at %v but was %v", start.Add(time.Hour), got)
+	}
+
+	settings.Orgs[0].Spaces[1].Schedule = "@every 2h"
+	settings.Orgs[0].Spaces = append(settings.Orgs[0].Spaces, config.CfSpace{Name: "new"})
+	reloaded := start.Add(30 * time.Minute)
+	spaces = scheduleSpaces(spaces, reloaded)
+	for key, want := range map[string]time.Time{
+		"org/same":    start.Add(time.Hour),
+		"org/changed": reloaded.Add(2 * time.Hour),
+		"org/new":     reloaded.Add(time.Hour),
+	} {
+		if got := spaces[key].next; !got.Equal(want) {
+			t.Errorf("scheduleSpaces() expected %s at %v but was %v", key, want, got)
+		}
+	}
+	if got := untilNext(spaces, reloaded); got != 30*time.Minute {
+		t.Errorf("untilNext() expected 30m but was %v", got)
+	}
+}
+
+func Test_ReloadConfig_KeepsConfigWhenASinkCannotBeCreated(t *testing.T) {
+	defer useSettings(t, "")()
+	previous := settings
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer github.Close()
+
+	file, err := ioutil.TempFile("", "torque-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprintf(file, `
+github:
+  api_url: %s
+orgs:
+- name: org
+  spaces:
+  - name: space
+    repos:
+    - name: govau/a
+      sink: github
+`, github.URL)
+	file.Close()
+	defer func(f string) { *configFile = f }(*configFile)
+	*configFile = file.Name()
+	os.Unsetenv("GITHUB_TOKEN")
+
+	if sinks := reloadConfig(); sinks != nil {
+		t.Errorf("reloadConfig() expected no sinks without GITHUB_TOKEN, got %v", sinks)
+	}
+	if settings != previous {
+		t.Error("reloadConfig() expected the previous config to be kept")
+	}
+
+	os.Setenv("GITHUB_TOKEN", "token")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	if sinks := reloadConfig(); sinks == nil || settings == previous {
+		t.Error("reloadConfig() expected the new config once GITHUB_TOKEN is set")
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// SecretSink somewhere a space's credentials are delivered to, such as a CI system. A target is
+// whatever the sink delivers to, e.g. org/repo for a CircleCI project.
+type SecretSink interface {
+	// EnsureTarget set up the target to receive secrets, e.g. start building a CircleCI project
+	EnsureTarget(target string) error
+	// TargetReady whether the target is already set up, without changing anything
+	TargetReady(target string) (bool, error)
+	// SecretNames the names of the secrets and static vars set on the target
+	SecretNames(target string) (map[string]bool, error)
+	// SetSecret set a secret on the target, replacing any existing value
+	SetSecret(target string, name string, value string) error
+	// SetStaticVars set each of these vars that is not already set on the target
+	SetStaticVars(target string, vars map[string]string) error
+	// Delete a secret or static var from the target
+	Delete(target string, name string) error
+}
+
+// repoConfigurer a sink that needs more of each repo's config than its name
+type repoConfigurer interface {
+	ConfigureRepo(repo config.Repo) error
+}
+
+// targetCreator a sink whose EnsureTarget creates a target that is not ready yet, e.g. a CircleCI
+// context. In any other sink, a target that is not ready has to be set up by hand first.
+type targetCreator interface {
+	CreatesTargets()
+}
+
+// manualSetup a sink whose targets have to be set up by hand, that can say how
+type manualSetup interface {
+	ManualSetup() string
+}
+
+// maskedValuer a sink that returns its secrets' values masked, e.g. CircleCI's xxxx1234, so they
+// can be compared with the values they should have
+type maskedValuer interface {
+	MaskedValues(target string) (map[string]string, error)
+}
+
+// newSink create the sink the repo is delivered through, reading its credentials from the
+// environment
+func newSink(repo config.Repo, s *config.Settings) (SecretSink, error) {
+	switch repo.Sink {
+	case config.SinkCircleCI, config.SinkCircleCIContext:
+		endpoint, ok := s.CircleCIEndpoint(repo.Endpoint)
+		if !ok {
+			return nil, fmt.Errorf("Unknown circleci endpoint: %s", repo.Endpoint)
+		}
+		apiURL := endpoint.URL + circleAPIPath
+		token, err := getEnvVar(endpoint.TokenEnv)
+		if err != nil {
+			return nil, err
+		}
+		if repo.Sink == config.SinkCircleCIContext {
+			contexts, err := NewCircleContexts(apiURL, token, endpoint.CACert)
+			if err != nil {
+				return nil, err
+			}
+			return contexts, nil
+		}
+		circle, err := NewCircle(apiURL, token, endpoint.CACert)
+		if err != nil {
+			return nil, err
+		}
+		return circle, nil
+	case config.SinkGitHub:
+		token, err := getEnvVar("GITHUB_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		github, err := NewGitHub(s.GitHub.APIURL, token)
+		if err != nil {
+			return nil, err
+		}
+		return github, nil
+	case config.SinkGitLab:
+		token, err := getEnvVar("GITLAB_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		gitlab, err := NewGitLab(s.GitLab.URL, token)
+		if err != nil {
+			return nil, err
+		}
+		return gitlab, nil
+	case config.SinkCredHub:
+		client, err := getEnvVar("CREDHUB_CLIENT")
+		if err != nil {
+			return nil, err
+		}
+		secret, err := getEnvVar("CREDHUB_SECRET")
+		if err != nil {
+			return nil, err
+		}
+		credhub, err := NewCredHub(s.CredHub.URL, s.CredHub.CACert, client, secret)
+		if err != nil {
+			return nil, err
+		}
+		return credhub, nil
+	case config.SinkVault:
+		auth, err := newVaultAuth(s.Vault.Auth)
+		if err != nil {
+			return nil, err
+		}
+		vault, err := NewVault(s.Vault.Address, s.Vault.CACert, s.Vault.Mount, cfIDs(s), auth)
+		if err != nil {
+			return nil, err
+		}
+		return vault, nil
+	case config.SinkKubernetes:
+		kubernetes, err := NewKubernetes(s.Kubernetes.Kubeconfig, s.Kubernetes.Context, s.Kubernetes.Namespace, cfIDs(s))
+		if err != nil {
+			return nil, err
+		}
+		return kubernetes, nil
+	case config.SinkBuildkite:
+		token, err := getEnvVar("BUILDKITE_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		buildkite, err := NewBuildkite(s.Buildkite.APIURL, token)
+		if err != nil {
+			return nil, err
+		}
+		return buildkite, nil
+	default:
+		return nil, fmt.Errorf("Unknown sink: %s", repo.Sink)
+	}
+}
+
+// cfIDs the ID of every cf in the settings, for sinks that put each cf's secrets somewhere
+// different
+func cfIDs(s *config.Settings) []string {
+	ids := []string{}
+	for _, cf := range s.Cfs {
+		ids = append(ids, cf.ID)
+	}
+	return ids
+}
+
+// cfIDOf the ID of the cf a secret belongs to, or "" if it is for every cf. A secret belongs to
+// a cf if its name ends in the cf's ID, e.g. CF_PASSWORD_STAGING. When the IDs of two cfs both
+// match, as PROD and AU_PROD do for CF_PASSWORD_AU_PROD, the longer one is the cf.
+func cfIDOf(name string, ids []string) string {
+	matched := ""
+	for _, id := range ids {
+		if strings.HasSuffix(name, "_"+id) && len(id) > len(matched) {
+			matched = id
+		}
+	}
+	return matched
+}
+
+// repoSinks delivers to each configured repo through the sink it is configured with. It is a
+// SecretSink itself, whose targets are the repos' String(), so the rest of torque does not need
+// to care which sink a repo uses.
+type repoSinks struct {
+	settings *config.Settings
+	repos    map[string]config.Repo
+	// sinks by the repos' SinkName(). Only the sinks some repo uses are created.
+	sinks map[string]SecretSink
+	// sinkErrs why each sink that could not be created was not, by SinkName()
+	sinkErrs map[string]error
+	// failed why each configured repo that could not be set up was not, by the repo's String().
+	// Everything done with one of these repos returns its error.
+	failed map[string]error
+}
+
+// newRepoSinks create the sinks used by the repos in the settings. A repo that cannot be set up,
+// e.g. as its sink's token is bad, is recorded in failed, so the other repos can still be used.
+func newRepoSinks(s *config.Settings) *repoSinks {
+	rs := &repoSinks{
+		settings: s,
+		repos:    map[string]config.Repo{},
+		sinks:    map[string]SecretSink{},
+		sinkErrs: map[string]error{},
+		failed:   map[string]error{},
+	}
+	for _, cfOrg := range s.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			for _, repo := range cfSpace.Repos {
+				if err := rs.add(repo); err != nil {
+					rs.failed[repo.String()] = err
+				}
+			}
+			// Only their builds are checked, nothing is delivered to them
+			for _, repo := range cfSpace.WaitForRepos() {
+				if err := rs.add(repo); err != nil {
+					rs.failed[repo.String()] = err
+				}
+			}
+		}
+	}
+	return rs
+}
+
+// add the repo, creating its sink if no other repo uses it. A sink that could not be created is
+// not tried again.
+func (rs *repoSinks) add(repo config.Repo) error {
+	rs.repos[repo.String()] = repo
+	if err, ok := rs.sinkErrs[repo.SinkName()]; ok {
+		return err
+	}
+	sink, ok := rs.sinks[repo.SinkName()]
+	if !ok {
+		var err error
+		if sink, err = newSink(repo, rs.settings); err != nil {
+			rs.sinkErrs[repo.SinkName()] = fmt.Errorf("Problem creating the %s sink: %v", repo.SinkName(), err)
+			return rs.sinkErrs[repo.SinkName()]
+		}
+		rs.sinks[repo.SinkName()] = sink
+	}
+	if configurer, ok := sink.(repoConfigurer); ok {
+		return configurer.ConfigureRepo(repo)
+	}
+	return nil
+}
+
+// adopt a repo that is no longer configured, such as one the state store says had a password,
+// so its env vars can be cleaned up. Repos that are still configured are left as they are.
+func (rs *repoSinks) adopt(repo config.Repo) error {
+	if _, ok := rs.repos[repo.String()]; ok {
+		return nil
+	}
+	if err := rs.add(repo); err != nil {
+		delete(rs.repos, repo.String())
+		return err
+	}
+	return nil
+}
+
+// lookup the sink for the repo and the repo's target in that sink
+func (rs *repoSinks) lookup(repo string) (SecretSink, string, error) {
+	r, ok := rs.repos[repo]
+	if !ok {
+		return nil, "", fmt.Errorf("Repo %s is not configured", repo)
+	}
+	if err, ok := rs.failed[repo]; ok {
+		return nil, "", err
+	}
+	return rs.sinks[r.SinkName()], r.Name, nil
+}
+
+func (rs *repoSinks) EnsureTarget(repo string) error {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return err
+	}
+	return sink.EnsureTarget(target)
+}
+
+func (rs *repoSinks) TargetReady(repo string) (bool, error) {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return false, err
+	}
+	return sink.TargetReady(target)
+}
+
+func (rs *repoSinks) SecretNames(repo string) (map[string]bool, error) {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return nil, err
+	}
+	return sink.SecretNames(target)
+}
+
+func (rs *repoSinks) SetSecret(repo string, name string, value string) error {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return err
+	}
+	return sink.SetSecret(target, name, value)
+}
+
+func (rs *repoSinks) SetStaticVars(repo string, vars map[string]string) error {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return err
+	}
+	return sink.SetStaticVars(target, vars)
+}
+
+func (rs *repoSinks) Delete(repo string, name string) error {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return err
+	}
+	return sink.Delete(target, name)
+}
+
+// BuildsInProgress the builds in progress for the repo, if its sink runs builds. Sinks that do
+// not have nothing to wait for.
+func (rs *repoSinks) BuildsInProgress(repo string) (int, error) {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return 0, err
+	}
+	checker, ok := sink.(buildChecker)
+	if !ok {
+		return 0, nil
+	}
+	return checker.BuildsInProgress(target)
+}
+
+// CreatesTarget whether EnsureTarget sets up the repo's target if it is not ready
+func (rs *repoSinks) CreatesTarget(repo string) bool {
+	sink, _, err := rs.lookup(repo)
+	if err != nil {
+		return false
+	}
+	_, ok := sink.(targetCreator)
+	return ok
+}
+
+// ManualSetup how to set up the repo's target by hand, or "" if its sink does not say
+func (rs *repoSinks) ManualSetup(repo string) string {
+	sink, _, err := rs.lookup(repo)
+	if err != nil {
+		return ""
+	}
+	if manual, ok := sink.(manualSetup); ok {
+		return manual.ManualSetup()
+	}
+	return ""
+}
+
+// MaskedValues the masked values of the repo's env vars by name, and whether its sink masks
+// values rather than hiding them completely. Sinks that hide them return false.
+func (rs *repoSinks) MaskedValues(repo string) (map[string]string, bool, error) {
+	sink, target, err := rs.lookup(repo)
+	if err != nil {
+		return nil, false, err
+	}
+	valuer, ok := sink.(maskedValuer)
+	if !ok {
+		return nil, false, nil
+	}
+	values, err := valuer.MaskedValues(target)
+	return values, true, err
+}
+
+// repoNames the String() of each repo, as repoSinks knows them
+func repoNames(repos []config.Repo) []string {
+	names := []string{}
+	for _, repo := range repos {
+		names = append(names, repo.String())
+	}
+	return names
+}
+
+// sinkTimeout how long a request to a sink's API may take, so that one that hangs cannot hold up
+// the rest of the run, or every later run under serve
+const sinkTimeout = 30 * time.Second
+
+// newSinkClient a client for a sink's API, timing its requests for the metrics. A nil transport
+// uses the default.
+func newSinkClient(api string, transport http.RoundTripper) *http.Client {
+	return &http.Client{Transport: newTimedTransport(api, transport), Timeout: sinkTimeout}
+}
+
+// apiClient a sink's JSON API: where it is, and the headers that authenticate each request
+type apiClient struct {
+	// name of the API, in errors and metrics
+	name    string
+	baseURL string
+	header  http.Header
+	client  *http.Client
+}
+
+// apiError an unsuccessful response from a sink's API
+type apiError struct {
+	API        string
+	StatusCode int
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.API, e.StatusCode, e.Body)
+}
+
+// isStatus whether the error is an unsuccessful response with the status code
+func isStatus(err error, statusCode int) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == statusCode
+}
+
+// newAPIClient a client for the API at baseURL, sending the header with each request. A nil
+// transport uses the default.
+func newAPIClient(name string, baseURL string, transport http.RoundTripper, header http.Header) *apiClient {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &apiClient{
+		name:    name,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		header:  header,
+		client:  newSinkClient(name, transport),
+	}
+}
+
+// do make the request, sending body and decoding the response into response as JSON. Either may
+// be nil.
+func (a *apiClient) do(method string, path string, body interface{}, response interface{}) error {
+	reqBody := &bytes.Buffer{}
+	if body != nil {
+		if err := json.NewEncoder(reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	// path is already escaped, so it is appended rather than parsed again
+	req, err := http.NewRequest(method, a.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	for name, values := range a.header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &apiError{API: a.name, StatusCode: res.StatusCode, Body: string(resBody)}
+	}
+	if response == nil || len(resBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resBody, response)
+}
+
+// newTransport a transport for a sink's API that also trusts the CA certificate in caCertFile,
+// for a private CA. An empty caCertFile trusts only the system's CAs.
+func newTransport(caCertFile string) (*http.Transport, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if caCertFile == "" {
+		return transport, nil
+	}
+	caCert, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates in %s", caCertFile)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
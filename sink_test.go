@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+func Test_RepoSinks_SendsEachRepoToItsSink(t *testing.T) {
+	circle := newFakeSink("govau/a")
+	other := newFakeSink("govau/a")
+	repos := []config.Repo{
+		{Name: "govau/a", Sink: config.SinkCircleCI},
+		{Name: "govau/a", Sink: "other"},
+	}
+	sinks := &repoSinks{
+		repos: map[string]config.Repo{},
+		sinks: map[string]SecretSink{config.SinkCircleCI: circle, "other": other},
+	}
+	for _, repo := range repos {
+		sinks.repos[repo.String()] = repo
+	}
+
+	names := repoNames(repos)
+	if names[0] != "govau/a" || names[1] != "other:govau/a" {
+		t.Fatalf("repoNames() expected circleci repos to keep their plain name, got %v", names)
+	}
+	for _, repo := range names {
+		if err := sinks.SetSecret(repo, "CF_PASSWORD_TEST", "new-"+repo); err != nil {
+			t.Fatalf("SetSecret() error: %v", err)
+		}
+	}
+	if got := circle.envVars["govau/a"]["CF_PASSWORD_TEST"]; got != "new-govau/a" {
+		t.Errorf("SetSecret() expected circleci repo to get its own value, got %s", got)
+	}
+	if got := other.envVars["govau/a"]["CF_PASSWORD_TEST"]; got != "new-other:govau/a" {
+		t.Errorf("SetSecret() expected other repo to get its own value, got %s", got)
+	}
+
+	// Neither fake runs builds, so there is nothing to wait for
+	if inProgress, err := sinks.BuildsInProgress("other:govau/a"); err != nil || inProgress != 0 {
+		t.Errorf("BuildsInProgress() expected 0 for a sink without builds, got %d, %v", inProgress, err)
+	}
+	if err := sinks.SetSecret("govau/unknown", "CF_PASSWORD_TEST", "new"); err == nil {
+		t.Error("SetSecret() expected an error for a repo that is not configured")
+	}
+}
+
+func Test_NewRepoSinks_SinkThatCannotBeCreated_FailsOnlyItsRepos(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer github.Close()
+	defer useSettings(t, fmt.Sprintf(`
+  github:
+    api_url: %s
+  orgs:
+  - name: org
+    spaces:
+    - name: space
+      repos:
+      - name: govau/a
+        sink: github
+    - name: other
+      repos:
+      - name: team/app
+        sink: gitlab
+  `, github.URL))()
+	os.Setenv("GITHUB_TOKEN", "token")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	os.Unsetenv("GITLAB_TOKEN")
+
+	sinks := newRepoSinks(settings)
+	if len(sinks.failed) != 1 || sinks.failed["gitlab:team/app"] == nil {
+		t.Fatalf("newRepoSinks() expected only gitlab:team/app to fail, got %v", sinks.failed)
+	}
+	if _, err := sinks.TargetReady("gitlab:team/app"); err == nil || !strings.Contains(err.Error(), "GITLAB_TOKEN") {
+		t.Errorf("TargetReady() expected the gitlab sink's error, got %v", err)
+	}
+	if ready, err := sinks.TargetReady("github:govau/a"); err != nil || !ready {
+		t.Errorf("TargetReady() expected the github repo to still be usable, got %v, %v", ready, err)
+	}
+}
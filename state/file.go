@@ -0,0 +1,120 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileStore keeps the state in a JSON file. The file is read and rewritten on every change,
+// which is fine for the few hundred credentials torque manages.
+type FileStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// NewFileStore a store backed by the JSON file at path, which is created on the first Put
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+func (f *FileStore) load() (map[string]Rotation, error) {
+	rotations := map[string]Rotation{}
+
+	bytes, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return rotations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Rotation{}
+	if err := json.Unmarshal(bytes, &list); err != nil {
+		return nil, err
+	}
+	for _, rotation := range list {
+		rotations[rotation.Key.String()] = rotation
+	}
+	return rotations, nil
+}
+
+func (f *FileStore) save(rotations map[string]Rotation) error {
+	bytes, err := json.MarshalIndent(sorted(rotations), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a half written file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Get the latest rotation of the credential, or nil if there is none
+func (f *FileStore) Get(key Key) (*Rotation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rotations, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	rotation, ok := rotations[key.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &rotation, nil
+}
+
+// Put replaces the latest rotation of the credential
+func (f *FileStore) Put(rotation Rotation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rotations, err := f.load()
+	if err != nil {
+		return err
+	}
+	rotations[rotation.Key.String()] = rotation
+	return f.save(rotations)
+}
+
+// List the latest rotation of every credential
+func (f *FileStore) List() ([]Rotation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rotations, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return sorted(rotations), nil
+}
+
+func sorted(rotations map[string]Rotation) []Rotation {
+	keys := []string{}
+	for key := range rotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := []Rotation{}
+	for _, key := range keys {
+		list = append(list, rotations[key])
+	}
+	return list
+}
@@ -0,0 +1,59 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/govau/torque/state"
+)
+
+func Test_FileStore_NoFile_ReturnsNothing(t *testing.T) {
+	store := state.NewFileStore(filepath.Join(os.TempDir(), "NoSuchFile.json"))
+	rotation, err := store.Get(state.Key{CfID: "TEST", Org: "org", Space: "space"})
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if rotation != nil {
+		t.Errorf("Get() expected nil for a missing file but got %+v", rotation)
+	}
+}
+
+func Test_FileStore_Put_CanBeReadBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := state.NewFileStore(filepath.Join(dir, "state.json"))
+	key := state.Key{CfID: "TEST", Org: "org", Space: "space"}
+	rotated := time.Date(2019, 5, 1, 6, 0, 0, 0, time.UTC)
+	for _, r := range []state.Rotation{
+		{Key: key, Username: "ci-org-space", LastRotated: rotated, Outcome: state.OutcomeRotated, Repos: []string{"govau/a"}},
+		{Key: state.Key{CfID: "TEST", Org: "org", Space: "other"}, Outcome: state.OutcomeFailed},
+	} {
+		if err := store.Put(r); err != nil {
+			t.Fatalf("Put() error: %v", err)
+		}
+	}
+
+	// A new store reads what the first one wrote
+	rotation, err := state.NewFileStore(filepath.Join(dir, "state.json")).Get(key)
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if rotation == nil || !rotation.LastRotated.Equal(rotated) || rotation.Repos[0] != "govau/a" {
+		t.Errorf("Get() expected the rotation that was put but got %+v", rotation)
+	}
+
+	rotations, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(rotations) != 2 {
+		t.Errorf("List() expected 2 rotations but got %d", len(rotations))
+	}
+}
@@ -0,0 +1,90 @@
+// Package state records what torque did in previous runs
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/govau/torque/config"
+)
+
+// Outcomes of a rotation
+const (
+	// OutcomeRotated the new password is in UAA and every repo
+	OutcomeRotated = "rotated"
+	// OutcomeStale the new password is in UAA, but some repos could not be updated
+	OutcomeStale = "stale"
+	// OutcomeFailed nothing changed
+	OutcomeFailed = "failed"
+	// OutcomeOffboarded the space was offboarded, its ci user deactivated or deleted and its
+	// env vars removed from its repos
+	OutcomeOffboarded = "offboarded"
+)
+
+// Key identifies a credential: the ci user of a space in one cf
+type Key struct {
+	CfID  string `json:"cf_id"`
+	Org   string `json:"org"`
+	Space string `json:"space"`
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.CfID, k.Org, k.Space)
+}
+
+// Rotation the latest rotation of a credential
+type Rotation struct {
+	Key
+	Username string `json:"username"`
+	// LastRotated when UAA was last given a new password, which is kept when a later attempt fails
+	LastRotated time.Time `json:"last_rotated"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	// Repos that have the password set at LastRotated
+	Repos []string `json:"repos"`
+	// StaleRepos that should have the password set at LastRotated, but do not
+	StaleRepos []string `json:"stale_repos,omitempty"`
+	// RepoConfigs the config of each of Repos and StaleRepos, by name, so a repo that is removed
+	// from the config can still be reached
+	RepoConfigs map[string]config.Repo `json:"repo_configs,omitempty"`
+}
+
+// Store keeps the latest rotation of each credential between runs
+type Store interface {
+	// Get the latest rotation of the credential, or nil if there is none
+	Get(key Key) (*Rotation, error)
+	// Put replaces the latest rotation of the credential
+	Put(rotation Rotation) error
+	// List the latest rotation of every credential
+	List() ([]Rotation, error)
+}
+
+// Types of store
+const (
+	// TypeNone keep nothing
+	TypeNone = ""
+	// TypeFile keep everything in a local JSON file
+	TypeFile = "file"
+)
+
+// New the store of the given type
+func New(storeType string, path string) (Store, error) {
+	switch storeType {
+	case TypeNone:
+		return Discard, nil
+	case TypeFile:
+		return NewFileStore(path), nil
+	default:
+		return nil, fmt.Errorf("Unknown state store type: %s", storeType)
+	}
+}
+
+// Discard a store that keeps nothing, for when no store is configured
+var Discard Store = nopStore{}
+
+type nopStore struct{}
+
+func (nopStore) Get(key Key) (*Rotation, error) { return nil, nil }
+func (nopStore) Put(rotation Rotation) error    { return nil }
+func (nopStore) List() ([]Rotation, error)      { return []Rotation{}, nil }
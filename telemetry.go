@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/govau/torque/metrics"
+	"github.com/govau/torque/schedule"
+	"github.com/govau/torque/state"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	rotationsTotal = registry.NewCounter("torque_rotations_total",
+		"Rotations of a ci user's password by outcome: rotated, stale (in UAA but not every repo) or failed.",
+		"cf_id", "org", "space", "outcome")
+	credentialAge = registry.NewGauge("torque_credential_age_seconds",
+		"Seconds since the ci user's password was last changed.",
+		"cf_id", "org", "space")
+	credentialInterval = registry.NewGauge("torque_credential_rotation_interval_seconds",
+		"The longest the ci user's password should go unchanged: its max_age plus the time between scheduled runs.",
+		"cf_id", "org", "space")
+	reposManaged = registry.NewGauge("torque_repos",
+		"Number of repos torque manages.")
+	apiDuration = registry.NewHistogram("torque_api_request_duration_seconds",
+		"Time taken by requests to UAA, the Cloud Controller and each sink's API.",
+		metrics.DefaultBuckets, "api")
+)
+
+// passwordsChanged when each configured credential's password last changed, for credentialAge
+var passwordsChanged = struct {
+	sync.Mutex
+	m map[state.Key]time.Time
+}{m: map[state.Key]time.Time{}}
+
+func init() {
+	registry.BeforeWrite(func() {
+		passwordsChanged.Lock()
+		defer passwordsChanged.Unlock()
+		credentialAge.Reset()
+		for key, changed := range passwordsChanged.m {
+			credentialAge.Set(time.Since(changed).Seconds(), key.CfID, key.Org, key.Space)
+		}
+	})
+}
+
+// observePasswordChanged note when the target's password last changed
+func observePasswordChanged(target rotationTarget, changed time.Time) {
+	if changed.IsZero() {
+		return
+	}
+	passwordsChanged.Lock()
+	defer passwordsChanged.Unlock()
+	for _, id := range target.cfIDs {
+		passwordsChanged.m[state.Key{CfID: id, Org: target.org, Space: target.space}] = changed
+	}
+}
+
+// updateConfigMetrics set the metrics that come from the config, and forget credentials that are
+// no longer configured. Credentials not seen yet start with their last rotation from the state store.
+func updateConfigMetrics() {
+	passwordsChanged.Lock()
+	defer passwordsChanged.Unlock()
+
+	configured := map[state.Key]time.Time{}
+	repos := map[string]bool{}
+	credentialInterval.Reset()
+	for _, cfOrg := range settings.Orgs {
+		for _, cfSpace := range cfOrg.Spaces {
+			for _, repo := range cfSpace.Repos {
+				repos[repo.String()] = true
+			}
+			interval := settings.MaxAgeFor(cfOrg, cfSpace) + schedulePeriod(settings.ScheduleFor(cfOrg, cfSpace))
+			for _, id := range rotatedCfIDs(cfSpace) {
+				key := state.Key{CfID: id, Org: cfOrg.Name, Space: cfSpace.Name}
+				credentialInterval.Set(interval.Seconds(), key.CfID, key.Org, key.Space)
+
+				if changed, ok := passwordsChanged.m[key]; ok {
+					configured[key] = changed
+					continue
+				}
+				entry, err := stateStore.Get(key)
+				if err != nil {
+					log.Printf("Problem reading state: %v", err)
+					continue
+				}
+				if entry != nil && !entry.LastRotated.IsZero() {
+					configured[key] = entry.LastRotated
+				}
+			}
+		}
+	}
+	passwordsChanged.m = configured
+	reposManaged.Set(float64(len(repos)))
+}
+
+// schedulePeriod roughly how long between runs on this schedule
+func schedulePeriod(spec string) time.Duration {
+	sched, err := schedule.Parse(spec)
+	if err != nil {
+		return 0
+	}
+	next := sched.Next(time.Now())
+	if next.IsZero() {
+		return 0
+	}
+	return sched.Next(next).Sub(next)
+}
+
+// timedTransport records how long each request to an API takes
+type timedTransport struct {
+	api  string
+	next http.RoundTripper
+}
+
+func newTimedTransport(api string, next http.RoundTripper) *timedTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &timedTransport{api: api, next: next}
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	apiDuration.Observe(time.Since(start).Seconds(), t.api)
+	return res, err
+}
+
+// serveMetrics serve /metrics on the listen address, in the background. The returned channel
+// receives the error if serving stops.
+func serveMetrics(address string) (<-chan error, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- http.Serve(listener, mux)
+	}()
+	log.Printf("Serving metrics on %s/metrics", address)
+	return errs, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/govau/torque/config"
+)
+
+// Vault a SecretSink delivering to a HashiCorp Vault KV version 2 secrets engine, whose targets
+// are the names of vault repos, templates of the path of each cf's secret. A secret's keys are
+// the env vars: those for one cf, e.g. CF_PASSWORD_STAGING, go in that cf's secret, and the rest,
+// e.g. CF_ORG, in every cf's secret. Each change writes a new version of the secret, so the
+// previous password can still be read from the version before.
+type Vault struct {
+	Mount string
+	api   *apiClient
+	auth  vaultAuth
+	// cfIDs every cf, sorted
+	cfIDs []string
+}
+
+// vaultAuth how to log in to Vault. The token method has the token, the others the body of their
+// login request.
+type vaultAuth struct {
+	method string
+	mount  string
+	token  string
+	login  map[string]string
+}
+
+// newVaultAuth read the credentials for the auth method from the environment
+func newVaultAuth(auth config.VaultAuth) (vaultAuth, error) {
+	switch auth.Method {
+	case config.VaultAuthAppRole:
+		roleID, err := getEnvVar("VAULT_ROLE_ID")
+		if err != nil {
+			return vaultAuth{}, err
+		}
+		secretID, err := getEnvVar("VAULT_SECRET_ID")
+		if err != nil {
+			return vaultAuth{}, err
+		}
+		return vaultAuth{method: auth.Method, mount: auth.Mount, login: map[string]string{
+			"role_id":   roleID,
+			"secret_id": secretID,
+		}}, nil
+	case config.VaultAuthKubernetes:
+		jwt, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+		if err != nil {
+			return vaultAuth{}, fmt.Errorf("Problem reading service account token: %v", err)
+		}
+		return vaultAuth{method: auth.Method, mount: auth.Mount, login: map[string]string{
+			"role": auth.Role,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		}}, nil
+	default:
+		token, err := getEnvVar("VAULT_TOKEN")
+		if err != nil {
+			return vaultAuth{}, err
+		}
+		return vaultAuth{method: config.VaultAuthToken, token: token}, nil
+	}
+}
+
+// NewVault Create new Vault instance, logging in with the auth method. The credentials are tested
+// and any error is returned.
+func NewVault(address string, caCertFile string, mount string, cfIDs []string, auth vaultAuth) (*Vault, error) {
+	transport, err := newTransport(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("Bad vault ca_cert: %v", err)
+	}
+	sorted := append([]string{}, cfIDs...)
+	sort.Strings(sorted)
+	v := &Vault{
+		Mount: strings.Trim(mount, "/"),
+		api:   newAPIClient("vault", address, transport, nil),
+		auth:  auth,
+		cfIDs: sorted,
+	}
+	if auth.token != "" {
+		v.api.header.Set("X-Vault-Token", auth.token)
+	}
+
+	if auth.method != config.VaultAuthToken {
+		if err := v.login(); err != nil {
+			return nil, err
+		}
+	}
+	self := struct {
+		Data struct {
+			DisplayName string `json:"display_name"`
+		} `json:"data"`
+	}{}
+	if err := v.do(http.MethodGet, "/v1/auth/token/lookup-self", nil, &self); err != nil {
+		return nil, fmt.Errorf("Bad vault token: %v", err)
+	}
+	if *verbose {
+		log.Printf("Vault Token belongs to %s", self.Data.DisplayName)
+	}
+	return v, nil
+}
+
+// login get a new token from the auth method
+func (v *Vault) login() error {
+	res := struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}{}
+	if err := v.api.do(http.MethodPost, fmt.Sprintf("/v1/auth/%s/login", v.auth.mount), v.auth.login, &res); err != nil {
+		return fmt.Errorf("Problem logging in to vault with %s: %v", v.auth.method, err)
+	}
+	v.api.header.Set("X-Vault-Token", res.Auth.ClientToken)
+	return nil
+}
+
+// do make the request, logging in again if the token has expired
+func (v *Vault) do(method string, path string, body interface{}, response interface{}) error {
+	err := v.api.do(method, path, body, response)
+	if isStatus(err, http.StatusForbidden) && v.auth.method != config.VaultAuthToken {
+		if err := v.login(); err != nil {
+			return err
+		}
+		return v.api.do(method, path, body, response)
+	}
+	return err
+}
+
+// secretPaths the path of each secret the env var goes in: its cf's, or every cf's
+func (v *Vault) secretPaths(target string, name string) ([]string, error) {
+	cfIDs := v.cfIDs
+	if id := cfIDOf(name, v.cfIDs); id != "" {
+		cfIDs = []string{id}
+	}
+
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, id := range cfIDs {
+		path, err := config.VaultPath(target, id)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// readSecret the latest version of the secret's data, and its version number. A secret that
+// does not exist, or whose latest version is deleted, is empty and version 0.
+func (v *Vault) readSecret(path string) (map[string]interface{}, int, error) {
+	secret := struct {
+		Data struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}{}
+	err := v.do(http.MethodGet, fmt.Sprintf("/v1/%s/data/%s", v.Mount, path), nil, &secret)
+	if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusNotFound {
+		// Vault still returns the metadata of a deleted version, which check-and-set needs
+		json.Unmarshal([]byte(apiErr.Body), &secret)
+		return map[string]interface{}{}, secret.Data.Metadata.Version, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if secret.Data.Data == nil {
+		secret.Data.Data = map[string]interface{}{}
+	}
+	return secret.Data.Data, secret.Data.Metadata.Version, nil
+}
+
+// updateSecret write a new version of the secret with the changes made by update, if it made any.
+// Check-and-set stops a change made since the secret was read being lost.
+func (v *Vault) updateSecret(path string, update func(data map[string]interface{}) bool) error {
+	data, version, err := v.readSecret(path)
+	if err != nil {
+		return err
+	}
+	if !update(data) {
+		return nil
+	}
+	body := map[string]interface{}{
+		"options": map[string]int{"cas": version},
+		"data":    data,
+	}
+	if err := v.do(http.MethodPost, fmt.Sprintf("/v1/%s/data/%s", v.Mount, path), body, nil); err != nil {
+		return fmt.Errorf("Problem writing %s/%s: %v", v.Mount, path, err)
+	}
+	return nil
+}
+
+// EnsureTarget Vault paths need nothing creating
+func (v *Vault) EnsureTarget(target string) error {
+	_, err := v.secretPaths(target, "")
+	return err
+}
+
+// TargetReady Vault paths are always ready
+func (v *Vault) TargetReady(target string) (bool, error) {
+	_, err := v.secretPaths(target, "")
+	return err == nil, err
+}
+
+// SecretNames the keys in any of the cfs' secrets
+func (v *Vault) SecretNames(target string) (map[string]bool, error) {
+	paths, err := v.secretPaths(target, "")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, path := range paths {
+		data, _, err := v.readSecret(path)
+		if err != nil {
+			return nil, err
+		}
+		for name := range data {
+			names[name] = true
+		}
+	}
+	return names, nil
+}
+
+// SetSecret write a new version of each secret the env var goes in
+func (v *Vault) SetSecret(target string, name string, value string) error {
+	paths, err := v.secretPaths(target, name)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err := v.updateSecret(path, func(data map[string]interface{}) bool {
+			data[name] = value
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetStaticVars add the vars missing from each secret, in one new version of the secret
+func (v *Vault) SetStaticVars(target string, vars map[string]string) error {
+	missing := map[string]map[string]string{}
+	paths := []string{}
+	for name, value := range vars {
+		varPaths, err := v.secretPaths(target, name)
+		if err != nil {
+			return err
+		}
+		for _, path := range varPaths {
+			if missing[path] == nil {
+				missing[path] = map[string]string{}
+				paths = append(paths, path)
+			}
+			missing[path][name] = value
+		}
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		err := v.updateSecret(path, func(data map[string]interface{}) bool {
+			changed := false
+			for name, value := range missing[path] {
+				if _, ok := data[name]; !ok {
+					data[name] = value
+					changed = true
+				}
+			}
+			return changed
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete remove the env var from each secret it is in, in a new version of the secret
+func (v *Vault) Delete(target string, name string) error {
+	paths, err := v.secretPaths(target, name)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err := v.updateSecret(path, func(data map[string]interface{}) bool {
+			_, ok := data[name]
+			delete(data, name)
+			return ok
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
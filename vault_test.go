@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/govau/torque/config"
+)
+
+// fakeVault a Vault with AppRole auth and a KV version 2 secrets engine at secret/, keeping every
+// version of each secret
+type fakeVault struct {
+	mu sync.Mutex
+	// tokens the valid tokens. Deleting one expires it.
+	tokens  map[string]bool
+	logins  int
+	secrets map[string][]map[string]interface{}
+}
+
+func newFakeVault() (*fakeVault, *httptest.Server) {
+	f := &fakeVault{tokens: map[string]bool{}, secrets: map[string][]map[string]interface{}{}}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "torque" || body["secret_id"] != "test-secret" {
+			http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+			return
+		}
+		f.logins++
+		token := fmt.Sprintf("token-%d", f.logins)
+		f.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]map[string]string{"auth": {"client_token": token}})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == "/v1/auth/token/lookup-self" {
+		json.NewEncoder(w).Encode(map[string]map[string]string{"data": {"display_name": "approle"}})
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v1/secret/data/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+	versions := f.secrets[path]
+	switch r.Method {
+	case http.MethodGet:
+		if len(versions) == 0 {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"data":     versions[len(versions)-1],
+			"metadata": map[string]int{"version": len(versions)},
+		}})
+	case http.MethodPost:
+		body := struct {
+			Options struct {
+				CAS int `json:"cas"`
+			} `json:"options"`
+			Data map[string]interface{} `json:"data"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Options.CAS != len(versions) {
+			http.Error(w, `{"errors":["check-and-set parameter did not match the current version"]}`, http.StatusBadRequest)
+			return
+		}
+		f.secrets[path] = append(versions, body.Data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_Vault_KeepsPreviousPasswordVersion(t *testing.T) {
+	fake, server := newFakeVault()
+	defer server.Close()
+
+	auth := vaultAuth{method: config.VaultAuthAppRole, mount: "approle", login: map[string]string{"role_id": "torque", "secret_id": "test-secret"}}
+	v, err := NewVault(server.URL, "", "secret", []string{"STAGING", "PROD"}, auth)
+	if err != nil {
+		t.Fatalf("NewVault() error: %v", err)
+	}
+	target := "torque/dta/prod/{{.CfID}}"
+
+	if err := v.SetStaticVars(target, map[string]string{"CF_ORG": "dta", "CF_API_STAGING": "https://api.staging"}); err != nil {
+		t.Fatalf("SetStaticVars() error: %v", err)
+	}
+	if err := v.SetSecret(target, "CF_PASSWORD_STAGING", "first-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+	// The token expires, and torque logs in again
+	fake.tokens = map[string]bool{}
+	if err := v.SetSecret(target, "CF_PASSWORD_STAGING", "second-password"); err != nil {
+		t.Fatalf("SetSecret() error: %v", err)
+	}
+
+	staging := fake.secrets["torque/dta/prod/STAGING"]
+	if len(staging) != 3 {
+		t.Fatalf("expected 3 versions of the staging secret, got %v", staging)
+	}
+	if got := staging[2]["CF_PASSWORD_STAGING"]; got != "second-password" {
+		t.Errorf("SetSecret() expected the latest version to have the second password, got %v", got)
+	}
+	if got := staging[1]["CF_PASSWORD_STAGING"]; got != "first-password" {
+		t.Errorf("SetSecret() expected the previous version to keep the first password, got %v", got)
+	}
+	if got := staging[2]["CF_ORG"]; got != "dta" {
+		t.Errorf("SetSecret() expected the static vars to be kept, got %v", staging[2])
+	}
+
+	prod := fake.secrets["torque/dta/prod/PROD"]
+	if len(prod) != 1 || prod[0]["CF_ORG"] != "dta" {
+		t.Errorf("SetStaticVars() expected the prod secret to have CF_ORG, got %v", prod)
+	}
+	if _, ok := prod[0]["CF_API_STAGING"]; ok {
+		t.Errorf("SetStaticVars() expected CF_API_STAGING only in the staging secret, got %v", prod[0])
+	}
+
+	names, err := v.SecretNames(target)
+	if err != nil {
+		t.Fatalf("SecretNames() error: %v", err)
+	}
+	for _, name := range []string{"CF_ORG", "CF_API_STAGING", "CF_PASSWORD_STAGING"} {
+		if !names[name] {
+			t.Errorf("SecretNames() expected %s, got %v", name, names)
+		}
+	}
+}
+
+func Test_Vault_BadSecretID_ReturnsError(t *testing.T) {
+	_, server := newFakeVault()
+	defer server.Close()
+
+	auth := vaultAuth{method: config.VaultAuthAppRole, mount: "approle", login: map[string]string{"role_id": "torque", "secret_id": "wrong-secret"}}
+	if _, err := NewVault(server.URL, "", "secret", []string{"STAGING"}, auth); err == nil {
+		t.Error("NewVault() expected an error for a bad secret ID")
+	}
+}
+
+func Test_Vault_SecretPaths_OverlappingIDs_PicksLongest(t *testing.T) {
+	v := &Vault{cfIDs: []string{"PROD", "SYD_PROD"}}
+	target := "torque/dta/prod/{{.CfID}}"
+
+	for name, expected := range map[string][]string{
+		"CF_PASSWORD_PROD":     {"torque/dta/prod/PROD"},
+		"CF_PASSWORD_SYD_PROD": {"torque/dta/prod/SYD_PROD"},
+		"CF_ORG":               {"torque/dta/prod/PROD", "torque/dta/prod/SYD_PROD"},
+	} {
+		paths, err := v.secretPaths(target, name)
+		if err != nil {
+			t.Fatalf("secretPaths(%s) error: %v", name, err)
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("secretPaths(%s) expected %v but was %v", name, expected, paths)
+		}
+	}
+}